@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+	logkit "gitlab.com/gitlab-org/labkit/log"
+	"gitlab.com/gitlab-org/labkit/tracing"
+
+	"gitlab.com/gitlab-org/gitlab-elasticsearch-indexer/elastic"
+	"gitlab.com/gitlab-org/gitlab-elasticsearch-indexer/git"
+	"gitlab.com/gitlab-org/gitlab-elasticsearch-indexer/indexer"
+	"gitlab.com/gitlab-org/gitlab-elasticsearch-indexer/server"
+)
+
+// batch indexes every project of a manifest, sharing one Elasticsearch
+// client and a pool of Gitaly connections between them as serve does
+func batch(args []string) {
+	if len(args) != 1 {
+		error := errors.New("WrongArguments")
+		logkit.WithError(error).Fatalf("Usage: %s [--batch-concurrency=<batch-concurrency>] [--batch-report=<path>] batch (<manifest>|-)", os.Args[0])
+	}
+
+	input := os.Stdin
+	if args[0] != "-" {
+		file, err := os.Open(args[0])
+		if err != nil {
+			logkit.WithError(err).WithField("manifest", args[0]).Fatal("Error opening manifest")
+		}
+		defer file.Close()
+
+		input = file
+	}
+
+	entries, err := server.ReadManifest(input)
+	if err != nil {
+		logkit.WithError(err).WithField("manifest", args[0]).Fatal("Error reading manifest")
+	}
+
+	config, err := elastic.ConfigFromEnv()
+	if err != nil {
+		logkit.WithError(err).Fatalf("Error loading config")
+	}
+
+	// Every job has a span of its own
+	closer := tracing.Initialize(tracing.WithServiceName(serviceName))
+	defer closer.Close()
+
+	esClient, err := elastic.NewClient(config, generateCorrelationID())
+	if err != nil {
+		logkit.WithError(err).Fatal("Error creating elastic client")
+	}
+	defer esClient.Close()
+
+	pool := git.NewConnectionPool()
+	defer pool.Close()
+
+	encoders := indexer.NewEncoderPool()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	logkit.WithFields(
+		logkit.Fields{
+			"manifest":    args[0],
+			"projects":    len(entries),
+			"concurrency": *batchConcurrencyFlag,
+		},
+	).Info("Starting batch")
+
+	report := server.RunBatch(ctx, func(ctx context.Context, request *server.JobRequest) (*server.JobResult, error) {
+		return runJob(ctx, esClient, pool, encoders, request)
+	}, entries, server.Options{Concurrency: *batchConcurrencyFlag})
+
+	if *batchReportFlag != "" {
+		if err := writeBatchReport(*batchReportFlag, report); err != nil {
+			logkit.WithError(err).WithField("batchReport", *batchReportFlag).Error("Error writing batch report")
+		}
+	}
+
+	fields := logkit.Fields{
+		"jobs":           report.Summary.Jobs,
+		"succeeded":      report.Summary.Succeeded,
+		"failed":         report.Summary.Failed,
+		"canceled":       report.Summary.Canceled,
+		"failedProjects": report.Summary.FailedProjects,
+	}
+
+	switch {
+	case ctx.Err() != nil:
+		logkit.WithFields(fields).WithError(ctx.Err()).Error("The batch was interrupted")
+		logrus.Exit(exitCodeInterrupted)
+	case len(report.Summary.FailedProjects) > 0:
+		logkit.WithFields(fields).Error("Batch finished with failures")
+		logrus.Exit(1)
+	default:
+		logkit.WithFields(fields).Info("Batch finished")
+	}
+}
+
+func writeBatchReport(path string, report *server.BatchReport) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	if err := report.Write(file); err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
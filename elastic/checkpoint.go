@@ -0,0 +1,64 @@
+package elastic
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/olivere/elastic/v7"
+
+	"gitlab.com/gitlab-org/gitlab-elasticsearch-indexer/indexer"
+)
+
+// CheckpointStore keeps the checkpoint of a project as a document of its
+// own index, since the GitLab indices have a strict mapping
+type CheckpointStore struct {
+	client *elastic.Client
+	index  string
+	id     string
+}
+
+func (c *Client) NewCheckpointStore(blobType string) *CheckpointStore {
+	index := c.IndexNameCheckpoints
+	if index == "" {
+		index = c.IndexNameDefault + "-checkpoints"
+	}
+
+	return &CheckpointStore{
+		client: c.Client,
+		index:  index,
+		id:     fmt.Sprintf("project_%v_%v", c.ProjectID, blobType),
+	}
+}
+
+func (s *CheckpointStore) Load(ctx context.Context) (*indexer.Checkpoint, error) {
+	result, err := s.client.Get().Index(s.index).Id(s.id).Do(ctx)
+	if elastic.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	checkpoint := new(indexer.Checkpoint)
+	if err := json.Unmarshal(result.Source, checkpoint); err != nil {
+		return nil, fmt.Errorf("Checkpoint %s/%s: %s", s.index, s.id, err)
+	}
+
+	return checkpoint, nil
+}
+
+func (s *CheckpointStore) Save(ctx context.Context, checkpoint *indexer.Checkpoint) error {
+	_, err := s.client.Index().Index(s.index).Id(s.id).BodyJson(checkpoint).Do(ctx)
+
+	return err
+}
+
+func (s *CheckpointStore) Clear(ctx context.Context) error {
+	_, err := s.client.Delete().Index(s.index).Id(s.id).Do(ctx)
+	if err != nil && !elastic.IsNotFound(err) {
+		return err
+	}
+
+	return nil
+}
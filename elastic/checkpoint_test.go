@@ -0,0 +1,98 @@
+package elastic_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-elasticsearch-indexer/elastic"
+	"gitlab.com/gitlab-org/gitlab-elasticsearch-indexer/indexer"
+)
+
+// documentServer keeps documents in memory, keyed by URL path
+func documentServer(t *testing.T) (*httptest.Server, map[string]string) {
+	var mu sync.Mutex
+	docs := make(map[string]string)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+
+		switch r.Method {
+		case http.MethodPut, http.MethodPost:
+			body, err := io.ReadAll(r.Body)
+			require.NoError(t, err)
+			docs[r.URL.Path] = string(body)
+			w.Write([]byte(`{"result":"created"}`))
+		case http.MethodGet:
+			doc, ok := docs[r.URL.Path]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte(`{"found":false}`))
+				return
+			}
+			w.Write([]byte(`{"found":true,"_source":` + doc + `}`))
+		case http.MethodDelete:
+			if _, ok := docs[r.URL.Path]; !ok {
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte(`{"result":"not_found"}`))
+				return
+			}
+			delete(docs, r.URL.Path)
+			w.Write([]byte(`{"result":"deleted"}`))
+		}
+	}))
+
+	return srv, docs
+}
+
+func TestCheckpointStore(t *testing.T) {
+	ctx := context.Background()
+
+	srv, docs := documentServer(t)
+	defer srv.Close()
+
+	config, err := elastic.ReadConfig(strings.NewReader(
+		`{
+			"url":["` + srv.URL + `"],
+			"index_name": "gitlab-test"
+		}`,
+	))
+	require.NoError(t, err)
+	config.ProjectID = projectID
+
+	client, err := elastic.NewClient(config, "the-correlation-id")
+	require.NoError(t, err)
+	defer client.Close()
+
+	store := client.NewCheckpointStore("wiki_blob")
+
+	checkpoint, err := store.Load(ctx)
+	require.NoError(t, err)
+	require.Nil(t, checkpoint)
+
+	saved := &indexer.Checkpoint{FromSHA: "from", ToSHA: "to", BlobType: "wiki_blob", BlobOffset: 42, LastPath: "foo"}
+	require.NoError(t, store.Save(ctx, saved))
+	require.Contains(t, docs, "/gitlab-test-checkpoints/_doc/project_667_wiki_blob")
+
+	var stored indexer.Checkpoint
+	require.NoError(t, json.Unmarshal([]byte(docs["/gitlab-test-checkpoints/_doc/project_667_wiki_blob"]), &stored))
+	require.Equal(t, *saved, stored)
+
+	checkpoint, err = store.Load(ctx)
+	require.NoError(t, err)
+	require.Equal(t, saved, checkpoint)
+
+	require.NoError(t, store.Clear(ctx))
+	require.NoError(t, store.Clear(ctx))
+	require.Empty(t, docs)
+}
@@ -7,9 +7,14 @@ import (
 	"net/http"
 	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
 	logkit "gitlab.com/gitlab-org/labkit/log"
+	"gitlab.com/gitlab-org/labkit/tracing"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
@@ -18,6 +23,7 @@ import (
 	"github.com/deoxxa/aws_signing_client"
 	"github.com/olivere/elastic/v7"
 	"gitlab.com/gitlab-org/gitlab-elasticsearch-indexer/indexer"
+	"gitlab.com/gitlab-org/gitlab-elasticsearch-indexer/metrics"
 )
 
 var (
@@ -25,14 +31,50 @@ var (
 )
 
 type Client struct {
-	IndexNameDefault string
-	IndexNameCommits string
-	ProjectID        int64
-	Permissions      *indexer.ProjectPermissions
-	maxBulkSize      int
-	Client           *elastic.Client
-	bulk             *elastic.BulkProcessor
-	bulkFailed       bool
+	IndexNameDefault     string
+	IndexNameCommits     string
+	IndexNameWikis       string
+	IndexNameBlobs       string
+	IndexNameCheckpoints string
+	IndexNameStatus      string
+	ProjectID            int64
+	Permissions          *indexer.ProjectPermissions
+	maxBulkSize          int
+	maxBulkAttempts      int
+	bulkRetryBackoff     time.Duration
+	Client               *elastic.Client
+	bulk                 *elastic.BulkProcessor
+	bulkFailed           int32
+	retries              pendingRetries
+	failures             failures
+
+	// bulkSpan is the parent of the spans of bulk requests, if any
+	bulkSpan opentracing.SpanContext
+
+	// bulks holds the bulk requests being committed, by execution ID
+	bulks sync.Map
+
+	// indexNames are the indices of the document types that aren't kept
+	// in IndexNameDefault
+	indexNames map[string]string
+
+	// config is kept to create the clients of other projects
+	config *Config
+
+	// shared is set on clients created by ForProject, whose connections
+	// belong to another client
+	shared bool
+
+	// Once closed, the bulk processor doesn't accept the items being
+	// retried anymore
+	closeMu sync.RWMutex
+	closed  bool
+}
+
+// bulkExecution is a bulk request being committed by the bulk processor
+type bulkExecution struct {
+	started time.Time
+	span    opentracing.Span
 }
 
 // ConfigFromEnv creates a Config from the `ELASTIC_CONNECTION_INFO`
@@ -45,6 +87,26 @@ func ConfigFromEnv() (*Config, error) {
 		return nil, fmt.Errorf("Couldn't parse ELASTIC_CONNECTION_INFO: %s", err)
 	}
 
+	setDefaultIndexName(config)
+
+	return config, nil
+}
+
+// DryRunConfigFromEnv is like ConfigFromEnv, except that
+// `ELASTIC_CONNECTION_INFO` is optional since a dry run only needs the
+// index names
+func DryRunConfigFromEnv() (*Config, error) {
+	if os.Getenv("ELASTIC_CONNECTION_INFO") != "" {
+		return ConfigFromEnv()
+	}
+
+	config := new(Config)
+	setDefaultIndexName(config)
+
+	return config, nil
+}
+
+func setDefaultIndexName(config *Config) {
 	if config.IndexNameDefault == "" {
 		railsEnv := os.Getenv("RAILS_ENV")
 		indexName := "gitlab"
@@ -53,17 +115,67 @@ func ConfigFromEnv() (*Config, error) {
 		}
 		config.IndexNameDefault = indexName
 	}
-
-	return config, nil
 }
 
 func (c *Client) UseSeparateIndexForCommits() bool {
-	return c.IndexNameCommits != "" && c.IndexNameCommits != c.IndexNameDefault
+	return useSeparateIndex("commit", c.IndexNameDefault, c.indexNames)
+}
+
+func (c *Client) UseSeparateIndexForWikis() bool {
+	return useSeparateIndex("wiki_blob", c.IndexNameDefault, c.indexNames)
+}
+
+func (c *Client) UseSeparateIndexForBlobs() bool {
+	return useSeparateIndex("blob", c.IndexNameDefault, c.indexNames)
+}
+
+func useSeparateIndex(documentType, indexNameDefault string, indexNames map[string]string) bool {
+	name := indexNames[documentType]
+	return name != "" && name != indexNameDefault
+}
+
+func (c *Client) beforeCallback(executionId int64, requests []elastic.BulkableRequest) {
+	// Sources are cached by the requests, so they aren't built twice
+	size := 0
+	for _, req := range requests {
+		lines, err := req.Source()
+		if err != nil {
+			continue
+		}
+		for _, line := range lines {
+			size += len(line) + 1
+		}
+	}
+
+	metrics.BulkRequestsTotal.Inc()
+	metrics.BulkBytesTotal.Add(float64(size))
+
+	span := opentracing.StartSpan("elasticsearch.bulk", opentracing.ChildOf(c.bulkSpan))
+	span.SetTag("project_id", c.ProjectID)
+	span.SetTag("bulk_request_id", executionId)
+	span.SetTag("requests", len(requests))
+	span.SetTag("bytes", size)
+
+	c.bulks.Store(executionId, &bulkExecution{started: time.Now(), span: span})
 }
 
 func (c *Client) afterCallback(executionId int64, requests []elastic.BulkableRequest, response *elastic.BulkResponse, err error) {
+	if value, ok := c.bulks.LoadAndDelete(executionId); ok {
+		execution := value.(*bulkExecution)
+		metrics.BulkRequestDuration.Observe(time.Since(execution.started).Seconds())
+
+		if err != nil {
+			ext.LogError(execution.span, err)
+		}
+		if response != nil {
+			execution.span.SetTag("failed", len(response.Failed()))
+		}
+		execution.span.Finish()
+	}
+
 	if err != nil {
-		c.bulkFailed = true
+		c.setBulkFailed()
+		metrics.BulkFailuresTotal.WithLabelValues("request").Inc()
 
 		if elastic.IsStatusCode(err, http.StatusRequestEntityTooLarge) {
 			logkit.WithFields(
@@ -79,25 +191,135 @@ func (c *Client) afterCallback(executionId int64, requests []elastic.BulkableReq
 				},
 			).WithError(err).Error("Bulk request failed")
 		}
+
+		for _, req := range requests {
+			c.failures.add(failedRequest(req, err))
+		}
 	}
 
 	// bulk response can be nil in some cases, we must check first
 	if response != nil && response.Errors {
-		failedBulkResponseItems := response.Failed()
-		numFailed := len(failedBulkResponseItems)
-		if numFailed > 0 {
-			c.bulkFailed = true
-			total := numFailed + len(response.Succeeded())
+		var failed []*elastic.BulkResponseItem
+		retried := 0
+
+		// The bulk processor doesn't retry items itself, so response items
+		// are 1 to 1 with requests, in the same order
+		for i, result := range response.Items {
+			for _, item := range result {
+				if item.Status >= 200 && item.Status <= 299 {
+					continue
+				}
+
+				if req, ok := requests[i].(*bulkRequest); ok && req.isDone(item.Status) {
+					continue
+				}
+
+				if c.retry(requests[i], item) {
+					retried++
+				} else {
+					failed = append(failed, item)
+					c.failures.add(failedDocument(requests[i], item))
+				}
+			}
+		}
+
+		total := len(response.Items)
 
-			logkit.WithField("bulkRequestId", executionId).Errorf("Bulk request failed to insert %d/%d documents", numFailed, total)
+		metrics.BulkFailuresTotal.WithLabelValues("retry").Add(float64(retried))
+		metrics.BulkFailuresTotal.WithLabelValues("document").Add(float64(len(failed)))
+
+		if retried > 0 {
+			logkit.WithField("bulkRequestId", executionId).Warnf("Bulk request will retry %d/%d documents", retried, total)
 		}
+
+		if len(failed) > 0 {
+			c.setBulkFailed()
+
+			logkit.WithField("bulkRequestId", executionId).Errorf("Bulk request failed to insert %d/%d documents", len(failed), total)
+
+			for _, item := range failed {
+				logFailedItem(executionId, item)
+			}
+		}
+	}
+}
+
+// retry adds the request of a failed item to the bulk processor again after
+// a backoff, unless its failure is permanent or it has been attempted too
+// many times. It reports whether the request will be retried.
+func (c *Client) retry(request elastic.BulkableRequest, item *elastic.BulkResponseItem) bool {
+	req, ok := request.(*bulkRequest)
+	if !ok || !req.isRetryable(item.Status) {
+		return false
+	}
+
+	req.attempt++
+	if req.attempt >= c.maxBulkAttempts || c.isClosed() {
+		return false
+	}
+
+	c.retries.add()
+	time.AfterFunc(retryBackoff(c.bulkRetryBackoff, req.attempt), func() {
+		defer c.retries.done()
+
+		c.closeMu.RLock()
+		defer c.closeMu.RUnlock()
+
+		// Retries still pending once the client is closed are given up
+		if c.closed {
+			c.setBulkFailed()
+			c.failures.add(failedDocument(req, item))
+			return
+		}
+
+		c.bulk.Add(req)
+	})
+
+	return true
+}
+
+// setBulkFailed makes Flush fail. It's called by the bulk workers and by the
+// retries, concurrently.
+func (c *Client) setBulkFailed() {
+	atomic.StoreInt32(&c.bulkFailed, 1)
+}
+
+func (c *Client) isClosed() bool {
+	c.closeMu.RLock()
+	defer c.closeMu.RUnlock()
+
+	return c.closed
+}
+
+func logFailedItem(executionId int64, item *elastic.BulkResponseItem) {
+	fields := logkit.Fields{
+		"bulkRequestId": executionId,
+		"index":         item.Index,
+		"id":            item.Id,
+		"status":        item.Status,
+	}
+
+	if item.Error != nil {
+		fields["errorType"] = item.Error.Type
+		fields["errorReason"] = item.Error.Reason
 	}
+
+	logkit.WithFields(fields).Error("Bulk request item failed")
 }
 
 func NewClient(config *Config, correlationID string) (*Client, error) {
+	return NewClientWithContext(context.Background(), config, correlationID)
+}
+
+// NewClientWithContext creates a Client whose bulk requests are traced as
+// children of the span of ctx, if any. The trace context is sent to
+// Elasticsearch in the headers of every request.
+func NewClientWithContext(ctx context.Context, config *Config, correlationID string) (*Client, error) {
 	var opts []elastic.ClientOptionFunc
 
-	httpClient := &http.Client{}
+	httpClient := &http.Client{
+		Transport: tracing.NewRoundTripper(http.DefaultTransport),
+	}
 	if config.RequestTimeout != 0 {
 		httpClient.Timeout = time.Duration(config.RequestTimeout) * time.Second
 	}
@@ -116,9 +338,7 @@ func NewClient(config *Config, correlationID string) (*Client, error) {
 
 		opts = append(opts, elastic.SetHttpClient(awsClient))
 	} else {
-		if config.RequestTimeout != 0 {
-			opts = append(opts, elastic.SetHttpClient(httpClient))
-		}
+		opts = append(opts, elastic.SetHttpClient(httpClient))
 	}
 
 	// Sniffer should look for HTTPS URLs if at-least-one initial URL is HTTPS
@@ -142,20 +362,61 @@ func NewClient(config *Config, correlationID string) (*Client, error) {
 		return nil, err
 	}
 
+	return newClient(ctx, client, config)
+}
+
+// ForProject creates a Client for another project, sharing the connections
+// of c. It has a bulk processor of its own, which is stopped by Close.
+func (c *Client) ForProject(ctx context.Context, projectID int64, permissions *indexer.ProjectPermissions) (*Client, error) {
+	config := *c.config
+	config.ProjectID = projectID
+	config.Permissions = permissions
+
+	client, err := newClient(ctx, c.Client, &config)
+	if err != nil {
+		return nil, err
+	}
+	client.shared = true
+
+	return client, nil
+}
+
+func newClient(ctx context.Context, client *elastic.Client, config *Config) (*Client, error) {
+	indexNames := config.indexNames()
+
 	wrappedClient := &Client{
-		IndexNameDefault: config.IndexNameDefault,
-		IndexNameCommits: config.IndexNameCommits,
-		ProjectID:        config.ProjectID,
-		Permissions:      config.Permissions,
-		maxBulkSize:      config.MaxBulkSize,
-		Client:           client,
+		IndexNameDefault:     config.IndexNameDefault,
+		IndexNameCommits:     indexNames["commit"],
+		IndexNameWikis:       indexNames["wiki_blob"],
+		IndexNameBlobs:       indexNames["blob"],
+		IndexNameCheckpoints: config.IndexNameCheckpoints,
+		IndexNameStatus:      config.IndexNameStatus,
+		ProjectID:            config.ProjectID,
+		Permissions:          config.Permissions,
+		maxBulkSize:          config.MaxBulkSize,
+		maxBulkAttempts:      config.MaxBulkAttempts,
+		bulkRetryBackoff:     time.Duration(config.BulkRetryBackoff) * time.Millisecond,
+		Client:               client,
+		indexNames:           indexNames,
+		config:               config,
+	}
+
+	// The bulk processor sends every request with the context it's started
+	// with, so it only gets the span of ctx, not its cancellation
+	bulkCtx := context.Background()
+	if span := opentracing.SpanFromContext(ctx); span != nil {
+		wrappedClient.bulkSpan = span.Context()
+		bulkCtx = opentracing.ContextWithSpan(bulkCtx, span)
 	}
 
 	bulk, err := client.BulkProcessor().
 		Workers(config.BulkWorkers).
 		BulkSize(config.MaxBulkSize).
+		// Failed items are retried by afterCallback, with a limit
+		RetryItemStatusCodes().
+		Before(wrappedClient.beforeCallback).
 		After(wrappedClient.afterCallback).
-		Do(context.Background())
+		Do(bulkCtx)
 
 	if err != nil {
 		return nil, err
@@ -196,36 +457,104 @@ func (c *Client) ProjectPermissions() *indexer.ProjectPermissions {
 	return c.Permissions
 }
 
-func (c *Client) Flush() error {
-	err := c.bulk.Flush()
+// Flush waits for the bulk processor to commit every queued request,
+// including the items being retried. The bulk processor can't be
+// interrupted, so once ctx is done we stop waiting and the requests still in
+// flight are abandoned.
+func (c *Client) Flush(ctx context.Context) error {
+	for {
+		_, readded := c.retries.wait()
+
+		done := make(chan error, 1)
+		go func() { done <- c.bulk.Flush() }()
+
+		select {
+		case err := <-done:
+			if err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 
-	if err == nil && c.bulkFailed {
-		err = fmt.Errorf("Failed to perform all operations")
+		// Retries are scheduled while the bulk processor commits, and may
+		// be added again to a worker that was already flushed, so we flush
+		// until none was added again since the last flush started
+		if retrying, _ := c.retries.wait(); retrying != nil {
+			select {
+			case <-retrying:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		if _, n := c.retries.wait(); n == readded {
+			break
+		}
 	}
 
-	return err
+	if atomic.LoadInt32(&c.bulkFailed) != 0 {
+		return fmt.Errorf("Failed to perform all operations")
+	}
+
+	return nil
 }
 
+// Close stops the bulk processor, which commits the requests still queued,
+// and gives up the retries still pending. A client created by ForProject
+// then leaves the connections open for the other projects, while others stop
+// them.
 func (c *Client) Close() {
-	c.Client.Stop()
+	c.closeMu.Lock()
+	c.closed = true
+	c.closeMu.Unlock()
+
+	c.bulk.Close()
+
+	if !c.shared {
+		c.Client.Stop()
+	}
 }
 
 func (c *Client) indexNameFor(documentType string) string {
-	if documentType == "commit" && c.IndexNameCommits != "" {
-		return c.IndexNameCommits
-	} else {
-		return c.IndexNameDefault
+	return indexNameFor(documentType, c.IndexNameDefault, c.indexNames)
+}
+
+func indexNameFor(documentType, indexNameDefault string, indexNames map[string]string) string {
+	if name := indexNames[documentType]; name != "" {
+		return name
 	}
+
+	return indexNameDefault
 }
 
-func (c *Client) Index(documentType, id string, thing interface{}) {
-	req := elastic.NewBulkIndexRequest().
-		Index(c.indexNameFor(documentType)).
-		Routing(fmt.Sprintf("project_%v", c.ProjectID)).
+// newIndexRequest and newRemoveRequest build the bulk requests of Index and
+// Remove, which are shared with DryRun
+func newIndexRequest(index string, projectID int64, id string, thing interface{}) *elastic.BulkIndexRequest {
+	return elastic.NewBulkIndexRequest().
+		Index(index).
+		Routing(fmt.Sprintf("project_%v", projectID)).
 		Id(id).
 		Doc(thing)
+}
 
-	c.bulk.Add(req)
+func newRemoveRequest(index string, projectID int64, id string) *elastic.BulkDeleteRequest {
+	return elastic.NewBulkDeleteRequest().
+		Index(index).
+		Routing(fmt.Sprintf("project_%v", projectID)).
+		Id(id)
+}
+
+func (c *Client) Index(documentType, id string, thing interface{}) {
+	path, sha := documentSource(thing)
+
+	c.bulk.Add(&bulkRequest{
+		BulkableRequest: newIndexRequest(c.indexNameFor(documentType), c.ProjectID, id, thing),
+		documentType:    documentType,
+		id:              id,
+		path:            path,
+		sha:             sha,
+	})
 }
 
 // We only really use this for tests
@@ -245,11 +574,15 @@ func (c *Client) GetBlob(path string) (*elastic.GetResult, error) {
 	return c.Get("blob", fmt.Sprintf("%v_%v", c.ProjectID, path))
 }
 
-func (c *Client) Remove(documentType, id string) {
-	req := elastic.NewBulkDeleteRequest().
-		Index(c.indexNameFor(documentType)).
-		Routing(fmt.Sprintf("project_%v", c.ProjectID)).
-		Id(id)
+func (c *Client) GetWikiBlob(path string) (*elastic.GetResult, error) {
+	return c.Get("wiki_blob", fmt.Sprintf("wiki_%v_%v", c.ProjectID, path))
+}
 
-	c.bulk.Add(req)
+func (c *Client) Remove(documentType, id string) {
+	c.bulk.Add(&bulkRequest{
+		BulkableRequest: newRemoveRequest(c.indexNameFor(documentType), c.ProjectID, id),
+		delete:          true,
+		documentType:    documentType,
+		id:              id,
+	})
 }
@@ -17,6 +17,7 @@ import (
 	"github.com/stretchr/testify/require"
 
 	"gitlab.com/gitlab-org/gitlab-elasticsearch-indexer/elastic"
+	"gitlab.com/gitlab-org/gitlab-elasticsearch-indexer/indexer"
 )
 
 const (
@@ -282,7 +283,7 @@ func TestElasticClientIndexAndRetrieval(t *testing.T) {
 	commitDoc := map[string]interface{}{}
 	client.Index("commit", projectIDString+"_0000", commitDoc)
 
-	require.NoError(t, client.Flush())
+	require.NoError(t, client.Flush(context.Background()))
 
 	blob, err := client.GetBlob("foo")
 	require.NoError(t, err)
@@ -293,7 +294,7 @@ func TestElasticClientIndexAndRetrieval(t *testing.T) {
 	require.Equal(t, true, commit.Found)
 
 	client.Remove("blob", projectIDString+"_foo")
-	require.NoError(t, client.Flush())
+	require.NoError(t, client.Flush(context.Background()))
 
 	_, err = client.GetBlob("foo")
 	require.Error(t, err)
@@ -302,7 +303,7 @@ func TestElasticClientIndexAndRetrieval(t *testing.T) {
 	// for our IndexMapping
 	blobDocInvalid := map[string]interface{}{fmt.Sprintf("invalid-key-%d", time.Now().Unix()): ""}
 	client.Index("blob", projectIDString+"_invalid", blobDocInvalid)
-	require.Error(t, client.Flush())
+	require.Error(t, client.Flush(context.Background()))
 
 	require.NoError(t, client.DeleteIndex(client.IndexNameDefault))
 	require.NoError(t, client.DeleteIndex(client.IndexNameCommits))
@@ -317,7 +318,7 @@ func TestFlushErrorWithESActionRequestValidationException(t *testing.T) {
 	blobDoc := map[string]interface{}{}
 	client.Index("blob", projectIDString+"_foo", blobDoc)
 
-	require.Error(t, client.Flush())
+	require.Error(t, client.Flush(context.Background()))
 }
 
 func TestElasticReadConfig(t *testing.T) {
@@ -333,19 +334,25 @@ func TestElasticReadConfig(t *testing.T) {
 	require.Equal(t, []string{"http://elasticsearch:9200"}, config.URL)
 	require.Equal(t, elastic.DefaultMaxBulkSize, config.MaxBulkSize)
 	require.Equal(t, elastic.DefaultBulkWorkers, config.BulkWorkers)
+	require.Equal(t, elastic.DefaultMaxBulkAttempts, config.MaxBulkAttempts)
+	require.Equal(t, elastic.DefaultBulkRetryBackoff, config.BulkRetryBackoff)
 }
 
 func TestElasticReadConfigCustomBulkSettings(t *testing.T) {
 	config, err := elastic.ReadConfig(strings.NewReader(
 		`{
 			"max_bulk_size_bytes": 1024,
-			"max_bulk_concurrency": 6
+			"max_bulk_concurrency": 6,
+			"max_bulk_attempts": 3,
+			"bulk_retry_backoff_ms": 100
 		}`,
 	))
 	require.NoError(t, err)
 
 	require.Equal(t, 1024, config.MaxBulkSize)
 	require.Equal(t, 6, config.BulkWorkers)
+	require.Equal(t, 3, config.MaxBulkAttempts)
+	require.Equal(t, 100, config.BulkRetryBackoff)
 
 }
 
@@ -378,7 +385,7 @@ func TestCorrelationIdForwardedAsXOpaqueId(t *testing.T) {
 
 	blobDoc := map[string]interface{}{}
 	client.Index("blob", projectIDString+"_foo", blobDoc)
-	require.NoError(t, client.Flush())
+	require.NoError(t, client.Flush(context.Background()))
 
 	require.NotNil(t, req)
 	require.Equal(t, "the-correlation-id", req.Header.Get("X-Opaque-Id"))
@@ -441,3 +448,24 @@ func TestHealthcheckIsDisabled(t *testing.T) {
 
 	require.Nil(t, req)
 }
+
+func TestForProjectSharesConnections(t *testing.T) {
+	client, received := setupReplayClient(t, `{"errors":false,"items":[{"index":{"_index":"gitlab","_id":"42_README.md","status":201}}]}`)
+
+	permissions := &indexer.ProjectPermissions{VisibilityLevel: 20, RepositoryAccessLevel: 20}
+	projectClient, err := client.ForProject(context.Background(), 42, permissions)
+	require.NoError(t, err)
+
+	require.Same(t, client.Client, projectClient.Client)
+	require.Equal(t, int64(42), projectClient.ParentID())
+	require.Equal(t, permissions, projectClient.ProjectPermissions())
+	require.Equal(t, client.IndexNameDefault, projectClient.IndexNameDefault)
+
+	projectClient.Index("blob", "42_README.md", map[string]interface{}{"type": "blob"})
+	require.NoError(t, projectClient.Flush(context.Background()))
+	require.Contains(t, received.String(), `"routing":"project_42"`)
+
+	// The connections are left open for the other projects
+	projectClient.Close()
+	require.True(t, client.Client.IsRunning())
+}
@@ -0,0 +1,120 @@
+package elastic
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"sync"
+
+	"github.com/olivere/elastic/v7"
+
+	"gitlab.com/gitlab-org/gitlab-elasticsearch-indexer/indexer"
+)
+
+// DryRun is a Submitter writing every operation to w in the bulk API
+// format, as NDJSON, instead of sending it to Elasticsearch. Index names and
+// routing are the same as Client would use.
+type DryRun struct {
+	IndexNameDefault string
+	IndexNameCommits string
+	IndexNameWikis   string
+	IndexNameBlobs   string
+	ProjectID        int64
+	Permissions      *indexer.ProjectPermissions
+
+	indexNames map[string]string
+
+	mu  sync.Mutex
+	w   *bufio.Writer
+	err error
+}
+
+func NewDryRun(config *Config, w io.Writer) *DryRun {
+	indexNames := config.indexNames()
+
+	return &DryRun{
+		IndexNameDefault: config.IndexNameDefault,
+		IndexNameCommits: indexNames["commit"],
+		IndexNameWikis:   indexNames["wiki_blob"],
+		IndexNameBlobs:   indexNames["blob"],
+		ProjectID:        config.ProjectID,
+		Permissions:      config.Permissions,
+		indexNames:       indexNames,
+		w:                bufio.NewWriter(w),
+	}
+}
+
+func (d *DryRun) ParentID() int64 {
+	return d.ProjectID
+}
+
+func (d *DryRun) ProjectPermissions() *indexer.ProjectPermissions {
+	return d.Permissions
+}
+
+func (d *DryRun) UseSeparateIndexForCommits() bool {
+	return useSeparateIndex("commit", d.IndexNameDefault, d.indexNames)
+}
+
+func (d *DryRun) UseSeparateIndexForWikis() bool {
+	return useSeparateIndex("wiki_blob", d.IndexNameDefault, d.indexNames)
+}
+
+func (d *DryRun) UseSeparateIndexForBlobs() bool {
+	return useSeparateIndex("blob", d.IndexNameDefault, d.indexNames)
+}
+
+func (d *DryRun) indexNameFor(documentType string) string {
+	return indexNameFor(documentType, d.IndexNameDefault, d.indexNames)
+}
+
+func (d *DryRun) Index(documentType, id string, thing interface{}) {
+	d.write(newIndexRequest(d.indexNameFor(documentType), d.ProjectID, id, thing))
+}
+
+func (d *DryRun) Remove(documentType, id string) {
+	d.write(newRemoveRequest(d.indexNameFor(documentType), d.ProjectID, id))
+}
+
+func (d *DryRun) IndexRef(documentType, id, ref string, thing interface{}) {
+	d.write(newIndexRefRequest(d.indexNameFor(documentType), d.ProjectID, id, ref, thing))
+}
+
+func (d *DryRun) RemoveRef(documentType, id, ref string) {
+	d.write(newRemoveRefRequest(d.indexNameFor(documentType), d.ProjectID, id, ref))
+}
+
+// write keeps the first error, which Flush returns, as Index and Remove
+// can't fail
+func (d *DryRun) write(req elastic.BulkableRequest) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.err != nil {
+		return
+	}
+
+	lines, err := req.Source()
+	if err != nil {
+		d.err = err
+		return
+	}
+
+	for _, line := range lines {
+		if _, err := d.w.WriteString(line + "\n"); err != nil {
+			d.err = err
+			return
+		}
+	}
+}
+
+func (d *DryRun) Flush(_ context.Context) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.err != nil {
+		return d.err
+	}
+
+	return d.w.Flush()
+}
@@ -0,0 +1,145 @@
+package elastic_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-elasticsearch-indexer/elastic"
+)
+
+func TestDryRun(t *testing.T) {
+	var out bytes.Buffer
+
+	config, err := elastic.ReadConfig(strings.NewReader(
+		`{
+			"index_name": "gitlab-test",
+			"index_name_commits": "gitlab-test-commits"
+		}`,
+	))
+	require.NoError(t, err)
+	config.ProjectID = projectID
+
+	dryRun := elastic.NewDryRun(config, &out)
+	require.Equal(t, projectID, dryRun.ParentID())
+	require.True(t, dryRun.UseSeparateIndexForCommits())
+
+	dryRun.Index("blob", projectIDString+"_foo", map[string]interface{}{"type": "blob"})
+	dryRun.Index("commit", projectIDString+"_0000", map[string]interface{}{"type": "commit"})
+	dryRun.Remove("blob", projectIDString+"_bar")
+
+	// Nothing is written before the flush
+	require.Empty(t, out.String())
+	require.NoError(t, dryRun.Flush(context.Background()))
+
+	require.Equal(t, strings.Join([]string{
+		`{"index":{"_index":"gitlab-test","_id":"667_foo","routing":"project_667"}}`,
+		`{"type":"blob"}`,
+		`{"index":{"_index":"gitlab-test-commits","_id":"667_0000","routing":"project_667"}}`,
+		`{"type":"commit"}`,
+		`{"delete":{"_index":"gitlab-test","_id":"667_bar","routing":"project_667"}}`,
+		``,
+	}, "\n"), out.String())
+}
+
+func TestDryRunSeparateWikisIndex(t *testing.T) {
+	for _, data := range []string{
+		`{"index_name": "gitlab-test", "index_name_wikis": "gitlab-test-wikis"}`,
+		`{"index_name": "gitlab-test", "index_names": {"wiki_blob": "gitlab-test-wikis"}}`,
+		// The dedicated setting takes precedence
+		`{"index_name": "gitlab-test", "index_name_wikis": "gitlab-test-wikis", "index_names": {"wiki_blob": "other"}}`,
+	} {
+		var out bytes.Buffer
+
+		config, err := elastic.ReadConfig(strings.NewReader(data))
+		require.NoError(t, err)
+		config.ProjectID = projectID
+
+		dryRun := elastic.NewDryRun(config, &out)
+		require.True(t, dryRun.UseSeparateIndexForWikis(), data)
+		require.False(t, dryRun.UseSeparateIndexForCommits(), data)
+		require.Equal(t, "gitlab-test-wikis", dryRun.IndexNameWikis, data)
+
+		dryRun.Index("wiki_blob", "wiki_"+projectIDString+"_foo", map[string]interface{}{"type": "wiki_blob"})
+		dryRun.Remove("wiki_blob", "wiki_"+projectIDString+"_bar")
+		dryRun.Index("commit", projectIDString+"_0000", map[string]interface{}{"type": "commit"})
+		require.NoError(t, dryRun.Flush(context.Background()))
+
+		require.Equal(t, strings.Join([]string{
+			`{"index":{"_index":"gitlab-test-wikis","_id":"wiki_667_foo","routing":"project_667"}}`,
+			`{"type":"wiki_blob"}`,
+			`{"delete":{"_index":"gitlab-test-wikis","_id":"wiki_667_bar","routing":"project_667"}}`,
+			`{"index":{"_index":"gitlab-test","_id":"667_0000","routing":"project_667"}}`,
+			`{"type":"commit"}`,
+			``,
+		}, "\n"), out.String(), data)
+	}
+}
+
+func TestDryRunSeparateBlobsIndex(t *testing.T) {
+	var out bytes.Buffer
+
+	config, err := elastic.ReadConfig(strings.NewReader(`{"index_name": "gitlab-test", "index_name_blobs": "gitlab-test-blobs"}`))
+	require.NoError(t, err)
+	config.ProjectID = projectID
+
+	dryRun := elastic.NewDryRun(config, &out)
+	require.True(t, dryRun.UseSeparateIndexForBlobs())
+	require.False(t, dryRun.UseSeparateIndexForWikis())
+	require.Equal(t, "gitlab-test-blobs", dryRun.IndexNameBlobs)
+
+	// Gitlinks share IDs with blobs, so they're kept along with them
+	dryRun.Index("blob", projectIDString+"_foo", map[string]interface{}{"type": "blob"})
+	dryRun.Index("gitlink", projectIDString+"_six", map[string]interface{}{"type": "gitlink"})
+	dryRun.Index("wiki_blob", "wiki_"+projectIDString+"_foo", map[string]interface{}{"type": "wiki_blob"})
+	require.NoError(t, dryRun.Flush(context.Background()))
+
+	require.Equal(t, strings.Join([]string{
+		`{"index":{"_index":"gitlab-test-blobs","_id":"667_foo","routing":"project_667"}}`,
+		`{"type":"blob"}`,
+		`{"index":{"_index":"gitlab-test-blobs","_id":"667_six","routing":"project_667"}}`,
+		`{"type":"gitlink"}`,
+		`{"index":{"_index":"gitlab-test","_id":"wiki_667_foo","routing":"project_667"}}`,
+		`{"type":"wiki_blob"}`,
+		``,
+	}, "\n"), out.String())
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+func TestDryRunReportsWriteErrors(t *testing.T) {
+	config, err := elastic.ReadConfig(strings.NewReader(`{"index_name": "gitlab-test"}`))
+	require.NoError(t, err)
+
+	dryRun := elastic.NewDryRun(config, failingWriter{})
+	dryRun.Index("blob", projectIDString+"_foo", map[string]interface{}{"content": "foo"})
+
+	require.Error(t, dryRun.Flush(context.Background()))
+}
+
+func TestDryRunRefs(t *testing.T) {
+	var out bytes.Buffer
+
+	config, err := elastic.ReadConfig(strings.NewReader(`{"index_name": "gitlab-test"}`))
+	require.NoError(t, err)
+	config.ProjectID = projectID
+
+	dryRun := elastic.NewDryRun(config, &out)
+	dryRun.IndexRef("blob", projectIDString+"_abc_foo", "refs/heads/main", map[string]interface{}{"type": "blob"})
+	dryRun.RemoveRef("blob", projectIDString+"_def_foo", "refs/heads/main")
+	require.NoError(t, dryRun.Flush(context.Background()))
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(t, lines, 4)
+	require.Equal(t, `{"update":{"_index":"gitlab-test","_id":"667_abc_foo","retry_on_conflict":3,"routing":"project_667"}}`, lines[0])
+	require.Contains(t, lines[1], `"upsert":{"type":"blob"}`)
+	require.Equal(t, `{"update":{"_index":"gitlab-test","_id":"667_def_foo","retry_on_conflict":3,"routing":"project_667"}}`, lines[2])
+}
@@ -12,21 +12,65 @@ const (
 	// increases round trips in larger or non-AWS clusters
 	DefaultMaxBulkSize = 10 * 1024 * 1024
 	DefaultBulkWorkers = 10
+
+	// Items failing with a transient error are attempted up to
+	// DefaultMaxBulkAttempts times, waiting about DefaultBulkRetryBackoff
+	// milliseconds before the first retry and twice as long on each next one
+	DefaultMaxBulkAttempts  = 5
+	DefaultBulkRetryBackoff = 500
 )
 
 type Config struct {
-	IndexNameDefault string                      `json:"index_name"`
-	IndexNameCommits string                      `json:"index_name_commits"`
-	ProjectID        int64                       `json:"-"`
-	Permissions      *indexer.ProjectPermissions `json:"-"`
-	URL              []string                    `json:"url"`
-	AWS              bool                        `json:"aws"`
-	Region           string                      `json:"aws_region"`
-	AccessKey        string                      `json:"aws_access_key"`
-	SecretKey        string                      `json:"aws_secret_access_key"`
-	MaxBulkSize      int                         `json:"max_bulk_size_bytes"`
-	BulkWorkers      int                         `json:"max_bulk_concurrency"`
-	RequestTimeout   int                         `json:"client_request_timeout"`
+	IndexNameDefault     string                      `json:"index_name"`
+	IndexNameCommits     string                      `json:"index_name_commits"`
+	IndexNameWikis       string                      `json:"index_name_wikis"`
+	IndexNameBlobs       string                      `json:"index_name_blobs"`
+	IndexNames           map[string]string           `json:"index_names"`
+	IndexNameCheckpoints string                      `json:"index_name_checkpoints"`
+	IndexNameStatus      string                      `json:"index_name_status"`
+	ProjectID            int64                       `json:"-"`
+	Permissions          *indexer.ProjectPermissions `json:"-"`
+	URL                  []string                    `json:"url"`
+	AWS                  bool                        `json:"aws"`
+	Region               string                      `json:"aws_region"`
+	AccessKey            string                      `json:"aws_access_key"`
+	SecretKey            string                      `json:"aws_secret_access_key"`
+	MaxBulkSize          int                         `json:"max_bulk_size_bytes"`
+	BulkWorkers          int                         `json:"max_bulk_concurrency"`
+	MaxBulkAttempts      int                         `json:"max_bulk_attempts"`
+	BulkRetryBackoff     int                         `json:"bulk_retry_backoff_ms"`
+	RequestTimeout       int                         `json:"client_request_timeout"`
+}
+
+// indexNames returns the index of the document types that aren't kept in
+// IndexNameDefault, IndexNameCommits, IndexNameWikis and IndexNameBlobs
+// taking precedence over IndexNames for commits, wiki blobs and blobs.
+// Gitlinks are kept along with blobs, which they share IDs with.
+func (c *Config) indexNames() map[string]string {
+	names := make(map[string]string)
+	for documentType, name := range c.IndexNames {
+		if name != "" {
+			names[documentType] = name
+		}
+	}
+
+	if c.IndexNameCommits != "" {
+		names["commit"] = c.IndexNameCommits
+	}
+
+	if c.IndexNameWikis != "" {
+		names["wiki_blob"] = c.IndexNameWikis
+	}
+
+	if c.IndexNameBlobs != "" {
+		names["blob"] = c.IndexNameBlobs
+	}
+
+	if names["blob"] != "" {
+		names["gitlink"] = names["blob"]
+	}
+
+	return names
 }
 
 func ReadConfig(r io.Reader) (*Config, error) {
@@ -44,5 +88,13 @@ func ReadConfig(r io.Reader) (*Config, error) {
 		out.BulkWorkers = DefaultBulkWorkers
 	}
 
+	if out.MaxBulkAttempts == 0 {
+		out.MaxBulkAttempts = DefaultMaxBulkAttempts
+	}
+
+	if out.BulkRetryBackoff == 0 {
+		out.BulkRetryBackoff = DefaultBulkRetryBackoff
+	}
+
 	return &out, nil
 }
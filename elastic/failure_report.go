@@ -0,0 +1,159 @@
+package elastic
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+
+	"github.com/olivere/elastic/v7"
+
+	"gitlab.com/gitlab-org/gitlab-elasticsearch-indexer/indexer"
+)
+
+// FailedDocument is a document Elasticsearch didn't write, either because it
+// was rejected or because it still failed after its last attempt
+type FailedDocument struct {
+	DocumentType string `json:"document_type,omitempty"`
+	ID           string `json:"id"`
+	Index        string `json:"index,omitempty"`
+	Path         string `json:"path,omitempty"`
+	SHA          string `json:"sha,omitempty"`
+	Status       int    `json:"status,omitempty"`
+	ErrorType    string `json:"error_type,omitempty"`
+	ErrorReason  string `json:"error_reason,omitempty"`
+}
+
+// FailureReport lists the documents that failed during a run
+type FailureReport struct {
+	Failures []FailedDocument `json:"failures"`
+
+	// ErrorTypes counts the failures by Elasticsearch error type
+	ErrorTypes map[string]int `json:"error_types"`
+}
+
+// Write writes the report as JSON
+func (r *FailureReport) Write(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+
+	return encoder.Encode(r)
+}
+
+// failures collects the failed documents of a Client, which are reported by
+// several bulk workers at once
+type failures struct {
+	mu        sync.Mutex
+	documents []FailedDocument
+}
+
+func (f *failures) add(doc FailedDocument) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.documents = append(f.documents, doc)
+}
+
+func (f *failures) report() *FailureReport {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	report := &FailureReport{
+		Failures:   append([]FailedDocument{}, f.documents...),
+		ErrorTypes: make(map[string]int),
+	}
+
+	for _, doc := range f.documents {
+		errorType := doc.ErrorType
+		if errorType == "" {
+			errorType = "unknown"
+		}
+		report.ErrorTypes[errorType]++
+	}
+
+	return report
+}
+
+// FailureReport returns the documents that failed so far
+func (c *Client) FailureReport() *FailureReport {
+	return c.failures.report()
+}
+
+// failedDocument describes the document of a request whose item failed
+func failedDocument(request elastic.BulkableRequest, item *elastic.BulkResponseItem) FailedDocument {
+	doc := requestDocument(request)
+	doc.ID = item.Id
+	doc.Index = item.Index
+	doc.Status = item.Status
+
+	if item.Error != nil {
+		doc.ErrorType = item.Error.Type
+		doc.ErrorReason = item.Error.Reason
+	}
+
+	return doc
+}
+
+// failedRequest describes the document of a request sent in a bulk request
+// that failed as a whole
+func failedRequest(request elastic.BulkableRequest, err error) FailedDocument {
+	doc := requestDocument(request)
+	doc.ErrorReason = err.Error()
+
+	if e, ok := err.(*elastic.Error); ok {
+		doc.Status = e.Status
+		if e.Details != nil {
+			doc.ErrorType = e.Details.Type
+			doc.ErrorReason = e.Details.Reason
+		}
+	}
+
+	return doc
+}
+
+func requestDocument(request elastic.BulkableRequest) FailedDocument {
+	var doc FailedDocument
+
+	if req, ok := request.(*bulkRequest); ok {
+		doc.DocumentType = req.documentType
+		doc.ID = req.id
+		doc.Path = req.path
+		doc.SHA = req.sha
+	}
+
+	return doc
+}
+
+// documentSource returns the path of a blob or the SHA of a commit
+// submitted by the Indexer, to find it again in the repository
+func documentSource(thing interface{}) (path, sha string) {
+	body, ok := thing.(map[string]interface{})
+	if !ok {
+		return "", ""
+	}
+
+	switch body["type"] {
+	case "blob", "wiki_blob":
+		if blob, ok := body["blob"].(*indexer.Blob); ok {
+			return blob.Path, ""
+		}
+	case "gitlink":
+		if gitlink, ok := body["gitlink"].(*indexer.Gitlink); ok {
+			return gitlink.Path, ""
+		}
+	case "commit":
+		if commit, ok := body["commit"].(*indexer.Commit); ok {
+			return "", commit.SHA
+		}
+
+		// Commits in their own index are flattened into a map
+		sha, _ := body["sha"].(string)
+		return "", sha
+	default:
+		return "", ""
+	}
+
+	// Blobs, wiki blobs and gitlinks in their own index are flattened into a
+	// map, where the "sha" of gitlinks is the commit of the submodule
+	path, _ = body["path"].(string)
+	return path, ""
+}
@@ -0,0 +1,89 @@
+package elastic_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-elasticsearch-indexer/elastic"
+	"gitlab.com/gitlab-org/gitlab-elasticsearch-indexer/indexer"
+)
+
+func TestFailureReport(t *testing.T) {
+	client, _ := setupReplayClient(t, `{"errors":true,"items":[{"index":{"_index":"gitlab-test","_id":"667_foo/bar.rb","status":400,"error":{"type":"mapping_parser_exception","reason":"failed to parse field [blob.content]"}}}]}`)
+
+	blob := &indexer.Blob{Type: "blob", ID: "667_foo/bar.rb", Path: "foo/bar.rb"}
+	client.Index("blob", blob.ID, map[string]interface{}{"blob": blob, "type": "blob"})
+
+	require.Error(t, client.Flush(context.Background()))
+
+	report := client.FailureReport()
+	require.Equal(t, []elastic.FailedDocument{
+		{
+			DocumentType: "blob",
+			ID:           "667_foo/bar.rb",
+			Index:        "gitlab-test",
+			Path:         "foo/bar.rb",
+			Status:       400,
+			ErrorType:    "mapping_parser_exception",
+			ErrorReason:  "failed to parse field [blob.content]",
+		},
+	}, report.Failures)
+	require.Equal(t, map[string]int{"mapping_parser_exception": 1}, report.ErrorTypes)
+
+	var out bytes.Buffer
+	require.NoError(t, report.Write(&out))
+
+	var written elastic.FailureReport
+	require.NoError(t, json.Unmarshal(out.Bytes(), &written))
+	require.Equal(t, report, &written)
+}
+
+func TestFailureReportRecordsCommitSHA(t *testing.T) {
+	client, _ := setupReplayClient(t, `{"errors":true,"items":[{"index":{"_index":"gitlab-test-commits","_id":"667_0000","status":400,"error":{"type":"illegal_argument_exception","reason":"bad commit"}}}]}`)
+
+	client.Index("commit", "667_0000", map[string]interface{}{"sha": "0000", "type": "commit"})
+
+	require.Error(t, client.Flush(context.Background()))
+
+	failures := client.FailureReport().Failures
+	require.Len(t, failures, 1)
+	require.Equal(t, "commit", failures[0].DocumentType)
+	require.Equal(t, "0000", failures[0].SHA)
+	require.Empty(t, failures[0].Path)
+}
+
+func TestFailureReportRecordsPathOfFlatDocuments(t *testing.T) {
+	for documentType, body := range map[string]map[string]interface{}{
+		"blob":      {"path": "foo/bar.rb", "commit_sha": "0000", "type": "blob"},
+		"wiki_blob": {"path": "foo/bar.rb", "commit_sha": "0000", "type": "wiki_blob"},
+		// The sha of a gitlink is the commit of the submodule
+		"gitlink": {"path": "foo/bar.rb", "commit_sha": "0000", "sha": "1111", "type": "gitlink"},
+	} {
+		client, _ := setupReplayClient(t, `{"errors":true,"items":[{"index":{"_index":"gitlab-test-separate","_id":"667_foo/bar.rb","status":400,"error":{"type":"illegal_argument_exception","reason":"bad document"}}}]}`)
+
+		client.Index(documentType, "667_foo/bar.rb", body)
+
+		require.Error(t, client.Flush(context.Background()))
+
+		failures := client.FailureReport().Failures
+		require.Len(t, failures, 1, documentType)
+		require.Equal(t, documentType, failures[0].DocumentType)
+		require.Equal(t, "foo/bar.rb", failures[0].Path, documentType)
+		require.Empty(t, failures[0].SHA, documentType)
+	}
+}
+
+func TestFailureReportIsEmptyWithoutFailures(t *testing.T) {
+	client, _ := setupReplayClient(t, `{"errors":false,"items":[{"index":{"_index":"gitlab-test","_id":"667_foo","status":201}}]}`)
+
+	client.Index("blob", "667_foo", map[string]interface{}{"type": "blob"})
+	require.NoError(t, client.Flush(context.Background()))
+
+	report := client.FailureReport()
+	require.Empty(t, report.Failures)
+	require.Empty(t, report.ErrorTypes)
+}
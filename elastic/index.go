@@ -141,6 +141,25 @@ const defaultIndexProperties = `
 			"rid": {
 				"type": "keyword"
 			},
+			"symbols": {
+				"properties": {
+					"kind": {
+						"type": "keyword"
+					},
+					"line": {
+						"type": "integer"
+					},
+					"name": {
+						"analyzer": "code_analyzer",
+						"type": "text",
+						"fields": {
+							"keyword": {
+								"type": "keyword"
+							}
+						}
+					}
+				}
+			},
 			"type": {
 				"type": "keyword"
 			}
@@ -164,6 +183,32 @@ const defaultIndexProperties = `
 					}
 				}
 			},
+			"changed_files": {
+				"properties": {
+					"additions": {
+						"type": "integer"
+					},
+					"deletions": {
+						"type": "integer"
+					},
+					"old_path": {
+						"analyzer": "path_analyzer",
+						"type": "text"
+					},
+					"operation": {
+						"type": "keyword"
+					},
+					"path": {
+						"analyzer": "path_analyzer",
+						"type": "text",
+						"fields": {
+							"keyword": {
+								"type": "keyword"
+							}
+						}
+					}
+				}
+			},
 			"committer": {
 				"properties": {
 					"email": {
@@ -180,6 +225,10 @@ const defaultIndexProperties = `
 					}
 				}
 			},
+			"diff": {
+				"analyzer": "code_analyzer",
+				"type": "text"
+			},
 			"id": {
 				"normalizer": "sha_normalizer",
 				"index_options": "docs",
@@ -220,6 +269,37 @@ const defaultIndexProperties = `
 		"index_options": "offsets",
 		"type": "text"
 	},
+	"gitlink": {
+		"properties": {
+			"commit_sha": {
+				"normalizer": "sha_normalizer",
+				"index_options": "docs",
+				"type": "keyword"
+			},
+			"file_name": {
+				"analyzer": "code_analyzer",
+				"type": "text"
+			},
+			"path": {
+				"analyzer": "path_analyzer",
+				"type": "text"
+			},
+			"rid": {
+				"type": "keyword"
+			},
+			"sha": {
+				"normalizer": "sha_normalizer",
+				"index_options": "docs",
+				"type": "keyword"
+			},
+			"type": {
+				"type": "keyword"
+			},
+			"url": {
+				"type": "keyword"
+			}
+		}
+	},
 	"id": {
 		"type": "integer"
 	},
@@ -252,7 +332,8 @@ const defaultIndexProperties = `
 				"milestone",
 				"wiki_blob",
 				"commit",
-				"merge_request"
+				"merge_request",
+				"gitlink"
 			]
 		},
 		"type": "join"
@@ -302,6 +383,9 @@ const defaultIndexProperties = `
 	"project_id": {
 		"type": "integer"
 	},
+	"refs": {
+		"type": "keyword"
+	},
 	"repository_access_level": {
 		"type": "integer"
 	},
@@ -371,6 +455,32 @@ const commitsIndexProperties = `
 			}
 		}
 	},
+	"changed_files": {
+		"properties": {
+			"additions": {
+				"type": "integer"
+			},
+			"deletions": {
+				"type": "integer"
+			},
+			"old_path": {
+				"analyzer": "path_analyzer",
+				"type": "text"
+			},
+			"operation": {
+				"type": "keyword"
+			},
+			"path": {
+				"analyzer": "path_analyzer",
+				"type": "text",
+				"fields": {
+					"keyword": {
+						"type": "keyword"
+					}
+				}
+			}
+		}
+	},
 	"committer": {
 		"properties": {
 			"email": {
@@ -387,6 +497,10 @@ const commitsIndexProperties = `
 			}
 		}
 	},
+	"diff": {
+		"analyzer": "code_analyzer",
+		"type": "text"
+	},
 	"id": {
 		"normalizer": "sha_normalizer",
 		"index_options": "docs",
@@ -407,6 +521,130 @@ const commitsIndexProperties = `
 }
 `
 
+const wikisIndexProperties = `
+{
+	"type": {
+		"type": "keyword"
+	},
+	"project_id": {
+		"type": "integer"
+	},
+	"visibility_level": {
+		"type": "integer"
+	},
+	"commit_sha": {
+		"normalizer": "sha_normalizer",
+		"index_options": "docs",
+		"type": "keyword"
+	},
+	"content": {
+		"analyzer": "code_analyzer",
+		"index_options": "positions",
+		"type": "text"
+	},
+	"file_name": {
+		"analyzer": "code_analyzer",
+		"type": "text"
+	},
+	"language": {
+		"type": "keyword"
+	},
+	"oid": {
+		"normalizer": "sha_normalizer",
+		"index_options": "docs",
+		"type": "keyword"
+	},
+	"path": {
+		"analyzer": "path_analyzer",
+		"type": "text"
+	},
+	"refs": {
+		"type": "keyword"
+	},
+	"rid": {
+		"type": "keyword"
+	}
+}
+`
+
+// blobsIndexProperties also have the fields of gitlinks, which are kept
+// along with blobs
+const blobsIndexProperties = `
+{
+	"type": {
+		"type": "keyword"
+	},
+	"project_id": {
+		"type": "integer"
+	},
+	"visibility_level": {
+		"type": "integer"
+	},
+	"repository_access_level": {
+		"type": "integer"
+	},
+	"commit_sha": {
+		"normalizer": "sha_normalizer",
+		"index_options": "docs",
+		"type": "keyword"
+	},
+	"content": {
+		"analyzer": "code_analyzer",
+		"index_options": "positions",
+		"type": "text"
+	},
+	"file_name": {
+		"analyzer": "code_analyzer",
+		"type": "text"
+	},
+	"language": {
+		"type": "keyword"
+	},
+	"oid": {
+		"normalizer": "sha_normalizer",
+		"index_options": "docs",
+		"type": "keyword"
+	},
+	"path": {
+		"analyzer": "path_analyzer",
+		"type": "text"
+	},
+	"refs": {
+		"type": "keyword"
+	},
+	"rid": {
+		"type": "keyword"
+	},
+	"sha": {
+		"normalizer": "sha_normalizer",
+		"index_options": "docs",
+		"type": "keyword"
+	},
+	"symbols": {
+		"properties": {
+			"kind": {
+				"type": "keyword"
+			},
+			"line": {
+				"type": "integer"
+			},
+			"name": {
+				"analyzer": "code_analyzer",
+				"type": "text",
+				"fields": {
+					"keyword": {
+						"type": "keyword"
+					}
+				}
+			}
+		}
+	},
+	"url": {
+		"type": "keyword"
+	}
+}
+`
+
 // createIndex creates an index matching that created by GitLab
 func (c *Client) createIndex(indexName, mapping string) error {
 	createIndexService := c.Client.CreateIndex(indexName).BodyString(mapping)
@@ -436,6 +674,22 @@ func (c *Client) CreateCommitsWorkingIndex() error {
 	return c.createIndex(c.IndexNameCommits, mapping)
 }
 
+// CreateWikisWorkingIndex creates the separate index of wiki blobs, whose
+// documents have no project to join
+func (c *Client) CreateWikisWorkingIndex() error {
+	mapping := strings.Replace(defaultIndexMapping, "__PROPERTIES__", wikisIndexProperties, -1)
+
+	return c.createIndex(c.IndexNameWikis, mapping)
+}
+
+// CreateBlobsWorkingIndex creates the separate index of blobs and gitlinks,
+// whose documents have no project to join
+func (c *Client) CreateBlobsWorkingIndex() error {
+	mapping := strings.Replace(defaultIndexMapping, "__PROPERTIES__", blobsIndexProperties, -1)
+
+	return c.createIndex(c.IndexNameBlobs, mapping)
+}
+
 // For testing
 func (c *Client) CreateDefaultBrokenIndex() error {
 	mapping := strings.Replace(defaultIndexMapping, "__PROPERTIES__", "{}", -1)
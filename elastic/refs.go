@@ -0,0 +1,105 @@
+package elastic
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/olivere/elastic/v7"
+)
+
+// Documents indexed for refs list them in `refs`. The same blob found in
+// several refs is a single document, deleted once no ref has it anymore.
+const (
+	addRefScript = `if (ctx._source.refs == null) {
+  ctx._source.refs = [params.ref];
+} else if (ctx._source.refs.contains(params.ref)) {
+  ctx.op = 'none';
+} else {
+  ctx._source.refs.add(params.ref);
+}`
+
+	removeRefScript = `if (ctx._source.refs == null || !ctx._source.refs.removeIf(r -> r == params.ref)) {
+  ctx.op = '%[1]s';
+} else if (ctx._source.refs.isEmpty()) {
+  ctx.op = 'delete';
+}`
+)
+
+// newIndexRefRequest and newRemoveRefRequest build the bulk requests of
+// IndexRef and RemoveRef, which are shared with DryRun
+func newIndexRefRequest(index string, projectID int64, id, ref string, thing interface{}) *elastic.BulkUpdateRequest {
+	return elastic.NewBulkUpdateRequest().
+		Index(index).
+		Routing(fmt.Sprintf("project_%v", projectID)).
+		Id(id).
+		Script(elastic.NewScript(addRefScript).Param("ref", ref)).
+		Upsert(thing).
+		RetryOnConflict(3)
+}
+
+func newRemoveRefRequest(index string, projectID int64, id, ref string) *elastic.BulkUpdateRequest {
+	return elastic.NewBulkUpdateRequest().
+		Index(index).
+		Routing(fmt.Sprintf("project_%v", projectID)).
+		Id(id).
+		Script(elastic.NewScript(fmt.Sprintf(removeRefScript, "none")).Param("ref", ref)).
+		RetryOnConflict(3)
+}
+
+// IndexRef adds ref to the document, which is created with thing if it
+// doesn't exist yet
+func (c *Client) IndexRef(documentType, id, ref string, thing interface{}) {
+	path, sha := documentSource(thing)
+
+	c.bulk.Add(&bulkRequest{
+		BulkableRequest: newIndexRefRequest(c.indexNameFor(documentType), c.ProjectID, id, ref, thing),
+		documentType:    documentType,
+		id:              id,
+		path:            path,
+		sha:             sha,
+	})
+}
+
+// RemoveRef removes ref from the document, and deletes it if no ref is
+// left. A document that doesn't exist is not an error.
+func (c *Client) RemoveRef(documentType, id, ref string) {
+	c.bulk.Add(&bulkRequest{
+		BulkableRequest: newRemoveRefRequest(c.indexNameFor(documentType), c.ProjectID, id, ref),
+		missingOK:       true,
+		documentType:    documentType,
+		id:              id,
+	})
+}
+
+// RemoveRefFromProject removes ref from every document of the project of the
+// given blob type, which is needed when the ref is deleted. Documents left
+// without any ref are deleted. It returns the number of documents updated
+// or deleted, and fails on version conflicts so that the removal can be
+// attempted again later.
+func (c *Client) RemoveRefFromProject(ctx context.Context, blobType, ref string) (int64, error) {
+	types := []interface{}{blobType}
+	if blobType == "blob" {
+		types = append(types, "gitlink")
+	}
+
+	query := elastic.NewBoolQuery().Filter(
+		elastic.NewTermQuery("project_id", c.ProjectID),
+		elastic.NewTermsQuery("type", types...),
+		elastic.NewTermQuery("refs", ref),
+	)
+
+	response, err := c.Client.UpdateByQuery(c.indexNameFor(blobType)).
+		Routing(fmt.Sprintf("project_%v", c.ProjectID)).
+		Query(query).
+		Script(elastic.NewScript(fmt.Sprintf(removeRefScript, "noop")).Param("ref", ref)).
+		Do(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(response.Failures) > 0 {
+		return 0, fmt.Errorf("Removing ref %s: %d documents failed, the first one with status %d", ref, len(response.Failures), response.Failures[0].Status)
+	}
+
+	return response.Updated + response.Deleted, nil
+}
@@ -0,0 +1,37 @@
+package elastic_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIndexRefAndRemoveRef(t *testing.T) {
+	client, received := setupReplayClient(t, `{
+		"errors": true,
+		"items": [
+			{"update": {"_id": "0_abc_foo", "status": 201}},
+			{"update": {"_id": "0_def_foo", "status": 404, "error": {"type": "document_missing_exception", "reason": "document missing"}}}
+		]
+	}`)
+
+	client.IndexRef("blob", "0_abc_foo", "refs/heads/main", map[string]interface{}{"type": "blob", "refs": []string{"refs/heads/main"}})
+	client.RemoveRef("blob", "0_def_foo", "refs/heads/main")
+
+	// Removing a ref from a document that is already gone isn't a failure
+	require.NoError(t, client.Flush(context.Background()))
+	require.Empty(t, client.FailureReport().Failures)
+
+	lines := strings.Split(strings.TrimSpace(received.String()), "\n")
+	require.Len(t, lines, 4)
+
+	require.Equal(t, `{"update":{"_id":"0_abc_foo","retry_on_conflict":3,"routing":"project_0"}}`, lines[0])
+	require.Contains(t, lines[1], `"params":{"ref":"refs/heads/main"}`)
+	require.Contains(t, lines[1], `"upsert":{"refs":["refs/heads/main"],"type":"blob"}`)
+
+	require.Equal(t, `{"update":{"_id":"0_def_foo","retry_on_conflict":3,"routing":"project_0"}}`, lines[2])
+	require.Contains(t, lines[3], `ctx.op = 'delete'`)
+	require.NotContains(t, lines[3], `"upsert"`)
+}
@@ -0,0 +1,112 @@
+package elastic
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// rawBulkRequest is a request read from a bulk file, sent as it is
+type rawBulkRequest struct {
+	lines []string
+}
+
+func (r *rawBulkRequest) String() string {
+	return strings.Join(r.lines, "\n")
+}
+
+func (r *rawBulkRequest) Source() ([]string, error) {
+	return r.lines, nil
+}
+
+// Replay sends the requests of a bulk file, in the NDJSON format written by
+// DryRun, through the bulk processor and flushes them. It returns the number
+// of requests read.
+func (c *Client) Replay(ctx context.Context, r io.Reader) (int, error) {
+	reader := bufio.NewReader(r)
+	count := 0
+	lineNumber := 0
+
+	readLine := func() (string, error) {
+		for {
+			line, err := reader.ReadString('\n')
+			if err == io.EOF && line != "" {
+				err = nil
+			}
+			if err != nil {
+				return "", err
+			}
+
+			lineNumber++
+			if line = strings.TrimSpace(line); line != "" {
+				return line, nil
+			}
+		}
+	}
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return count, err
+		}
+
+		action, err := readLine()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return count, err
+		}
+
+		name, err := parseBulkAction(action)
+		if err != nil {
+			return count, fmt.Errorf("line %d: %v", lineNumber, err)
+		}
+
+		req := &rawBulkRequest{lines: []string{action}}
+
+		if name != "delete" {
+			source, err := readLine()
+			if err == io.EOF {
+				return count, fmt.Errorf("line %d: missing source", lineNumber)
+			}
+			if err != nil {
+				return count, err
+			}
+
+			req.lines = append(req.lines, source)
+		}
+
+		// Updates with an upsert never miss their document, so the ones
+		// missing it are those of RemoveRef, which don't need it
+		c.bulk.Add(&bulkRequest{BulkableRequest: req, delete: name == "delete", missingOK: name == "update"})
+		count++
+	}
+
+	return count, c.Flush(ctx)
+}
+
+// parseBulkAction checks an action line and returns its name. A source line
+// follows every action but delete.
+func parseBulkAction(line string) (string, error) {
+	var action map[string]json.RawMessage
+
+	if err := json.Unmarshal([]byte(line), &action); err != nil {
+		return "", fmt.Errorf("invalid action: %v", err)
+	}
+
+	if len(action) != 1 {
+		return "", fmt.Errorf("invalid action: %s", line)
+	}
+
+	for name := range action {
+		switch name {
+		case "index", "create", "update", "delete":
+			return name, nil
+		}
+	}
+
+	return "", fmt.Errorf("unknown action: %s", line)
+}
@@ -0,0 +1,102 @@
+package elastic_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-elasticsearch-indexer/elastic"
+)
+
+const bulkFile = `{"index":{"_index":"gitlab-test","_id":"667_foo","routing":"project_667"}}
+{"type":"blob"}
+
+{"delete":{"_index":"gitlab-test","_id":"667_bar","routing":"project_667"}}
+{"index":{"_index":"gitlab-test-commits","_id":"667_0000","routing":"project_667"}}
+{"type":"commit"}`
+
+func setupReplayClient(t *testing.T, response string) (*elastic.Client, *strings.Builder) {
+	var mu sync.Mutex
+	var received strings.Builder
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		require.Equal(t, "/_bulk", r.URL.Path)
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		received.Write(body)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(response))
+	}))
+	t.Cleanup(srv.Close)
+
+	config, err := elastic.ReadConfig(strings.NewReader(`{"url":["` + srv.URL + `"]}`))
+	require.NoError(t, err)
+
+	client, err := elastic.NewClient(config, "the-correlation-id")
+	require.NoError(t, err)
+	t.Cleanup(client.Close)
+
+	return client, &received
+}
+
+func TestReplay(t *testing.T) {
+	client, received := setupReplayClient(t, `{"errors":false,"items":[]}`)
+
+	count, err := client.Replay(context.Background(), strings.NewReader(bulkFile))
+	require.NoError(t, err)
+	require.Equal(t, 3, count)
+
+	// The requests are spread over the bulk workers, so they may come in any
+	// order
+	require.ElementsMatch(t, strings.Fields(bulkFile), strings.Fields(received.String()))
+}
+
+func TestReplayReportsFailedItems(t *testing.T) {
+	client, _ := setupReplayClient(t, `{"errors":true,"items":[{"index":{"_index":"gitlab-test","_id":"667_foo","status":400,"error":{"type":"strict_dynamic_mapping_exception","reason":"mapping set to strict"}}}]}`)
+
+	_, err := client.Replay(context.Background(), strings.NewReader(bulkFile))
+	require.Error(t, err)
+}
+
+func TestReplayTakesRemovalsOfMissingDocumentsAsDone(t *testing.T) {
+	for _, tc := range []struct {
+		file   string
+		action string
+	}{
+		{`{"delete":{"_index":"gitlab-test","_id":"667_bar","routing":"project_667"}}`, "delete"},
+		{`{"update":{"_index":"gitlab-test","_id":"667_bar","routing":"project_667","retry_on_conflict":3}}
+{"script":{"source":"ctx.op = 'delete'","params":{"ref":"refs/heads/main"}}}`, "update"},
+	} {
+		client, _ := setupReplayClient(t, `{"errors":true,"items":[{"`+tc.action+`":{"_index":"gitlab-test","_id":"667_bar","status":404}}]}`)
+
+		_, err := client.Replay(context.Background(), strings.NewReader(tc.file))
+		require.NoError(t, err, tc.action)
+		require.Empty(t, client.FailureReport().Failures, tc.action)
+	}
+}
+
+func TestReplayRejectsInvalidFiles(t *testing.T) {
+	client, received := setupReplayClient(t, `{"errors":false,"items":[]}`)
+
+	for _, file := range []string{
+		`{"index":{"_index":"gitlab-test"}}`,
+		`{"upsert":{"_index":"gitlab-test"}}`,
+		`{"index":{},"delete":{}}`,
+		`not json`,
+	} {
+		_, err := client.Replay(context.Background(), strings.NewReader(file))
+		require.Error(t, err, file)
+	}
+
+	require.Empty(t, received.String())
+}
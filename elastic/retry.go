@@ -0,0 +1,113 @@
+package elastic
+
+import (
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/olivere/elastic/v7"
+)
+
+// maxBulkRetryBackoff caps the delay between two attempts of an item
+const maxBulkRetryBackoff = 30 * time.Second
+
+// bulkRequest is a request added to the bulk processor, remembering how many
+// times it has been attempted so that failed items can be retried, and which
+// document it's about so that failures can be reported
+type bulkRequest struct {
+	elastic.BulkableRequest
+	delete  bool
+	attempt int
+
+	// missingOK is set on updates of documents that may already be gone.
+	// Deletes are always done once their document is gone.
+	missingOK bool
+
+	documentType string
+	id           string
+	path         string
+	sha          string
+}
+
+// isRetryable reports whether an item that failed with status may succeed
+// if it's sent again. Version conflicts on deletes happen when a document is
+// being written concurrently, so the delete is attempted again.
+func (r *bulkRequest) isRetryable(status int) bool {
+	switch status {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	case http.StatusConflict:
+		return r.delete
+	}
+
+	return false
+}
+
+// isDone reports whether an item that failed with status still did what
+// the request asked for, which is the case of documents to delete or update
+// that don't exist anymore
+func (r *bulkRequest) isDone(status int) bool {
+	return status == http.StatusNotFound && (r.delete || r.missingOK)
+}
+
+// retryBackoff returns the delay before the given attempt: the initial delay
+// doubles on every attempt, and a random jitter spreads the retries of items
+// that failed together
+func retryBackoff(initial time.Duration, attempt int) time.Duration {
+	delay := initial
+	for i := 1; i < attempt && delay < maxBulkRetryBackoff; i++ {
+		delay *= 2
+	}
+
+	if delay > maxBulkRetryBackoff {
+		delay = maxBulkRetryBackoff
+	}
+
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// pendingRetries counts the items waiting for their backoff to expire
+// before being added to the bulk processor again, and how many were added
+// again so far
+type pendingRetries struct {
+	mu      sync.Mutex
+	count   int
+	readded int
+	idle    chan struct{}
+}
+
+func (p *pendingRetries) add() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.count == 0 {
+		p.idle = make(chan struct{})
+	}
+	p.count++
+}
+
+func (p *pendingRetries) done() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.readded++
+	p.count--
+	if p.count == 0 {
+		close(p.idle)
+	}
+}
+
+// wait returns a channel closed once every pending item has been added
+// again, or nil if there is none, and the number of items added again so
+// far
+func (p *pendingRetries) wait() (<-chan struct{}, int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.count == 0 {
+		return nil, p.readded
+	}
+
+	return p.idle, p.readded
+}
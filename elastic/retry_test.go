@@ -0,0 +1,233 @@
+package elastic_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-elasticsearch-indexer/elastic"
+	"gitlab.com/gitlab-org/gitlab-elasticsearch-indexer/metrics"
+)
+
+// setupRetryClient starts a bulk API answering each item with the status
+// returned by statusFor, given the action, the document ID and how many
+// times the document has been received. It returns the number of attempts
+// per document ID.
+func setupRetryClient(t *testing.T, statusFor func(action, id string, attempt int) int) (*elastic.Client, func() map[string]int) {
+	var mu sync.Mutex
+	attempts := make(map[string]int)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		var items []map[string]map[string]interface{}
+		errors := false
+
+		scanner := bufio.NewScanner(r.Body)
+		for scanner.Scan() {
+			var line map[string]json.RawMessage
+			require.NoError(t, json.Unmarshal(scanner.Bytes(), &line))
+
+			for action, raw := range line {
+				if action != "index" && action != "delete" {
+					continue
+				}
+
+				var meta struct {
+					Index string `json:"_index"`
+					ID    string `json:"_id"`
+				}
+				require.NoError(t, json.Unmarshal(raw, &meta))
+
+				attempts[meta.ID]++
+				status := statusFor(action, meta.ID, attempts[meta.ID])
+				errors = errors || status >= 300
+
+				items = append(items, map[string]map[string]interface{}{
+					action: {"_index": meta.Index, "_id": meta.ID, "status": status},
+				})
+			}
+		}
+		require.NoError(t, scanner.Err())
+
+		w.Header().Set("Content-Type", "application/json")
+		require.NoError(t, json.NewEncoder(w).Encode(map[string]interface{}{"errors": errors, "items": items}))
+	}))
+	t.Cleanup(srv.Close)
+
+	config, err := elastic.ReadConfig(strings.NewReader(`{
+		"url":["` + srv.URL + `"],
+		"index_name": "gitlab-test",
+		"max_bulk_attempts": 3,
+		"bulk_retry_backoff_ms": 1
+	}`))
+	require.NoError(t, err)
+	config.ProjectID = projectID
+
+	client, err := elastic.NewClient(config, "the-correlation-id")
+	require.NoError(t, err)
+	t.Cleanup(client.Close)
+
+	return client, func() map[string]int {
+		mu.Lock()
+		defer mu.Unlock()
+
+		return attempts
+	}
+}
+
+func TestFlushRetriesTransientFailures(t *testing.T) {
+	client, attempts := setupRetryClient(t, func(action, id string, attempt int) int {
+		switch {
+		case id == projectIDString+"_busy" && attempt == 1:
+			return http.StatusTooManyRequests
+		case id == projectIDString+"_unavailable" && attempt < 3:
+			return http.StatusServiceUnavailable
+		case id == projectIDString+"_conflict" && attempt == 1:
+			return http.StatusConflict
+		}
+
+		return http.StatusOK
+	})
+
+	client.Index("blob", projectIDString+"_busy", map[string]interface{}{"type": "blob"})
+	client.Index("blob", projectIDString+"_unavailable", map[string]interface{}{"type": "blob"})
+	client.Index("blob", projectIDString+"_ok", map[string]interface{}{"type": "blob"})
+	client.Remove("blob", projectIDString+"_conflict")
+
+	require.NoError(t, client.Flush(context.Background()))
+	require.Equal(t, map[string]int{
+		projectIDString + "_busy":        2,
+		projectIDString + "_unavailable": 3,
+		projectIDString + "_ok":          1,
+		projectIDString + "_conflict":    2,
+	}, attempts())
+}
+
+func TestFlushTakesDeletesOfMissingDocumentsAsDone(t *testing.T) {
+	client, attempts := setupRetryClient(t, func(action, id string, attempt int) int {
+		switch {
+		case id == projectIDString+"_busy" && attempt == 1:
+			return http.StatusTooManyRequests
+		case id == projectIDString+"_missing":
+			return http.StatusNotFound
+		}
+
+		return http.StatusOK
+	})
+
+	client.Index("blob", projectIDString+"_busy", map[string]interface{}{"type": "blob"})
+	client.Remove("blob", projectIDString+"_missing")
+
+	require.NoError(t, client.Flush(context.Background()))
+	require.Equal(t, map[string]int{
+		projectIDString + "_busy":    2,
+		projectIDString + "_missing": 1,
+	}, attempts())
+	require.Empty(t, client.FailureReport().Failures)
+}
+
+func TestFlushGivesUpAfterMaxAttempts(t *testing.T) {
+	client, attempts := setupRetryClient(t, func(action, id string, attempt int) int {
+		return http.StatusTooManyRequests
+	})
+
+	client.Index("blob", projectIDString+"_busy", map[string]interface{}{"type": "blob"})
+
+	require.Error(t, client.Flush(context.Background()))
+	require.Equal(t, map[string]int{projectIDString + "_busy": 3}, attempts())
+}
+
+func TestFlushDoesNotRetryPermanentFailures(t *testing.T) {
+	client, attempts := setupRetryClient(t, func(action, id string, attempt int) int {
+		switch id {
+		case projectIDString + "_invalid":
+			return http.StatusBadRequest
+		case projectIDString + "_conflict":
+			// Version conflicts are only retried for deletes
+			return http.StatusConflict
+		}
+
+		return http.StatusOK
+	})
+
+	client.Index("blob", projectIDString+"_invalid", map[string]interface{}{"type": "blob"})
+	client.Index("blob", projectIDString+"_conflict", map[string]interface{}{"type": "blob"})
+
+	require.Error(t, client.Flush(context.Background()))
+	require.Equal(t, map[string]int{
+		projectIDString + "_invalid":  1,
+		projectIDString + "_conflict": 1,
+	}, attempts())
+}
+
+func TestFlushStopsWaitingForRetriesWhenCanceled(t *testing.T) {
+	client, _ := setupRetryClient(t, func(action, id string, attempt int) int {
+		return http.StatusTooManyRequests
+	})
+
+	client.Index("blob", projectIDString+"_busy", map[string]interface{}{"type": "blob"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	require.ErrorIs(t, client.Flush(ctx), context.Canceled)
+
+	// The item is still retried until it runs out of attempts
+	require.Error(t, client.Flush(context.Background()))
+}
+
+func TestCloseGivesUpPendingRetries(t *testing.T) {
+	client, attempts := setupRetryClient(t, func(action, id string, attempt int) int {
+		return http.StatusTooManyRequests
+	})
+
+	client.Index("blob", projectIDString+"_busy", map[string]interface{}{"type": "blob"})
+
+	// The queued item is committed once, and not retried after the client
+	// is stopped
+	client.Close()
+	time.Sleep(10 * time.Millisecond)
+
+	require.Equal(t, map[string]int{projectIDString + "_busy": 1}, attempts())
+	require.Len(t, client.FailureReport().Failures, 1)
+	require.False(t, client.Client.IsRunning())
+}
+
+func TestFlushRecordsBulkMetrics(t *testing.T) {
+	client, _ := setupRetryClient(t, func(action, id string, attempt int) int {
+		switch {
+		case id == projectIDString+"_busy" && attempt == 1:
+			return http.StatusTooManyRequests
+		case id == projectIDString+"_invalid":
+			return http.StatusBadRequest
+		}
+
+		return http.StatusOK
+	})
+
+	requests := testutil.ToFloat64(metrics.BulkRequestsTotal)
+	bytes := testutil.ToFloat64(metrics.BulkBytesTotal)
+	retries := testutil.ToFloat64(metrics.BulkFailuresTotal.WithLabelValues("retry"))
+	failures := testutil.ToFloat64(metrics.BulkFailuresTotal.WithLabelValues("document"))
+
+	client.Index("blob", projectIDString+"_busy", map[string]interface{}{"type": "blob"})
+	client.Index("blob", projectIDString+"_invalid", map[string]interface{}{"type": "blob"})
+
+	require.Error(t, client.Flush(context.Background()))
+
+	require.GreaterOrEqual(t, testutil.ToFloat64(metrics.BulkRequestsTotal)-requests, 2.0)
+	require.Greater(t, testutil.ToFloat64(metrics.BulkBytesTotal), bytes)
+	require.Equal(t, 1.0, testutil.ToFloat64(metrics.BulkFailuresTotal.WithLabelValues("retry"))-retries)
+	require.Equal(t, 1.0, testutil.ToFloat64(metrics.BulkFailuresTotal.WithLabelValues("document"))-failures)
+}
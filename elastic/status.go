@@ -0,0 +1,88 @@
+package elastic
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/olivere/elastic/v7"
+)
+
+// IndexStatus records the last commit indexed for a project, so the next
+// run can start from it. When refs are indexed, it records the last commit
+// indexed for each of them instead.
+type IndexStatus struct {
+	ProjectID      int64             `json:"project_id"`
+	BlobType       string            `json:"blob_type"`
+	LastCommit     string            `json:"last_commit"`
+	Refs           map[string]string `json:"refs,omitempty"`
+	IndexedAt      time.Time         `json:"indexed_at"`
+	IndexerVersion string            `json:"indexer_version"`
+
+	// WikiBlobIDs tells that the documents of a wiki all have the IDs of
+	// indexer.GenerateWikiBlobID, see RemoveLegacyWikiBlobs
+	WikiBlobIDs bool `json:"wiki_blob_ids,omitempty"`
+}
+
+func (c *Client) StatusIndexName() string {
+	if c.IndexNameStatus != "" {
+		return c.IndexNameStatus
+	}
+
+	return c.IndexNameDefault + "-index-status"
+}
+
+func (c *Client) statusID(blobType string) string {
+	return fmt.Sprintf("project_%v_%v", c.ProjectID, blobType)
+}
+
+// GetIndexStatus returns nil when the project was never indexed
+func (c *Client) GetIndexStatus(ctx context.Context, blobType string) (*IndexStatus, error) {
+	result, err := c.Client.Get().Index(c.StatusIndexName()).Id(c.statusID(blobType)).Do(ctx)
+	if elastic.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	status := new(IndexStatus)
+	if err := json.Unmarshal(result.Source, status); err != nil {
+		return nil, fmt.Errorf("Index status %s: %s", c.statusID(blobType), err)
+	}
+
+	return status, nil
+}
+
+// SetIndexStatus is meant to be called once everything up to the commit
+// has been flushed
+func (c *Client) SetIndexStatus(ctx context.Context, blobType, commit, version string) error {
+	return c.setIndexStatus(ctx, &IndexStatus{
+		ProjectID:      c.ProjectID,
+		BlobType:       blobType,
+		LastCommit:     commit,
+		IndexedAt:      time.Now().UTC(),
+		IndexerVersion: version,
+		WikiBlobIDs:    blobType == "wiki_blob",
+	})
+}
+
+// SetRefsIndexStatus records the last commit indexed for each ref, which is
+// meant to be called every time a ref has been flushed
+func (c *Client) SetRefsIndexStatus(ctx context.Context, blobType string, refs map[string]string, version string) error {
+	return c.setIndexStatus(ctx, &IndexStatus{
+		ProjectID:      c.ProjectID,
+		BlobType:       blobType,
+		Refs:           refs,
+		IndexedAt:      time.Now().UTC(),
+		IndexerVersion: version,
+		WikiBlobIDs:    blobType == "wiki_blob",
+	})
+}
+
+func (c *Client) setIndexStatus(ctx context.Context, status *IndexStatus) error {
+	_, err := c.Client.Index().Index(c.StatusIndexName()).Id(c.statusID(status.BlobType)).BodyJson(status).Do(ctx)
+
+	return err
+}
@@ -0,0 +1,60 @@
+package elastic_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-elasticsearch-indexer/elastic"
+)
+
+func TestIndexStatus(t *testing.T) {
+	ctx := context.Background()
+
+	srv, docs := documentServer(t)
+	defer srv.Close()
+
+	config, err := elastic.ReadConfig(strings.NewReader(
+		`{
+			"url":["` + srv.URL + `"],
+			"index_name": "gitlab-test",
+			"index_name_status": "gitlab-test-status"
+		}`,
+	))
+	require.NoError(t, err)
+	config.ProjectID = projectID
+
+	client, err := elastic.NewClient(config, "the-correlation-id")
+	require.NoError(t, err)
+	defer client.Close()
+
+	status, err := client.GetIndexStatus(ctx, "blob")
+	require.NoError(t, err)
+	require.Nil(t, status)
+
+	require.NoError(t, client.SetIndexStatus(ctx, "blob", "b83d6e391c22777fca1ed3012fce84f633d7fed0", "v1.2.3"))
+	require.Contains(t, docs, "/gitlab-test-status/_doc/project_667_blob")
+
+	status, err = client.GetIndexStatus(ctx, "blob")
+	require.NoError(t, err)
+	require.Equal(t, projectID, status.ProjectID)
+	require.Equal(t, "blob", status.BlobType)
+	require.Equal(t, "b83d6e391c22777fca1ed3012fce84f633d7fed0", status.LastCommit)
+	require.Equal(t, "v1.2.3", status.IndexerVersion)
+	require.WithinDuration(t, time.Now(), status.IndexedAt, time.Minute)
+	require.False(t, status.WikiBlobIDs)
+
+	// Wikis are tracked separately
+	status, err = client.GetIndexStatus(ctx, "wiki_blob")
+	require.NoError(t, err)
+	require.Nil(t, status)
+
+	require.NoError(t, client.SetIndexStatus(ctx, "wiki_blob", "b83d6e391c22777fca1ed3012fce84f633d7fed0", "v1.2.3"))
+
+	status, err = client.GetIndexStatus(ctx, "wiki_blob")
+	require.NoError(t, err)
+	require.True(t, status.WikiBlobIDs)
+}
@@ -0,0 +1,86 @@
+package elastic_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/opentracing/opentracing-go"
+	otlog "github.com/opentracing/opentracing-go/log"
+	"github.com/opentracing/opentracing-go/mocktracer"
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-elasticsearch-indexer/elastic"
+)
+
+// quietTracer drops the logs of spans, which mocktracer can't record when
+// they hold nil errors like those of the HTTP client traces
+type quietTracer struct {
+	*mocktracer.MockTracer
+}
+
+func (t quietTracer) StartSpan(operationName string, opts ...opentracing.StartSpanOption) opentracing.Span {
+	return quietSpan{t.MockTracer.StartSpan(operationName, opts...).(*mocktracer.MockSpan)}
+}
+
+type quietSpan struct {
+	*mocktracer.MockSpan
+}
+
+func (quietSpan) LogFields(...otlog.Field) {}
+
+func TestBulkRequestsAreTraced(t *testing.T) {
+	tracer := mocktracer.New()
+	previous := opentracing.GlobalTracer()
+	opentracing.SetGlobalTracer(quietTracer{tracer})
+	t.Cleanup(func() { opentracing.SetGlobalTracer(previous) })
+
+	var mu sync.Mutex
+	var traceIDs []string
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		traceIDs = append(traceIDs, r.Header.Get("Mockpfx-Ids-Traceid"))
+		mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"errors":false,"items":[{"index":{"_index":"gitlab-test","_id":"667_foo","status":201}}]}`))
+	}))
+	t.Cleanup(srv.Close)
+
+	config, err := elastic.ReadConfig(strings.NewReader(`{"url":["` + srv.URL + `"], "index_name": "gitlab-test"}`))
+	require.NoError(t, err)
+	config.ProjectID = projectID
+
+	parent, ctx := opentracing.StartSpanFromContext(context.Background(), "index")
+
+	client, err := elastic.NewClientWithContext(ctx, config, "the-correlation-id")
+	require.NoError(t, err)
+	t.Cleanup(client.Close)
+
+	client.Index("blob", projectIDString+"_foo", map[string]interface{}{"type": "blob"})
+	require.NoError(t, client.Flush(context.Background()))
+	parent.Finish()
+
+	parentID := parent.Context().(mocktracer.MockSpanContext)
+
+	// The trace context is sent to Elasticsearch
+	require.Equal(t, []string{strconv.Itoa(parentID.TraceID)}, traceIDs)
+
+	var bulkSpans []*mocktracer.MockSpan
+	for _, span := range tracer.FinishedSpans() {
+		require.Equal(t, parentID.TraceID, span.SpanContext.TraceID)
+		if span.OperationName == "elasticsearch.bulk" {
+			bulkSpans = append(bulkSpans, span)
+		}
+	}
+
+	require.Len(t, bulkSpans, 1)
+	require.Equal(t, parentID.SpanID, bulkSpans[0].ParentID)
+	require.Equal(t, projectID, bulkSpans[0].Tag("project_id"))
+	require.Equal(t, 1, bulkSpans[0].Tag("requests"))
+}
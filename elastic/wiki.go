@@ -0,0 +1,35 @@
+package elastic
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/olivere/elastic/v7"
+)
+
+// RemoveLegacyWikiBlobs deletes the wiki blob documents of the project whose
+// ID isn't the one of indexer.GenerateWikiBlobID, which earlier versions wrote
+// to the default index. Documents of the current IDs are left alone.
+func (c *Client) RemoveLegacyWikiBlobs(ctx context.Context) (int64, error) {
+	// The IDs are only kept in _id, the documents leave them out
+	query := elastic.NewBoolQuery().
+		Filter(
+			elastic.NewTermQuery("project_id", c.ProjectID),
+			elastic.NewTermQuery("type", "wiki_blob"),
+		).
+		MustNot(elastic.NewPrefixQuery("_id", fmt.Sprintf("wiki_%v_", c.ProjectID)))
+
+	response, err := c.Client.DeleteByQuery(c.IndexNameDefault).
+		Routing(fmt.Sprintf("project_%v", c.ProjectID)).
+		Query(query).
+		Do(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(response.Failures) > 0 {
+		return 0, fmt.Errorf("Removing legacy wiki blobs: %d documents failed, the first one with status %d", len(response.Failures), response.Failures[0].Status)
+	}
+
+	return response.Deleted, nil
+}
@@ -0,0 +1,129 @@
+package elastic_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-elasticsearch-indexer/elastic"
+	"gitlab.com/gitlab-org/gitlab-elasticsearch-indexer/indexer"
+)
+
+// queryServer answers delete by query requests on index with the documents
+// of docs, keyed by ID, which match the filters and none of the negated
+// prefixes of a boolean query. It returns the paths of the requests.
+func queryServer(t *testing.T, index string, docs map[string]map[string]interface{}) (*httptest.Server, func() []string) {
+	var mu sync.Mutex
+	var paths []string
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		paths = append(paths, r.URL.Path)
+		require.Equal(t, "/"+index+"/_delete_by_query", r.URL.Path)
+
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+
+		var request struct {
+			Query struct {
+				Bool struct {
+					Filter  []map[string]map[string]interface{} `json:"filter"`
+					MustNot map[string]map[string]string        `json:"must_not"`
+				} `json:"bool"`
+			} `json:"query"`
+		}
+		require.NoError(t, json.Unmarshal(body, &request))
+
+		deleted := 0
+		for id, doc := range docs {
+			match := true
+			for _, filter := range request.Query.Bool.Filter {
+				for field, value := range filter["term"] {
+					match = match && doc[field] == value
+				}
+			}
+			for field, prefix := range request.Query.Bool.MustNot["prefix"] {
+				value, _ := doc[field].(string)
+				if field == "_id" {
+					value = id
+				}
+				match = match && !strings.HasPrefix(value, prefix)
+			}
+
+			if match {
+				delete(docs, id)
+				deleted++
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		require.NoError(t, json.NewEncoder(w).Encode(map[string]interface{}{"deleted": deleted, "failures": []interface{}{}}))
+	}))
+
+	return srv, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+
+		return paths
+	}
+}
+
+// wikiBlobDocument is the source of a document of the default index, as
+// indexed for the blob at path
+func wikiBlobDocument(t *testing.T, documentType, path string) map[string]interface{} {
+	data, err := json.Marshal(map[string]interface{}{
+		"project_id": projectID,
+		"type":       documentType,
+		"blob":       &indexer.Blob{Type: documentType, ID: indexer.GenerateWikiBlobID(projectID, path), Path: path},
+	})
+	require.NoError(t, err)
+
+	var doc map[string]interface{}
+	require.NoError(t, json.Unmarshal(data, &doc))
+
+	return doc
+}
+
+func TestRemoveLegacyWikiBlobs(t *testing.T) {
+	docs := map[string]map[string]interface{}{
+		indexer.GenerateWikiBlobID(projectID, "home.md"): wikiBlobDocument(t, "wiki_blob", "home.md"),
+		indexer.GenerateBlobID(projectID, "home.md"):     wikiBlobDocument(t, "wiki_blob", "home.md"),
+		indexer.GenerateBlobID(projectID, "README.md"):   wikiBlobDocument(t, "blob", "README.md"),
+	}
+
+	srv, paths := queryServer(t, "gitlab-test", docs)
+	defer srv.Close()
+
+	config, err := elastic.ReadConfig(strings.NewReader(
+		`{
+			"url":["` + srv.URL + `"],
+			"index_name": "gitlab-test",
+			"index_name_wikis": "gitlab-test-wikis"
+		}`,
+	))
+	require.NoError(t, err)
+	config.ProjectID = projectID
+
+	client, err := elastic.NewClient(config, "the-correlation-id")
+	require.NoError(t, err)
+	defer client.Close()
+
+	deleted, err := client.RemoveLegacyWikiBlobs(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, int64(1), deleted)
+
+	// Earlier versions only wrote wiki blobs to the default index
+	require.Equal(t, []string{"/gitlab-test/_delete_by_query"}, paths())
+	require.Contains(t, docs, indexer.GenerateWikiBlobID(projectID, "home.md"))
+	require.Contains(t, docs, indexer.GenerateBlobID(projectID, "README.md"))
+	require.NotContains(t, docs, indexer.GenerateBlobID(projectID, "home.md"))
+}
@@ -8,9 +8,11 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"regexp"
 	"strings"
 	"time"
 
+	"github.com/opentracing/opentracing-go"
 	logkit "gitlab.com/gitlab-org/labkit/log"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
@@ -20,6 +22,8 @@ import (
 	pb "gitlab.com/gitlab-org/gitaly/v14/proto/go/gitalypb"
 	"gitlab.com/gitlab-org/labkit/correlation"
 	grpccorrelation "gitlab.com/gitlab-org/labkit/correlation/grpc"
+
+	"gitlab.com/gitlab-org/gitlab-elasticsearch-indexer/metrics"
 )
 
 const (
@@ -30,6 +34,7 @@ const (
 
 	clientName                 = "gitlab-elasticsearch-indexer"
 	defaultLimitFileSize int64 = 1024 * 1024
+	defaultBlobBatchSize int64 = 10 * 1024 * 1024
 )
 
 type StorageConfig struct {
@@ -39,6 +44,7 @@ type StorageConfig struct {
 	RelativePath  string `json:"relative_path"`
 	ProjectPath   string `json:"project_path"`
 	LimitFileSize int64  `json:"limit_file_size"`
+	BlobBatchSize int64  `json:"blob_batch_size"`
 	TokenVersion  int    `json:"token_version"`
 }
 
@@ -49,23 +55,93 @@ type gitalyClient struct {
 	repositoryServiceClient pb.RepositoryServiceClient
 	refServiceClient        pb.RefServiceClient
 	commitServiceClient     pb.CommitServiceClient
-	ctx                     context.Context
+	diffServiceClient       pb.DiffServiceClient
+	correlationID           string
 	FromHash                string
 	ToHash                  string
 	limitFileSize           int64
+	blobBatchSize           int64
+	gitmodules              map[string]string
+
+	// previousOids is set by SetRange or TrackPreviousOids, to fill
+	// File.PreviousOid
+	previousOids bool
+
+	// pooled is set when conn belongs to a connection pool
+	pooled bool
+
+	// prefetchFilter is set by SetPrefetchFilter, and calls counts the calls
+	// to PutFunc and DelFunc since EachFileChange started
+	prefetchFilter PrefetchFilter
+	calls          int64
 }
 
 func NewGitalyClient(config *StorageConfig, fromSHA, toSHA, correlationID, projectID string) (*gitalyClient, error) {
-	var RPCCred credentials.PerRPCCredentials
+	return NewGitalyClientWithContext(context.Background(), config, fromSHA, toSHA, correlationID, projectID)
+}
+
+// NewGitalyClientWithContext is like NewGitalyClient, except that connecting
+// to Gitaly and looking up HEAD when toSHA is empty give up once ctx is done
+func NewGitalyClientWithContext(ctx context.Context, config *StorageConfig, fromSHA, toSHA, correlationID, projectID string) (*gitalyClient, error) {
+	RPCCred, err := rpcCredentials(config)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := gitalyclient.DialContext(ctx, config.Address, append(dialOptions(), grpc.WithPerRPCCredentials(RPCCred)))
+	if err != nil {
+		return nil, fmt.Errorf("did not connect: %s", err)
+	}
+
+	client, err := newGitalyClient(ctx, conn, config, fromSHA, toSHA, correlationID, projectID)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return client, nil
+}
+
+// NewConnectionPool creates a pool of Gitaly connections, to be shared by
+// the clients of several repositories with NewGitalyClientWithPool
+func NewConnectionPool() *gitalyclient.Pool {
+	return gitalyclient.NewPool(dialOptions()...)
+}
+
+// NewGitalyClientWithPool is like NewGitalyClient, except that the
+// connection is taken from pool. Closing the client leaves it open for the
+// next clients.
+func NewGitalyClientWithPool(ctx context.Context, pool *gitalyclient.Pool, config *StorageConfig, fromSHA, toSHA, correlationID, projectID string) (*gitalyClient, error) {
+	// The pool adds the credentials itself
+	if _, err := rpcCredentials(config); err != nil {
+		return nil, err
+	}
+
+	conn, err := pool.Dial(ctx, config.Address, config.Token)
+	if err != nil {
+		return nil, fmt.Errorf("did not connect: %s", err)
+	}
+
+	client, err := newGitalyClient(ctx, conn, config, fromSHA, toSHA, correlationID, projectID)
+	if err != nil {
+		return nil, err
+	}
+	client.pooled = true
+
+	return client, nil
+}
+
+func rpcCredentials(config *StorageConfig) (credentials.PerRPCCredentials, error) {
 	if config.TokenVersion == 0 || config.TokenVersion == 2 {
-		RPCCred = gitalyauth.RPCCredentialsV2(config.Token)
-	} else {
-		return nil, errors.New("Unknown token version")
+		return gitalyauth.RPCCredentialsV2(config.Token), nil
 	}
 
-	connOpts := append(
-		gitalyclient.DefaultDialOpts,
-		grpc.WithPerRPCCredentials(RPCCred),
+	return nil, errors.New("Unknown token version")
+}
+
+func dialOptions() []grpc.DialOption {
+	return append(
+		append([]grpc.DialOption{}, gitalyclient.DefaultDialOpts...),
 		grpc.WithStreamInterceptor(
 			grpccorrelation.StreamClientCorrelationInterceptor(
 				grpccorrelation.WithClientName(clientName),
@@ -77,14 +153,9 @@ func NewGitalyClient(config *StorageConfig, fromSHA, toSHA, correlationID, proje
 			),
 		),
 	)
+}
 
-	ctx := newContext(correlationID)
-
-	conn, err := gitalyclient.Dial(config.Address, connOpts)
-	if err != nil {
-		return nil, fmt.Errorf("did not connect: %s", err)
-	}
-
+func newGitalyClient(ctx context.Context, conn *grpc.ClientConn, config *StorageConfig, fromSHA, toSHA, correlationID, projectID string) (*gitalyClient, error) {
 	repository := &pb.Repository{
 		StorageName:   config.StorageName,
 		RelativePath:  config.RelativePath,
@@ -99,8 +170,14 @@ func NewGitalyClient(config *StorageConfig, fromSHA, toSHA, correlationID, proje
 		repositoryServiceClient: pb.NewRepositoryServiceClient(conn),
 		refServiceClient:        pb.NewRefServiceClient(conn),
 		commitServiceClient:     pb.NewCommitServiceClient(conn),
-		ctx:                     ctx,
+		diffServiceClient:       pb.NewDiffServiceClient(conn),
+		correlationID:           correlationID,
 		limitFileSize:           config.LimitFileSize,
+		blobBatchSize:           config.BlobBatchSize,
+	}
+
+	if client.blobBatchSize <= 0 {
+		client.blobBatchSize = defaultBlobBatchSize
 	}
 
 	if fromSHA == "" || fromSHA == ZeroSHA {
@@ -110,7 +187,7 @@ func NewGitalyClient(config *StorageConfig, fromSHA, toSHA, correlationID, proje
 	}
 
 	if toSHA == "" {
-		head, err := client.lookUpHEAD()
+		head, err := client.lookUpHEAD(ctx)
 		if err != nil {
 			return nil, fmt.Errorf("lookUpHEAD: %v", err)
 		}
@@ -129,6 +206,7 @@ func ReadConfig(repoPath, projectPath string) (*StorageConfig, error) {
 		RelativePath:  repoPath,
 		ProjectPath:   projectPath,
 		LimitFileSize: defaultLimitFileSize,
+		BlobBatchSize: defaultBlobBatchSize,
 	}
 
 	err := json.NewDecoder(data).Decode(&config)
@@ -136,14 +214,14 @@ func ReadConfig(repoPath, projectPath string) (*StorageConfig, error) {
 	return &config, err
 }
 
-func NewGitalyClientFromEnv(repoPath, fromSHA, toSHA, correlationID, projectID, projectPath string) (*gitalyClient, error) {
+func NewGitalyClientFromEnv(ctx context.Context, repoPath, fromSHA, toSHA, correlationID, projectID, projectPath string) (*gitalyClient, error) {
 	config, err := ReadConfig(repoPath, projectPath)
 
 	if err != nil {
 		return nil, err
 	}
 
-	client, err := NewGitalyClient(config, fromSHA, toSHA, correlationID, projectID)
+	client, err := NewGitalyClientWithContext(ctx, config, fromSHA, toSHA, correlationID, projectID)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to open %s: %s", config.RelativePath, err)
 	}
@@ -152,21 +230,33 @@ func NewGitalyClientFromEnv(repoPath, fromSHA, toSHA, correlationID, projectID,
 }
 
 func (gc *gitalyClient) Close() {
-	gc.conn.Close()
+	if !gc.pooled {
+		gc.conn.Close()
+	}
+}
+
+// context adds the correlation ID to the context of every RPC
+func (gc *gitalyClient) context(ctx context.Context) context.Context {
+	return correlation.ContextWithCorrelation(ctx, gc.correlationID)
 }
 
-func (gc *gitalyClient) EachFileChange(put PutFunc, del DelFunc) error {
+func (gc *gitalyClient) EachFileChange(ctx context.Context, put PutFunc, del DelFunc) (err error) {
+	span, ctx := gc.startSpan(ctx, "gitaly.GetRawChanges")
+	defer func() { finishSpan(span, err) }()
+
 	request := &pb.GetRawChangesRequest{
 		Repository:   gc.repository,
 		FromRevision: gc.FromHash,
 		ToRevision:   gc.ToHash,
 	}
 
-	stream, err := gc.repositoryServiceClient.GetRawChanges(gc.ctx, request)
+	stream, err := gc.repositoryServiceClient.GetRawChanges(gc.context(ctx), request)
 	if err != nil {
 		return fmt.Errorf("could not call rpc.GetRawChanges: %v", err)
 	}
 
+	gc.calls = 0
+
 	for {
 		c, err := stream.Recv()
 		if err == io.EOF {
@@ -175,53 +265,385 @@ func (gc *gitalyClient) EachFileChange(put PutFunc, del DelFunc) error {
 		if err != nil {
 			return fmt.Errorf("%v.GetRawChanges, %v", c, err)
 		}
-		for _, change := range c.RawChanges {
-			// TODO: We just skip submodules from indexing now just to mirror the go-git
-			// implementation but it can be not that expensive to implement with gitaly actually so some
-			// investigation is required here
-			if change.OldMode == SubmoduleFileMode || change.NewMode == SubmoduleFileMode {
-				continue
+		for _, batch := range gc.batchRawChanges(c.RawChanges) {
+			if err := gc.eachRawChange(ctx, batch, put, del); err != nil {
+				return err
 			}
+		}
+	}
+	return nil
+}
 
-			switch change.Operation.String() {
-			case "DELETED", "RENAMED":
-				path := string(change.OldPathBytes)
-				logkit.WithFields(
-					logkit.Fields{
-						"operation": "DELETE",
-						"path":      path,
-					},
-				).Debug("Indexing blob change")
-				if err = del(path); err != nil {
-					return err
-				}
+// batchRawChanges splits a page of changes into batches whose blobs add up
+// to at most blobBatchSize bytes, keeping the order of the changes
+func (gc *gitalyClient) batchRawChanges(changes []*pb.GetRawChangesResponse_RawChange) [][]*pb.GetRawChangesResponse_RawChange {
+	var batches [][]*pb.GetRawChangesResponse_RawChange
+	var batch []*pb.GetRawChangesResponse_RawChange
+	var batchSize int64
+
+	for _, change := range changes {
+		if gc.needsBlob(change) {
+			if len(batch) > 0 && batchSize+change.Size > gc.blobBatchSize {
+				batches = append(batches, batch)
+				batch = nil
+				batchSize = 0
 			}
+			batchSize += change.Size
+		}
+		batch = append(batch, change)
+	}
 
-			switch change.Operation.String() {
-			case "ADDED", "RENAMED", "MODIFIED", "COPIED":
-				file, err := gc.gitalyBuildFile(change, string(change.NewPathBytes))
+	if len(batch) > 0 {
+		batches = append(batches, batch)
+	}
+
+	return batches
+}
+
+func (gc *gitalyClient) needsBlob(change *pb.GetRawChangesResponse_RawChange) bool {
+	if isSubmodule(int64(change.OldMode), int64(change.NewMode)) {
+		return false
+	}
+
+	switch change.Operation.String() {
+	case "ADDED", "RENAMED", "MODIFIED", "COPIED":
+		return change.Size <= gc.limitFileSize
+	}
+
+	return false
+}
+
+// prefetched returns the changes whose blobs to fetch ahead, counting the
+// calls to PutFunc and DelFunc the same way eachRawChange makes them
+func (gc *gitalyClient) prefetched(changes []*pb.GetRawChangesResponse_RawChange) []*pb.GetRawChangesResponse_RawChange {
+	if gc.prefetchFilter == nil {
+		return changes
+	}
+
+	var prefetched []*pb.GetRawChangesResponse_RawChange
+	calls := gc.calls
+
+	for _, change := range changes {
+		switch change.Operation.String() {
+		case "DELETED", "RENAMED":
+			calls++
+		}
+
+		if gc.needsBlob(change) && gc.prefetchFilter(string(change.NewPathBytes), change.BlobId, calls) {
+			prefetched = append(prefetched, change)
+		}
+
+		switch change.Operation.String() {
+		case "TYPE_CHANGED":
+			if isSubmodule(int64(change.OldMode), int64(change.NewMode)) || gc.previousOids {
+				calls++
+			}
+		case "ADDED", "RENAMED", "MODIFIED", "COPIED":
+			calls++
+		}
+	}
+
+	return prefetched
+}
+
+func (gc *gitalyClient) eachRawChange(ctx context.Context, changes []*pb.GetRawChangesResponse_RawChange, put PutFunc, del DelFunc) error {
+	blobs, err := gc.getBlobs(ctx, gc.prefetched(changes))
+	if err != nil {
+		return err
+	}
+
+	previous, err := gc.getPreviousOids(ctx, changes)
+	if err != nil {
+		return err
+	}
+
+	for _, change := range changes {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		submodule := isSubmodule(int64(change.OldMode), int64(change.NewMode))
+
+		switch change.Operation.String() {
+		case "DELETED", "RENAMED":
+			path := string(change.OldPathBytes)
+			logkit.WithFields(
+				logkit.Fields{
+					"operation": "DELETE",
+					"path":      path,
+				},
+			).Debug("Indexing blob change")
+
+			// The blob of a deleted file is the old one
+			oid := previous[path]
+			if change.Operation.String() == "DELETED" {
+				oid = change.BlobId
+			}
+
+			gc.calls++
+			if err = del(path, oid); err != nil {
+				return err
+			}
+		}
+
+		switch change.Operation.String() {
+		case "TYPE_CHANGED":
+			// A blob replaced by a submodule or the other way around. Both
+			// share the same document, so it gets overwritten. Other type
+			// changes keep the document, unless documents are per blob.
+			if !submodule && !gc.previousOids {
+				continue
+			}
+			fallthrough
+		case "ADDED", "RENAMED", "MODIFIED", "COPIED":
+			var file *File
+			if change.NewMode == SubmoduleFileMode {
+				urls, err := gc.submoduleURLs(ctx)
 				if err != nil {
 					return err
 				}
-				logkit.WithFields(
-					logkit.Fields{
-						"operation": "PUT",
-						"path":      file.Path,
-					},
-				).Debug("Indexing blob change")
-				if err = put(file, gc.FromHash, gc.ToHash); err != nil {
-					return err
-				}
+				file = buildSubmoduleFile(string(change.NewPathBytes), change.BlobId, urls)
+			} else {
+				file = gc.gitalyBuildFile(ctx, change, string(change.NewPathBytes), blobs)
+			}
+			switch change.Operation.String() {
+			case "MODIFIED", "TYPE_CHANGED":
+				file.PreviousOid = previous[file.Path]
+			}
+			logkit.WithFields(
+				logkit.Fields{
+					"operation": "PUT",
+					"path":      file.Path,
+				},
+			).Debug("Indexing blob change")
+			gc.calls++
+			if err = put(file, gc.FromHash, gc.ToHash); err != nil {
+				return err
 			}
 		}
 	}
 	return nil
 }
 
+// submoduleURLs reads .gitmodules at ToHash the first time a submodule is
+// found in the changes
+func (gc *gitalyClient) submoduleURLs(ctx context.Context) (map[string]string, error) {
+	if gc.gitmodules != nil {
+		return gc.gitmodules, nil
+	}
+
+	data, err := gc.ReadFile(ctx, gitmodulesPath)
+	if err != nil {
+		return nil, err
+	}
+
+	gc.gitmodules = parseGitmodules(data)
+
+	return gc.gitmodules, nil
+}
+
+func (gc *gitalyClient) ReadFile(ctx context.Context, path string) (_ []byte, err error) {
+	span, ctx := gc.startSpan(ctx, "gitaly.GetBlobs")
+	defer func() { finishSpan(span, err) }()
+
+	request := &pb.GetBlobsRequest{
+		Repository: gc.repository,
+		RevisionPaths: []*pb.GetBlobsRequest_RevisionPath{
+			{Revision: gc.ToHash, Path: []byte(path)},
+		},
+		Limit: -1,
+	}
+
+	ctx, cancel := context.WithCancel(gc.context(ctx))
+	defer cancel()
+
+	stream, err := gc.blobServiceClient.GetBlobs(ctx, request)
+	if err != nil {
+		return nil, fmt.Errorf("could not call rpc.GetBlobs: %v", err)
+	}
+
+	blobs, err := readBlobs(stream)
+	if err != nil {
+		return nil, err
+	}
+
+	var data []byte
+	for _, blob := range blobs {
+		data = blob
+	}
+
+	return data, nil
+}
+
+func (gc *gitalyClient) FindFiles(ctx context.Context, name string) (_ []string, err error) {
+	span, ctx := gc.startSpan(ctx, "gitaly.SearchFilesByName")
+	defer func() { finishSpan(span, err) }()
+
+	request := &pb.SearchFilesByNameRequest{
+		Repository: gc.repository,
+		Query:      ".",
+		Ref:        []byte(gc.ToHash),
+		Filter:     "(^|/)" + regexp.QuoteMeta(name) + "$",
+	}
+
+	stream, err := gc.repositoryServiceClient.SearchFilesByName(gc.context(ctx), request)
+	if err != nil {
+		return nil, fmt.Errorf("could not call rpc.SearchFilesByName: %v", err)
+	}
+
+	var paths []string
+	for {
+		c, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error calling rpc.SearchFilesByName: %v", err)
+		}
+
+		for _, file := range c.Files {
+			paths = append(paths, string(file))
+		}
+	}
+
+	return paths, nil
+}
+
+// ChangedFiles combines the operations given by GetRawChanges with the line
+// stats given by DiffStats
+func (gc *gitalyClient) ChangedFiles(ctx context.Context, commit *Commit) (_ []ChangedFile, err error) {
+	stats, err := gc.diffStats(ctx, commit)
+	if err != nil {
+		return nil, err
+	}
+
+	span, ctx := gc.startSpan(ctx, "gitaly.GetRawChanges")
+	defer func() { finishSpan(span, err) }()
+
+	request := &pb.GetRawChangesRequest{
+		Repository:   gc.repository,
+		FromRevision: commit.FirstParent(),
+		ToRevision:   commit.Hash,
+	}
+
+	stream, err := gc.repositoryServiceClient.GetRawChanges(gc.context(ctx), request)
+	if err != nil {
+		return nil, fmt.Errorf("could not call rpc.GetRawChanges: %v", err)
+	}
+
+	var files []ChangedFile
+	for {
+		c, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error calling rpc.GetRawChanges: %v", err)
+		}
+
+		for _, change := range c.RawChanges {
+			file := ChangedFile{
+				Path:      string(change.NewPathBytes),
+				Operation: changeOperation(change.Operation.String()),
+			}
+
+			switch file.Operation {
+			case ChangeDeleted:
+				file.Path = string(change.OldPathBytes)
+			case ChangeRenamed:
+				file.OldPath = string(change.OldPathBytes)
+			}
+
+			if stat, ok := stats[file.Path]; ok {
+				file.Additions = int(stat.Additions)
+				file.Deletions = int(stat.Deletions)
+			}
+
+			files = append(files, file)
+		}
+	}
+
+	return files, nil
+}
+
+// diffStats returns the stats of the files changed by commit by path, which
+// is the new one for renamed files
+func (gc *gitalyClient) diffStats(ctx context.Context, commit *Commit) (_ map[string]*pb.DiffStats, err error) {
+	span, ctx := gc.startSpan(ctx, "gitaly.DiffStats")
+	defer func() { finishSpan(span, err) }()
+
+	request := &pb.DiffStatsRequest{
+		Repository:    gc.repository,
+		LeftCommitId:  commit.FirstParent(),
+		RightCommitId: commit.Hash,
+	}
+
+	stream, err := gc.diffServiceClient.DiffStats(gc.context(ctx), request)
+	if err != nil {
+		return nil, fmt.Errorf("could not call rpc.DiffStats: %v", err)
+	}
+
+	stats := make(map[string]*pb.DiffStats)
+	for {
+		c, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error calling rpc.DiffStats: %v", err)
+		}
+
+		for _, stat := range c.Stats {
+			stats[string(stat.Path)] = stat
+		}
+	}
+
+	return stats, nil
+}
+
+// Diff stops reading the stream of RawDiff once maxSize bytes are read
+func (gc *gitalyClient) Diff(ctx context.Context, commit *Commit, maxSize int64) (_ string, err error) {
+	span, ctx := gc.startSpan(ctx, "gitaly.RawDiff")
+	defer func() { finishSpan(span, err) }()
+
+	request := &pb.RawDiffRequest{
+		Repository:    gc.repository,
+		LeftCommitId:  commit.FirstParent(),
+		RightCommitId: commit.Hash,
+	}
+
+	ctx, cancel := context.WithCancel(gc.context(ctx))
+	defer cancel()
+
+	stream, err := gc.diffServiceClient.RawDiff(ctx, request)
+	if err != nil {
+		return "", fmt.Errorf("could not call rpc.RawDiff: %v", err)
+	}
+
+	var diff bytes.Buffer
+	for int64(diff.Len()) < maxSize {
+		c, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", fmt.Errorf("error calling rpc.RawDiff: %v", err)
+		}
+
+		diff.Write(c.Data)
+	}
+
+	if int64(diff.Len()) > maxSize {
+		diff.Truncate(int(maxSize))
+	}
+
+	return diff.String(), nil
+}
+
 // HEAD is not always set in some cases, so we find the last commit in
 // a default branch instead
-func (gc *gitalyClient) lookUpHEAD() (string, error) {
-	defaultBranchName, err := gc.findDefaultBranchName()
+func (gc *gitalyClient) lookUpHEAD(ctx context.Context) (string, error) {
+	defaultBranchName, err := gc.findDefaultBranchName(ctx)
 	if err != nil {
 		return "", err
 	}
@@ -231,85 +653,265 @@ func (gc *gitalyClient) lookUpHEAD() (string, error) {
 		Revision:   defaultBranchName,
 	}
 
-	response, err := gc.commitServiceClient.FindCommit(gc.ctx, request)
+	response, err := gc.commitServiceClient.FindCommit(gc.context(ctx), request)
 	if err != nil {
 		return "", fmt.Errorf("Cannot look up HEAD: %v", err)
 	}
 	return response.Commit.Id, nil
 }
 
-func (gc *gitalyClient) findDefaultBranchName() ([]byte, error) {
+func (gc *gitalyClient) findDefaultBranchName(ctx context.Context) (_ []byte, err error) {
+	span, ctx := gc.startSpan(ctx, "gitaly.FindDefaultBranchName")
+	defer func() { finishSpan(span, err) }()
+
 	request := &pb.FindDefaultBranchNameRequest{
 		Repository: gc.repository,
 	}
 
-	response, err := gc.refServiceClient.FindDefaultBranchName(gc.ctx, request)
+	response, err := gc.refServiceClient.FindDefaultBranchName(gc.context(ctx), request)
 	if err != nil {
 		return nil, fmt.Errorf("Cannot find a default branch: %v", err)
 	}
 	return response.Name, nil
 }
 
-func (gc *gitalyClient) getBlob(oid string) (io.ReadCloser, error) {
-	data := new(bytes.Buffer)
-
+// getBlob opens a GetBlob stream for oid. The returned reader receives the
+// blob from the stream as it is read, so it is never buffered as a whole.
+func (gc *gitalyClient) getBlob(ctx context.Context, oid string) (io.ReadCloser, error) {
 	request := &pb.GetBlobRequest{
 		Repository: gc.repository,
 		Oid:        oid,
 		Limit:      gc.limitFileSize,
 	}
 
-	stream, err := gc.blobServiceClient.GetBlob(gc.ctx, request)
+	// The span lasts until the reader is closed
+	span, ctx := gc.startSpan(ctx, "gitaly.GetBlob")
+	span.SetTag("oid", oid)
+
+	ctx, cancel := context.WithCancel(gc.context(ctx))
+
+	stream, err := gc.blobServiceClient.GetBlob(ctx, request)
+	if err != nil {
+		cancel()
+		err = fmt.Errorf("Cannot get blob: %s", oid)
+		finishSpan(span, err)
+		return nil, err
+	}
+
+	return &blobStreamReader{oid: oid, stream: stream, cancel: cancel, span: span}, nil
+}
+
+// getBlobs fetches the blobs of a batch of changes with a single GetBlobs
+// call, keyed by blob ID. Blobs missing from the response are left out, so
+// they are fetched one by one when needed.
+func (gc *gitalyClient) getBlobs(ctx context.Context, changes []*pb.GetRawChangesResponse_RawChange) (_ map[string][]byte, err error) {
+	request := &pb.GetBlobsRequest{
+		Repository: gc.repository,
+		Limit:      gc.limitFileSize,
+	}
+
+	requested := make(map[string]bool)
+	for _, change := range changes {
+		if !gc.needsBlob(change) || requested[change.BlobId] {
+			continue
+		}
+
+		requested[change.BlobId] = true
+		request.RevisionPaths = append(request.RevisionPaths, &pb.GetBlobsRequest_RevisionPath{
+			Revision: gc.ToHash,
+			Path:     change.NewPathBytes,
+		})
+	}
+
+	if len(request.RevisionPaths) == 0 {
+		return nil, nil
+	}
+
+	span, ctx := gc.startSpan(ctx, "gitaly.GetBlobs")
+	span.SetTag("blobs", len(request.RevisionPaths))
+	defer func() { finishSpan(span, err) }()
+
+	ctx, cancel := context.WithCancel(gc.context(ctx))
+	defer cancel()
+
+	stream, err := gc.blobServiceClient.GetBlobs(ctx, request)
+	if err != nil {
+		return nil, fmt.Errorf("could not call rpc.GetBlobs: %v", err)
+	}
+
+	return readBlobs(stream)
+}
+
+// getPreviousOids looks up the blobs replaced or renamed by a batch of
+// changes at FromHash, keyed by path, once a range is set with SetRange.
+// Deleted blobs are already known.
+func (gc *gitalyClient) getPreviousOids(ctx context.Context, changes []*pb.GetRawChangesResponse_RawChange) (_ map[string]string, err error) {
+	if !gc.previousOids || gc.FromHash == NullTreeSHA {
+		return nil, nil
+	}
+
+	// Only the object IDs are needed, not the data
+	request := &pb.GetBlobsRequest{
+		Repository: gc.repository,
+		Limit:      0,
+	}
+
+	for _, change := range changes {
+		var path []byte
+
+		switch change.Operation.String() {
+		case "MODIFIED", "TYPE_CHANGED":
+			path = change.NewPathBytes
+		case "RENAMED":
+			path = change.OldPathBytes
+		default:
+			continue
+		}
+
+		request.RevisionPaths = append(request.RevisionPaths, &pb.GetBlobsRequest_RevisionPath{
+			Revision: gc.FromHash,
+			Path:     path,
+		})
+	}
+
+	if len(request.RevisionPaths) == 0 {
+		return nil, nil
+	}
+
+	span, ctx := gc.startSpan(ctx, "gitaly.GetBlobs")
+	span.SetTag("blobs", len(request.RevisionPaths))
+	defer func() { finishSpan(span, err) }()
+
+	ctx, cancel := context.WithCancel(gc.context(ctx))
+	defer cancel()
+
+	stream, err := gc.blobServiceClient.GetBlobs(ctx, request)
 	if err != nil {
-		return nil, fmt.Errorf("Cannot get blob: %s", oid)
+		return nil, fmt.Errorf("could not call rpc.GetBlobs: %v", err)
+	}
+
+	return readOids(stream)
+}
+
+// readOids reads the object ID of every path in a GetBlobs stream
+func readOids(stream pb.BlobService_GetBlobsClient) (map[string]string, error) {
+	oids := make(map[string]string)
+
+	for {
+		c, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error calling rpc.GetBlobs: %v", err)
+		}
+
+		if c.Oid != "" {
+			oids[string(c.Path)] = c.Oid
+		}
 	}
 
+	return oids, nil
+}
+
+func readBlobs(stream pb.BlobService_GetBlobsClient) (map[string][]byte, error) {
+	blobs := make(map[string][]byte)
+	var oid string
+
 	for {
 		c, err := stream.Recv()
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
-			return nil, fmt.Errorf("%v.GetBlob: %v", c, err)
+			return nil, fmt.Errorf("error calling rpc.GetBlobs: %v", err)
+		}
+
+		// Only the first message of each blob carries its metadata, the
+		// following ones carry the rest of its data
+		if c.Oid != "" || len(c.Path) > 0 {
+			oid = c.Oid
+			if oid != "" {
+				blobs[oid] = make([]byte, 0, c.Size)
+			}
+		}
+
+		if oid != "" {
+			blobs[oid] = append(blobs[oid], c.Data...)
+		}
+		metrics.BlobBytesTotal.Add(float64(len(c.Data)))
+	}
+
+	return blobs, nil
+}
+
+type blobStreamReader struct {
+	oid    string
+	stream pb.BlobService_GetBlobClient
+	cancel context.CancelFunc
+	span   opentracing.Span
+	data   []byte
+}
+
+func (r *blobStreamReader) Read(p []byte) (int, error) {
+	for len(r.data) == 0 {
+		c, err := r.stream.Recv()
+		if err == io.EOF {
+			return 0, io.EOF
 		}
-		if c.Data != nil {
-			data.Write(c.Data)
+		if err != nil {
+			return 0, fmt.Errorf("%v.GetBlob: %v", r.oid, err)
 		}
+		r.data = c.Data
+		metrics.BlobBytesTotal.Add(float64(len(c.Data)))
 	}
 
-	return io.NopCloser(data), nil
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+
+	return n, nil
 }
 
-func (gc *gitalyClient) gitalyBuildFile(change *pb.GetRawChangesResponse_RawChange, path string) (*File, error) {
-	var data io.ReadCloser
-	var skipTooLarge bool
+// Close cancels the stream, so the rest of the blob is never sent if it
+// wasn't read
+func (r *blobStreamReader) Close() error {
+	r.cancel()
+	if r.span != nil {
+		finishSpan(r.span, nil)
+	}
+	return nil
+}
+
+func (gc *gitalyClient) gitalyBuildFile(ctx context.Context, change *pb.GetRawChangesResponse_RawChange, path string, blobs map[string][]byte) *File {
+	file := &File{
+		Path: path,
+		Oid:  change.BlobId,
+	}
+
 	// We limit the size to avoid loading too big blobs into memory
 	// as they will be rejected on the indexer side anyway
-	// Ideally, we need to create a lazy blob reader here.
 	if change.Size > gc.limitFileSize {
-		data = io.NopCloser(new(bytes.Buffer))
-		skipTooLarge = true
+		file.Blob = getBlobReader(io.NopCloser(new(bytes.Buffer)))
+		file.SkipTooLarge = true
+	} else if data, ok := blobs[change.BlobId]; ok {
+		file.Blob = func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(data)), nil }
 	} else {
-		var err error
-		data, err = gc.getBlob(change.BlobId)
-		if err != nil {
-			return nil, fmt.Errorf("getBlob returns error: %v", err)
-		}
+		// The stream is only opened when the indexer asks for the blob
+		oid := change.BlobId
+		file.Blob = func() (io.ReadCloser, error) { return gc.getBlob(ctx, oid) }
 	}
 
-	return &File{
-		Path:         path,
-		Oid:          change.BlobId,
-		Blob:         getBlobReader(data),
-		SkipTooLarge: skipTooLarge,
-	}, nil
+	return file
 }
 
 func getBlobReader(data io.ReadCloser) func() (io.ReadCloser, error) {
 	return func() (io.ReadCloser, error) { return data, nil }
 }
 
-func (gc *gitalyClient) EachCommit(f CommitFunc) error {
+func (gc *gitalyClient) EachCommit(ctx context.Context, f CommitFunc) (err error) {
+	span, ctx := gc.startSpan(ctx, "gitaly.ListCommits")
+	defer func() { finishSpan(span, err) }()
+
 	request := &pb.ListCommitsRequest{
 		Repository: gc.repository,
 		Revisions: []string{
@@ -319,7 +921,7 @@ func (gc *gitalyClient) EachCommit(f CommitFunc) error {
 		Reverse: true,
 	}
 
-	stream, err := gc.commitServiceClient.ListCommits(gc.ctx, request)
+	stream, err := gc.commitServiceClient.ListCommits(gc.context(ctx), request)
 	if err != nil {
 		return fmt.Errorf("could not call rpc.ListCommits: %v", err)
 	}
@@ -333,11 +935,16 @@ func (gc *gitalyClient) EachCommit(f CommitFunc) error {
 			return fmt.Errorf("error calling rpc.ListCommits: %v", err)
 		}
 		for _, cmt := range c.Commits {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
 			commit := &Commit{
 				Message:   string(cmt.Body),
 				Hash:      string(cmt.Id),
 				Author:    gitalyBuildSignature(cmt.Author),
 				Committer: gitalyBuildSignature(cmt.Committer),
+				Parents:   cmt.ParentIds,
 			}
 
 			logkit.WithField("commitID", cmt.Id).Debug("Indexing commit")
@@ -354,6 +961,68 @@ func (gc *gitalyClient) GetLimitFileSize() int64 {
 	return gc.limitFileSize
 }
 
+func (gc *gitalyClient) ListRefs(ctx context.Context, patterns []string) (_ []Ref, err error) {
+	span, ctx := gc.startSpan(ctx, "gitaly.ListRefs")
+	defer func() { finishSpan(span, err) }()
+
+	request := &pb.ListRefsRequest{
+		Repository: gc.repository,
+	}
+	for _, pattern := range patterns {
+		request.Patterns = append(request.Patterns, []byte(pattern))
+	}
+
+	stream, err := gc.refServiceClient.ListRefs(gc.context(ctx), request)
+	if err != nil {
+		return nil, fmt.Errorf("could not call rpc.ListRefs: %v", err)
+	}
+
+	var refs []Ref
+	for {
+		c, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error calling rpc.ListRefs: %v", err)
+		}
+
+		for _, reference := range c.References {
+			refs = append(refs, Ref{Name: string(reference.Name), Target: reference.Target})
+		}
+	}
+
+	return refs, nil
+}
+
+func (gc *gitalyClient) SetPrefetchFilter(filter PrefetchFilter) {
+	gc.prefetchFilter = filter
+}
+
+func (gc *gitalyClient) TrackPreviousOids() {
+	gc.previousOids = true
+}
+
+func (gc *gitalyClient) SetRange(fromSHA, toSHA string) {
+	if fromSHA == "" || fromSHA == ZeroSHA {
+		gc.FromHash = NullTreeSHA
+	} else {
+		gc.FromHash = fromSHA
+	}
+
+	gc.ToHash = toSHA
+	gc.gitmodules = nil
+	gc.previousOids = true
+}
+
+func (gc *gitalyClient) GetFromHash() string {
+	return gc.FromHash
+}
+
+func (gc *gitalyClient) GetToHash() string {
+	return gc.ToHash
+}
+
 func gitalyBuildSignature(ca *pb.CommitAuthor) Signature {
 	return Signature{
 		Name:  string(ca.Name),
@@ -361,7 +1030,3 @@ func gitalyBuildSignature(ca *pb.CommitAuthor) Signature {
 		When:  time.Unix(ca.Date.GetSeconds(), 0), // another option is ptypes.Timestamp(ca.Date)
 	}
 }
-
-func newContext(correlationID string) context.Context {
-	return correlation.ContextWithCorrelation(context.Background(), correlationID)
-}
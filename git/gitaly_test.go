@@ -1,12 +1,16 @@
 package git
 
 import (
+	"context"
+	"io"
 	"net"
 	"os"
 	"testing"
 
 	"github.com/stretchr/testify/require"
+	pb "gitlab.com/gitlab-org/gitaly/v14/proto/go/gitalypb"
 	"gitlab.com/gitlab-org/labkit/correlation"
+	"google.golang.org/grpc/connectivity"
 )
 
 const (
@@ -50,5 +54,202 @@ func TestNewGitalyClientWithContextID(t *testing.T) {
 	r.NoError(err)
 	r.NotNil(client)
 
-	r.Equal("the-correlation-id", correlation.ExtractFromContext(client.ctx))
+	r.Equal("the-correlation-id", correlation.ExtractFromContext(client.context(context.Background())))
+}
+
+func TestNewGitalyClientWithPoolSharesConnections(t *testing.T) {
+	r := require.New(t)
+
+	listener, err := startUnixSocketListener()
+	r.NoError(err)
+	defer listener.Close()
+
+	testConfig := getConfig(listener.Addr().String())
+
+	pool := NewConnectionPool()
+	defer pool.Close()
+
+	first, err := NewGitalyClientWithPool(context.Background(), pool, testConfig, testFromCommitSHA, testToCommitSHA, "first-correlation-id", "project-1")
+	r.NoError(err)
+	first.Close()
+
+	second, err := NewGitalyClientWithPool(context.Background(), pool, testConfig, testFromCommitSHA, testToCommitSHA, "second-correlation-id", "project-2")
+	r.NoError(err)
+	defer second.Close()
+
+	r.Same(first.conn, second.conn)
+	r.NotEqual(connectivity.Shutdown, second.conn.GetState())
+	r.Equal("project-2", second.repository.GlRepository)
+	r.Equal("second-correlation-id", correlation.ExtractFromContext(second.context(context.Background())))
+}
+
+type fakeGetBlobClient struct {
+	pb.BlobService_GetBlobClient
+	responses []*pb.GetBlobResponse
+	received  int
+}
+
+func (f *fakeGetBlobClient) Recv() (*pb.GetBlobResponse, error) {
+	if f.received == len(f.responses) {
+		return nil, io.EOF
+	}
+
+	f.received++
+	return f.responses[f.received-1], nil
+}
+
+func TestBlobStreamReaderReadsLazily(t *testing.T) {
+	r := require.New(t)
+
+	stream := &fakeGetBlobClient{
+		responses: []*pb.GetBlobResponse{
+			{Oid: "abc", Size: 11, Data: []byte("hello ")},
+			{Data: []byte("world")},
+		},
+	}
+	cancelled := false
+	reader := &blobStreamReader{oid: "abc", stream: stream, cancel: func() { cancelled = true }}
+
+	buf := make([]byte, 3)
+	n, err := reader.Read(buf)
+	r.NoError(err)
+	r.Equal("hel", string(buf[:n]))
+	r.Equal(1, stream.received)
+
+	rest, err := io.ReadAll(reader)
+	r.NoError(err)
+	r.Equal("lo world", string(rest))
+	r.Equal(2, stream.received)
+
+	r.NoError(reader.Close())
+	r.True(cancelled)
+}
+
+func gitalyRawChange(operation pb.GetRawChangesResponse_RawChange_Operation, path, blobID string, size int64) *pb.GetRawChangesResponse_RawChange {
+	return &pb.GetRawChangesResponse_RawChange{
+		Operation:    operation,
+		BlobId:       blobID,
+		Size:         size,
+		OldPathBytes: []byte(path),
+		NewPathBytes: []byte(path),
+		OldMode:      0100644,
+		NewMode:      0100644,
+	}
+}
+
+func TestBatchRawChangesIsBoundedByBlobSize(t *testing.T) {
+	r := require.New(t)
+
+	client := &gitalyClient{limitFileSize: 100, blobBatchSize: 150}
+
+	changes := []*pb.GetRawChangesResponse_RawChange{
+		gitalyRawChange(pb.GetRawChangesResponse_RawChange_ADDED, "a", "1", 100),
+		gitalyRawChange(pb.GetRawChangesResponse_RawChange_DELETED, "b", "2", 0),
+		gitalyRawChange(pb.GetRawChangesResponse_RawChange_MODIFIED, "c", "3", 40),
+		gitalyRawChange(pb.GetRawChangesResponse_RawChange_ADDED, "d", "4", 20),
+		// Too large blobs are never fetched, so they don't count
+		gitalyRawChange(pb.GetRawChangesResponse_RawChange_ADDED, "e", "5", 1000),
+		gitalyRawChange(pb.GetRawChangesResponse_RawChange_ADDED, "f", "6", 10),
+	}
+
+	batches := client.batchRawChanges(changes)
+	r.Len(batches, 2)
+	r.Equal(changes[:3], batches[0])
+	r.Equal(changes[3:], batches[1])
+}
+
+type fakeGetBlobsClient struct {
+	pb.BlobService_GetBlobsClient
+	responses []*pb.GetBlobsResponse
+}
+
+func (f *fakeGetBlobsClient) Recv() (*pb.GetBlobsResponse, error) {
+	if len(f.responses) == 0 {
+		return nil, io.EOF
+	}
+
+	response := f.responses[0]
+	f.responses = f.responses[1:]
+	return response, nil
+}
+
+func TestReadBlobsReassemblesChunks(t *testing.T) {
+	r := require.New(t)
+
+	stream := &fakeGetBlobsClient{
+		responses: []*pb.GetBlobsResponse{
+			{Oid: "1", Size: 11, Path: []byte("a"), Data: []byte("hello ")},
+			{Data: []byte("world")},
+			// A path that could not be resolved
+			{Path: []byte("b")},
+			{Oid: "3", Size: 0, Path: []byte("c")},
+			{Oid: "4", Size: 3, Path: []byte("d"), Data: []byte("foo")},
+		},
+	}
+
+	blobs, err := readBlobs(stream)
+	r.NoError(err)
+	r.Equal(map[string][]byte{"1": []byte("hello world"), "3": {}, "4": []byte("foo")}, blobs)
+}
+
+func TestReadOidsKeysObjectIDsByPath(t *testing.T) {
+	r := require.New(t)
+
+	stream := &fakeGetBlobsClient{
+		responses: []*pb.GetBlobsResponse{
+			{Oid: "1", Size: 11, Path: []byte("a")},
+			// A path that could not be resolved
+			{Path: []byte("b")},
+			{Oid: "3", Size: 0, Path: []byte("c")},
+		},
+	}
+
+	oids, err := readOids(stream)
+	r.NoError(err)
+	r.Equal(map[string]string{"a": "1", "c": "3"}, oids)
+}
+
+func TestPrefetchedCountsTheCallsBeforeEachChange(t *testing.T) {
+	r := require.New(t)
+
+	client := &gitalyClient{limitFileSize: 100, calls: 3}
+
+	changes := []*pb.GetRawChangesResponse_RawChange{
+		gitalyRawChange(pb.GetRawChangesResponse_RawChange_DELETED, "a", "1", 0),
+		gitalyRawChange(pb.GetRawChangesResponse_RawChange_RENAMED, "b", "2", 10),
+		// Without a range, type changes make no call
+		gitalyRawChange(pb.GetRawChangesResponse_RawChange_TYPE_CHANGED, "c", "3", 10),
+		gitalyRawChange(pb.GetRawChangesResponse_RawChange_ADDED, "d", "4", 10),
+		gitalyRawChange(pb.GetRawChangesResponse_RawChange_MODIFIED, "e", "5", 10),
+	}
+
+	r.Equal(changes, client.prefetched(changes))
+
+	calls := make(map[string]int64)
+	client.SetPrefetchFilter(func(path, oid string, n int64) bool {
+		calls[path] = n
+		return path != "d"
+	})
+
+	r.Equal([]*pb.GetRawChangesResponse_RawChange{changes[1], changes[4]}, client.prefetched(changes))
+	r.Equal(map[string]int64{"b": 5, "d": 6, "e": 7}, calls)
+}
+
+func TestGetPreviousOidsIsSkippedWithoutRange(t *testing.T) {
+	r := require.New(t)
+
+	changes := []*pb.GetRawChangesResponse_RawChange{
+		gitalyRawChange(pb.GetRawChangesResponse_RawChange_MODIFIED, "a", "1", 10),
+	}
+
+	// No RPC is made, so the client needs no connection
+	client := &gitalyClient{FromHash: testFromCommitSHA, ToHash: testToCommitSHA}
+	oids, err := client.getPreviousOids(context.Background(), changes)
+	r.NoError(err)
+	r.Nil(oids)
+
+	client.SetRange("", testToCommitSHA)
+	oids, err = client.getPreviousOids(context.Background(), changes)
+	r.NoError(err)
+	r.Nil(oids)
 }
@@ -0,0 +1,819 @@
+package git
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	logkit "gitlab.com/gitlab-org/labkit/log"
+
+	"gitlab.com/gitlab-org/gitlab-elasticsearch-indexer/metrics"
+)
+
+const (
+	// commitFormat is used with `git log -z`, so every field of a commit is
+	// separated by a NUL byte and so is every commit
+	commitFormat       = "%H%x00%an%x00%ae%x00%at%x00%cn%x00%ce%x00%ct%x00%P%x00%B"
+	commitFormatFields = 9
+)
+
+type LocalConfig struct {
+	RepoPath      string `json:"-"`
+	LimitFileSize int64  `json:"limit_file_size"`
+}
+
+// ReadLocalConfig reads the limit on the size of files from
+// `GITALY_CONNECTION_INFO` when it's set, as ReadConfig does, so that both
+// backends index the same files. Its other settings are ignored.
+func ReadLocalConfig(repoPath string) (*LocalConfig, error) {
+	config := LocalConfig{
+		RepoPath:      repoPath,
+		LimitFileSize: defaultLimitFileSize,
+	}
+
+	if data := os.Getenv("GITALY_CONNECTION_INFO"); data != "" {
+		if err := json.Unmarshal([]byte(data), &config); err != nil {
+			return nil, err
+		}
+	}
+
+	return &config, nil
+}
+
+// localClient reads a bare or non-bare repository directly from disk using
+// the git executable, which lets us index without a running Gitaly
+type localClient struct {
+	repoPath      string
+	FromHash      string
+	ToHash        string
+	limitFileSize int64
+	gitmodules    map[string]string
+
+	// previousOids is set by SetRange or TrackPreviousOids, to fill
+	// File.PreviousOid
+	previousOids bool
+
+	catFileMu sync.Mutex
+	catFile   *catFileProcess
+}
+
+type rawChange struct {
+	operation string
+	oldMode   int64
+	newMode   int64
+	blobID    string
+	oldBlobID string
+	oldPath   string
+	newPath   string
+	size      int64
+}
+
+func NewLocalClient(config *LocalConfig, fromSHA, toSHA string) (*localClient, error) {
+	return NewLocalClientWithContext(context.Background(), config, fromSHA, toSHA)
+}
+
+// NewLocalClientWithContext is like NewLocalClient, except that the git
+// commands opening the repository are killed once ctx is done
+func NewLocalClientWithContext(ctx context.Context, config *LocalConfig, fromSHA, toSHA string) (*localClient, error) {
+	client := &localClient{
+		repoPath:      config.RepoPath,
+		limitFileSize: config.LimitFileSize,
+	}
+
+	if _, err := client.run(ctx, "rev-parse", "--git-dir"); err != nil {
+		return nil, fmt.Errorf("not a git repository: %v", err)
+	}
+
+	if fromSHA == "" || fromSHA == ZeroSHA {
+		client.FromHash = NullTreeSHA
+	} else {
+		client.FromHash = fromSHA
+	}
+
+	if toSHA == "" {
+		head, err := client.lookUpHEAD(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("lookUpHEAD: %v", err)
+		}
+		client.ToHash = head
+	} else {
+		client.ToHash = toSHA
+	}
+
+	return client, nil
+}
+
+func NewLocalClientFromEnv(ctx context.Context, repoPath, fromSHA, toSHA string) (*localClient, error) {
+	config, err := ReadLocalConfig(repoPath)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := NewLocalClientWithContext(ctx, config, fromSHA, toSHA)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open %s: %s", config.RepoPath, err)
+	}
+
+	return client, nil
+}
+
+func (lc *localClient) Close() {
+	lc.catFileMu.Lock()
+	defer lc.catFileMu.Unlock()
+
+	if lc.catFile != nil {
+		lc.catFile.close()
+		lc.catFile = nil
+	}
+}
+
+// command builds a git command that is killed when ctx is done
+func (lc *localClient) command(ctx context.Context, args ...string) *exec.Cmd {
+	return exec.CommandContext(ctx, "git", append([]string{"-C", lc.repoPath}, args...)...)
+}
+
+func (lc *localClient) run(ctx context.Context, args ...string) ([]byte, error) {
+	var stderr bytes.Buffer
+
+	cmd := lc.command(ctx, args...)
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git %s: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+
+	return out, nil
+}
+
+// HEAD is not always set in some cases, so we fall back to the last commit
+// of a well-known or the first available branch, like Gitaly does
+func (lc *localClient) lookUpHEAD(ctx context.Context) (string, error) {
+	defaultBranchName, err := lc.findDefaultBranchName(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	out, err := lc.run(ctx, "rev-parse", "--verify", defaultBranchName+"^{commit}")
+	if err != nil {
+		return "", fmt.Errorf("Cannot look up HEAD: %v", err)
+	}
+
+	return strings.TrimSpace(string(out)), nil
+}
+
+func (lc *localClient) findDefaultBranchName(ctx context.Context) (string, error) {
+	out, err := lc.run(ctx, "for-each-ref", "--format=%(refname)", "refs/heads/")
+	if err != nil {
+		return "", fmt.Errorf("Cannot find a default branch: %v", err)
+	}
+
+	branches := strings.Fields(string(out))
+	if len(branches) == 0 {
+		return "", errors.New("Cannot find a default branch: no branches")
+	}
+
+	if head, err := lc.run(ctx, "symbolic-ref", "--quiet", "HEAD"); err == nil {
+		headRef := strings.TrimSpace(string(head))
+		for _, branch := range branches {
+			if branch == headRef {
+				return branch, nil
+			}
+		}
+	}
+
+	for _, candidate := range []string{"refs/heads/main", "refs/heads/master"} {
+		for _, branch := range branches {
+			if branch == candidate {
+				return branch, nil
+			}
+		}
+	}
+
+	return branches[0], nil
+}
+
+// rawChanges returns the same changes as Gitaly's GetRawChanges RPC does
+// between FromHash and ToHash
+func (lc *localClient) rawChanges(ctx context.Context) ([]*rawChange, error) {
+	out, err := lc.run(ctx, "diff-tree", "-r", "-z", "--raw", "--no-abbrev", "-M", lc.FromHash, lc.ToHash)
+	if err != nil {
+		return nil, err
+	}
+
+	changes, err := parseRawDiff(out)
+	if err != nil {
+		return nil, err
+	}
+
+	return changes, lc.fillSizes(ctx, changes)
+}
+
+func parseRawDiff(out []byte) ([]*rawChange, error) {
+	var changes []*rawChange
+
+	fields := strings.Split(string(out), "\x00")
+	for i := 0; i < len(fields) && fields[i] != ""; {
+		meta := strings.Fields(strings.TrimPrefix(fields[i], ":"))
+		if len(meta) != 5 {
+			return nil, fmt.Errorf("unexpected diff-tree output: %q", fields[i])
+		}
+
+		oldMode, err := strconv.ParseInt(meta[0], 8, 64)
+		if err != nil {
+			return nil, err
+		}
+		newMode, err := strconv.ParseInt(meta[1], 8, 64)
+		if err != nil {
+			return nil, err
+		}
+
+		change := &rawChange{
+			oldMode:   oldMode,
+			newMode:   newMode,
+			blobID:    meta[3],
+			oldBlobID: meta[2],
+		}
+
+		paths := 1
+		switch meta[4][0] {
+		case 'A':
+			change.operation = "ADDED"
+		case 'C':
+			change.operation = "COPIED"
+			paths = 2
+		case 'D':
+			change.operation = "DELETED"
+		case 'M':
+			change.operation = "MODIFIED"
+		case 'R':
+			change.operation = "RENAMED"
+			paths = 2
+		case 'T':
+			change.operation = "TYPE_CHANGED"
+		default:
+			change.operation = "UNKNOWN"
+		}
+
+		if i+paths >= len(fields) {
+			return nil, fmt.Errorf("truncated diff-tree output after %q", fields[i])
+		}
+
+		change.oldPath = fields[i+1]
+		change.newPath = fields[i+paths]
+		if change.operation == "DELETED" {
+			change.blobID = meta[2]
+		}
+
+		changes = append(changes, change)
+		i += paths + 1
+	}
+
+	return changes, nil
+}
+
+// fillSizes looks up the size of every new blob with a single
+// `git cat-file --batch-check` process
+func (lc *localClient) fillSizes(ctx context.Context, changes []*rawChange) error {
+	var input bytes.Buffer
+	var wanted []*rawChange
+
+	for _, change := range changes {
+		if change.operation == "DELETED" || change.newMode == SubmoduleFileMode {
+			continue
+		}
+
+		input.WriteString(change.blobID + "\n")
+		wanted = append(wanted, change)
+	}
+
+	if len(wanted) == 0 {
+		return nil
+	}
+
+	var stderr bytes.Buffer
+	cmd := lc.command(ctx, "cat-file", "--batch-check=%(objectname) %(objectsize)")
+	cmd.Stdin = &input
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return fmt.Errorf("git cat-file: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	lines := strings.Split(strings.TrimSuffix(string(out), "\n"), "\n")
+	if len(lines) != len(wanted) {
+		return fmt.Errorf("git cat-file: expected %d objects, got %d", len(wanted), len(lines))
+	}
+
+	for i, line := range lines {
+		parts := strings.Fields(line)
+		if len(parts) != 2 {
+			return fmt.Errorf("git cat-file: %s", line)
+		}
+
+		size, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("git cat-file: %s", line)
+		}
+		wanted[i].size = size
+	}
+
+	return nil
+}
+
+func (lc *localClient) EachFileChange(ctx context.Context, put PutFunc, del DelFunc) error {
+	changes, err := lc.rawChanges(ctx)
+	if err != nil {
+		return fmt.Errorf("could not list raw changes: %v", err)
+	}
+
+	for _, change := range changes {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		submodule := isSubmodule(change.oldMode, change.newMode)
+
+		switch change.operation {
+		case "DELETED", "RENAMED":
+			logkit.WithFields(
+				logkit.Fields{
+					"operation": "DELETE",
+					"path":      change.oldPath,
+				},
+			).Debug("Indexing blob change")
+			if err = del(change.oldPath, change.oldBlobID); err != nil {
+				return err
+			}
+		}
+
+		switch change.operation {
+		case "TYPE_CHANGED":
+			// A blob replaced by a submodule or the other way around. Both
+			// share the same document, so it gets overwritten. Other type
+			// changes keep the document, unless documents are per blob.
+			if !submodule && !lc.previousOids {
+				continue
+			}
+			fallthrough
+		case "ADDED", "RENAMED", "MODIFIED", "COPIED":
+			var file *File
+			if change.newMode == SubmoduleFileMode {
+				urls, err := lc.submoduleURLs(ctx)
+				if err != nil {
+					return err
+				}
+				file = buildSubmoduleFile(change.newPath, change.blobID, urls)
+			} else {
+				file = lc.localBuildFile(ctx, change)
+			}
+			if lc.previousOids && (change.operation == "MODIFIED" || change.operation == "TYPE_CHANGED") {
+				file.PreviousOid = change.oldBlobID
+			}
+			logkit.WithFields(
+				logkit.Fields{
+					"operation": "PUT",
+					"path":      file.Path,
+				},
+			).Debug("Indexing blob change")
+			if err = put(file, lc.FromHash, lc.ToHash); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// submoduleURLs reads .gitmodules at ToHash the first time a submodule is
+// found in the changes
+func (lc *localClient) submoduleURLs(ctx context.Context) (map[string]string, error) {
+	if lc.gitmodules != nil {
+		return lc.gitmodules, nil
+	}
+
+	data, err := lc.ReadFile(ctx, gitmodulesPath)
+	if err != nil {
+		return nil, err
+	}
+
+	lc.gitmodules = parseGitmodules(data)
+
+	return lc.gitmodules, nil
+}
+
+func (lc *localClient) ReadFile(ctx context.Context, path string) ([]byte, error) {
+	// Unlike `cat-file -e`, which exits with status 128 either way,
+	// `rev-parse --quiet` only exits with status 1 when there is no such file
+	oid, err := lc.run(ctx, "rev-parse", "--verify", "--quiet", lc.ToHash+":"+path)
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return lc.run(ctx, "cat-file", "blob", strings.TrimSpace(string(oid)))
+}
+
+func (lc *localClient) FindFiles(ctx context.Context, name string) ([]string, error) {
+	out, err := lc.run(ctx, "ls-tree", "-r", "-z", "--name-only", lc.ToHash)
+	if err != nil {
+		return nil, err
+	}
+
+	var paths []string
+	for _, file := range strings.Split(string(out), "\x00") {
+		if file != "" && path.Base(file) == name {
+			paths = append(paths, file)
+		}
+	}
+
+	return paths, nil
+}
+
+func (lc *localClient) ChangedFiles(ctx context.Context, commit *Commit) ([]ChangedFile, error) {
+	out, err := lc.run(ctx, "diff-tree", "-r", "-z", "--raw", "--no-abbrev", "-M", commit.FirstParent(), commit.Hash)
+	if err != nil {
+		return nil, err
+	}
+
+	changes, err := parseRawDiff(out)
+	if err != nil {
+		return nil, err
+	}
+
+	out, err = lc.run(ctx, "diff-tree", "-r", "-z", "--numstat", "-M", commit.FirstParent(), commit.Hash)
+	if err != nil {
+		return nil, err
+	}
+
+	stats, err := parseNumstat(out)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]ChangedFile, 0, len(changes))
+	for _, change := range changes {
+		file := ChangedFile{Path: change.newPath, Operation: changeOperation(change.operation)}
+		if file.Operation == ChangeRenamed {
+			file.OldPath = change.oldPath
+		}
+
+		if stat, ok := stats[file.Path]; ok {
+			file.Additions, file.Deletions = stat[0], stat[1]
+		}
+
+		files = append(files, file)
+	}
+
+	return files, nil
+}
+
+// parseNumstat returns the lines added and deleted by path, which is the new
+// one for renamed files. Binary files have no stats.
+func parseNumstat(out []byte) (map[string][2]int, error) {
+	stats := make(map[string][2]int)
+
+	fields := strings.Split(string(out), "\x00")
+	for i := 0; i < len(fields) && fields[i] != ""; i++ {
+		parts := strings.SplitN(fields[i], "\t", 3)
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("unexpected numstat output: %q", fields[i])
+		}
+
+		path := parts[2]
+		// Renamed files have their old and new paths as the next fields
+		if path == "" {
+			if i+2 >= len(fields) {
+				return nil, fmt.Errorf("truncated numstat output after %q", fields[i])
+			}
+			path = fields[i+2]
+			i += 2
+		}
+
+		if parts[0] == "-" {
+			continue
+		}
+
+		additions, err := strconv.Atoi(parts[0])
+		if err != nil {
+			return nil, err
+		}
+		deletions, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return nil, err
+		}
+
+		stats[path] = [2]int{additions, deletions}
+	}
+
+	return stats, nil
+}
+
+// Diff stops git once maxSize bytes of the patch are read
+func (lc *localClient) Diff(ctx context.Context, commit *Commit, maxSize int64) (string, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	cmd := lc.command(ctx, "diff-tree", "-p", "-M", "--no-color", "--full-index", commit.FirstParent(), commit.Hash)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return "", err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return "", fmt.Errorf("git diff-tree: %v", err)
+	}
+
+	diff, err := io.ReadAll(io.LimitReader(stdout, maxSize))
+	if err != nil {
+		cancel()
+		_ = cmd.Wait()
+		return "", fmt.Errorf("git diff-tree: %v", err)
+	}
+
+	if int64(len(diff)) == maxSize {
+		// The rest of the patch isn't needed, so git is killed
+		cancel()
+		_ = cmd.Wait()
+		return string(diff), nil
+	}
+
+	if err := cmd.Wait(); err != nil {
+		return "", fmt.Errorf("git diff-tree: %v", err)
+	}
+
+	return string(diff), nil
+}
+
+func (lc *localClient) localBuildFile(ctx context.Context, change *rawChange) *File {
+	file := &File{
+		Path: change.newPath,
+		Oid:  change.blobID,
+	}
+
+	// We limit the size to avoid loading too big blobs into memory
+	// as they will be rejected on the indexer side anyway
+	if change.size > lc.limitFileSize {
+		file.Blob = getBlobReader(io.NopCloser(new(bytes.Buffer)))
+		file.SkipTooLarge = true
+	} else {
+		oid := change.blobID
+		file.Blob = func() (io.ReadCloser, error) { return lc.getBlob(ctx, oid) }
+	}
+
+	return file
+}
+
+// getBlob streams a blob from a long-running `git cat-file --batch`
+// process. The process is shared, so it stays locked until the returned
+// reader is closed. It outlives ctx, which is only checked before asking
+// for the blob.
+func (lc *localClient) getBlob(ctx context.Context, oid string) (io.ReadCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	lc.catFileMu.Lock()
+
+	if lc.catFile == nil {
+		process, err := startCatFile(lc.command(context.Background(), "cat-file", "--batch"))
+		if err != nil {
+			lc.catFileMu.Unlock()
+			return nil, fmt.Errorf("Cannot get blob: %s: %v", oid, err)
+		}
+		lc.catFile = process
+	}
+
+	process := lc.catFile
+	release := func(err error) {
+		// The process is in an unknown state, so start a new one next time
+		if err != nil {
+			process.kill()
+			lc.catFile = nil
+		}
+		lc.catFileMu.Unlock()
+	}
+
+	reader, err := process.blob(oid, release)
+	if err != nil {
+		release(err)
+		return nil, fmt.Errorf("Cannot get blob: %s: %v", oid, err)
+	}
+
+	return reader, nil
+}
+
+func (lc *localClient) EachCommit(ctx context.Context, f CommitFunc) error {
+	args := []string{"log", "-z", "--reverse", "--format=" + commitFormat, lc.ToHash}
+	// The null tree is not a commit, so there is nothing to exclude
+	if lc.FromHash != NullTreeSHA {
+		args = append(args, "^"+lc.FromHash)
+	}
+
+	out, err := lc.run(ctx, append(args, "--")...)
+	if err != nil {
+		return fmt.Errorf("could not list commits: %v", err)
+	}
+
+	fields := strings.Split(string(out), "\x00")
+	for i := 0; i+commitFormatFields <= len(fields); i += commitFormatFields {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		commit, err := localBuildCommit(fields[i : i+commitFormatFields])
+		if err != nil {
+			return err
+		}
+
+		logkit.WithField("commitID", commit.Hash).Debug("Indexing commit")
+
+		if err := f(commit); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func localBuildCommit(fields []string) (*Commit, error) {
+	authorDate, err := strconv.ParseInt(fields[3], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("commit %s: bad author date: %v", fields[0], err)
+	}
+
+	committerDate, err := strconv.ParseInt(fields[6], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("commit %s: bad committer date: %v", fields[0], err)
+	}
+
+	return &Commit{
+		Hash:      fields[0],
+		Author:    Signature{Name: fields[1], Email: fields[2], When: time.Unix(authorDate, 0)},
+		Committer: Signature{Name: fields[4], Email: fields[5], When: time.Unix(committerDate, 0)},
+		Parents:   strings.Fields(fields[7]),
+		Message:   fields[8],
+	}, nil
+}
+
+func (lc *localClient) GetLimitFileSize() int64 {
+	return lc.limitFileSize
+}
+
+func (lc *localClient) ListRefs(ctx context.Context, patterns []string) ([]Ref, error) {
+	args := append([]string{"for-each-ref", "--format=%(objectname) %(refname)"}, patterns...)
+
+	out, err := lc.run(ctx, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	var refs []Ref
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		if line == "" {
+			continue
+		}
+
+		parts := strings.SplitN(line, " ", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("unexpected for-each-ref output: %q", line)
+		}
+
+		refs = append(refs, Ref{Name: parts[1], Target: parts[0]})
+	}
+
+	return refs, nil
+}
+
+func (lc *localClient) TrackPreviousOids() {
+	lc.previousOids = true
+}
+
+func (lc *localClient) SetRange(fromSHA, toSHA string) {
+	if fromSHA == "" || fromSHA == ZeroSHA {
+		lc.FromHash = NullTreeSHA
+	} else {
+		lc.FromHash = fromSHA
+	}
+
+	lc.ToHash = toSHA
+	lc.gitmodules = nil
+	lc.previousOids = true
+}
+
+func (lc *localClient) GetFromHash() string {
+	return lc.FromHash
+}
+
+func (lc *localClient) GetToHash() string {
+	return lc.ToHash
+}
+
+type catFileProcess struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Reader
+}
+
+func startCatFile(cmd *exec.Cmd) (*catFileProcess, error) {
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	return &catFileProcess{cmd: cmd, stdin: stdin, stdout: bufio.NewReader(stdout)}, nil
+}
+
+// blob asks for the blob oid. The returned reader calls release once closed,
+// with the error that left the process out of sync with the blobs asked for,
+// if any.
+func (p *catFileProcess) blob(oid string, release func(error)) (io.ReadCloser, error) {
+	if _, err := fmt.Fprintln(p.stdin, oid); err != nil {
+		return nil, err
+	}
+
+	header, err := p.stdout.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	// <oid> <type> <size>, or <oid> missing
+	parts := strings.Fields(header)
+	if len(parts) != 3 || parts[1] != "blob" {
+		return nil, fmt.Errorf("unexpected object: %s", strings.TrimSpace(header))
+	}
+
+	size, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	// The whole blob is read from the process, even when it's closed early
+	metrics.BlobBytesTotal.Add(float64(size))
+
+	return &catFileBlob{
+		Reader:  io.LimitReader(p.stdout, size),
+		process: p,
+		release: release,
+	}, nil
+}
+
+func (p *catFileProcess) close() {
+	p.stdin.Close()
+	_ = p.cmd.Wait()
+}
+
+// kill stops a process that may be blocked writing output nobody reads
+func (p *catFileProcess) kill() {
+	_ = p.cmd.Process.Kill()
+	p.close()
+}
+
+type catFileBlob struct {
+	io.Reader
+	process *catFileProcess
+	release func(error)
+	closed  bool
+}
+
+// Close skips whatever is left of the blob, including the trailing newline
+// `git cat-file --batch` prints, so the process is ready for the next one
+func (b *catFileBlob) Close() (err error) {
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+	defer func() { b.release(err) }()
+
+	if _, err := io.Copy(io.Discard, b.Reader); err != nil {
+		return err
+	}
+
+	_, err = b.process.stdout.Discard(1)
+	return err
+}
@@ -0,0 +1,34 @@
+package git
+
+import (
+	"context"
+	"io"
+	"os/exec"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLocalRestartsCatFileOutOfSync(t *testing.T) {
+	// The process announces more of the blob than it prints
+	process, err := startCatFile(exec.Command("sh", "-c", `read oid; printf "$oid blob 10\nabc"`))
+	require.NoError(t, err)
+
+	lc := &localClient{catFile: process}
+	defer lc.Close()
+
+	reader, err := lc.getBlob(context.Background(), "1234567")
+	require.NoError(t, err)
+
+	data := make([]byte, 3)
+	_, err = io.ReadFull(reader, data)
+	require.NoError(t, err)
+	require.Equal(t, "abc", string(data))
+
+	// Skipping the rest of the blob fails, so the process is stopped
+	require.Error(t, reader.Close())
+
+	lc.catFileMu.Lock()
+	defer lc.catFileMu.Unlock()
+	require.Nil(t, lc.catFile)
+}
@@ -0,0 +1,453 @@
+package git_test
+
+import (
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-elasticsearch-indexer/git"
+)
+
+type localTestRepository struct {
+	t    *testing.T
+	path string
+}
+
+func newLocalTestRepository(t *testing.T) *localTestRepository {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git executable not found")
+	}
+
+	repo := &localTestRepository{t: t, path: t.TempDir()}
+	repo.git("init", "--quiet", "--initial-branch=master")
+
+	return repo
+}
+
+func (r *localTestRepository) git(args ...string) string {
+	cmd := exec.Command("git", append([]string{"-C", r.path}, args...)...)
+	cmd.Env = append(os.Environ(),
+		"GIT_AUTHOR_NAME=Job van der Voort",
+		"GIT_AUTHOR_EMAIL=job@gitlab.com",
+		"GIT_AUTHOR_DATE=2016-09-27T14:37:46+00:00",
+		"GIT_COMMITTER_NAME=Nick Thomas",
+		"GIT_COMMITTER_EMAIL=nick@gitlab.com",
+		"GIT_COMMITTER_DATE=2017-10-28T15:38:47+00:00",
+	)
+
+	out, err := cmd.CombinedOutput()
+	require.NoError(r.t, err, string(out))
+
+	return strings.TrimSpace(string(out))
+}
+
+func (r *localTestRepository) write(path, content string) {
+	fullPath := filepath.Join(r.path, path)
+	require.NoError(r.t, os.MkdirAll(filepath.Dir(fullPath), 0755))
+	require.NoError(r.t, os.WriteFile(fullPath, []byte(content), 0644))
+	r.git("add", path)
+}
+
+func (r *localTestRepository) commit(message string) string {
+	r.git("commit", "--quiet", "--allow-empty", "-m", message)
+
+	return r.git("rev-parse", "HEAD")
+}
+
+func (r *localTestRepository) open(fromSHA, toSHA string) git.Repository {
+	repo, err := git.NewLocalClient(&git.LocalConfig{RepoPath: r.path, LimitFileSize: 1024}, fromSHA, toSHA)
+	require.NoError(r.t, err)
+
+	return repo
+}
+
+func readBlob(t *testing.T, file *git.File) string {
+	blob, err := file.Blob()
+	require.NoError(t, err)
+	defer blob.Close()
+
+	data, err := io.ReadAll(blob)
+	require.NoError(t, err)
+
+	return string(data)
+}
+
+func TestLocalEachFileChangeAllModifications(t *testing.T) {
+	r := newLocalTestRepository(t)
+	r.write("README.md", "testme\n")
+	r.write("foo/bar.rb", "puts 'bar'\n")
+	r.write("with space/file.txt", "spaces\n")
+	r.write("large.txt", strings.Repeat("a", 2048))
+	head := r.commit("Initial commit")
+
+	putFiles, delFiles, filePaths, err := runEachFileChange(r.open("", head))
+	require.NoError(t, err)
+	require.Empty(t, delFiles)
+
+	sort.Strings(filePaths)
+	require.Equal(t, []string{"README.md", "foo/bar.rb", "large.txt", "with space/file.txt"}, filePaths)
+
+	require.Equal(t, "testme\n", readBlob(t, putFiles["README.md"]))
+	require.Equal(t, "puts 'bar'\n", readBlob(t, putFiles["foo/bar.rb"]))
+	require.Equal(t, r.git("rev-parse", head+":README.md"), putFiles["README.md"].Oid)
+
+	// Blobs can be read again, in any order
+	require.Equal(t, "spaces\n", readBlob(t, putFiles["with space/file.txt"]))
+	require.Equal(t, "testme\n", readBlob(t, putFiles["README.md"]))
+
+	require.True(t, putFiles["large.txt"].SkipTooLarge)
+	require.Equal(t, "", readBlob(t, putFiles["large.txt"]))
+}
+
+func TestLocalEachFileChangeWithRenameAndDelete(t *testing.T) {
+	r := newLocalTestRepository(t)
+	r.write("files/js/commit.js.coffee", "class Commit\n  constructor: ->\n    @foo = 'bar'\n")
+	r.write("files/empty", "")
+	r.write("VERSION", "6.7.0.pre\n")
+	from := r.commit("Initial commit")
+
+	r.git("mv", "files/js/commit.js.coffee", "files/js/commit.coffee")
+	r.git("rm", "--quiet", "files/empty")
+	r.write("VERSION", "6.7.1\n")
+	to := r.commit("Rename, remove and modify")
+
+	putFiles, delFiles, _, err := runEachFileChange(r.open(from, to))
+	require.NoError(t, err)
+
+	sort.Strings(delFiles)
+	require.Equal(t, []string{"files/empty", "files/js/commit.js.coffee"}, delFiles)
+	require.Len(t, putFiles, 2)
+	require.Contains(t, putFiles, "files/js/commit.coffee")
+	require.Equal(t, "6.7.1\n", readBlob(t, putFiles["VERSION"]))
+}
+
+func TestLocalEachFileChangeWithSubmodules(t *testing.T) {
+	r := newLocalTestRepository(t)
+	r.write("README.md", "testme\n")
+	r.write(".gitmodules", "[submodule \"six\"]\n\tpath = six\n\turl = git://github.com/randx/six.git\n")
+	r.git("update-index", "--add", "--cacheinfo", "160000,409f37c4f05865e4fb208c771485f211a22c4c2d,six")
+	from := r.commit("Initial commit")
+
+	putFiles, _, filePaths, err := runEachFileChange(r.open("", from))
+	require.NoError(t, err)
+
+	sort.Strings(filePaths)
+	require.Equal(t, []string{".gitmodules", "README.md", "six"}, filePaths)
+
+	six := putFiles["six"]
+	require.True(t, six.IsSubmodule)
+	require.Equal(t, "409f37c4f05865e4fb208c771485f211a22c4c2d", six.Oid)
+	require.Equal(t, "git://github.com/randx/six.git", six.SubmoduleURL)
+	require.Equal(t, "", readBlob(t, six))
+	require.False(t, putFiles["README.md"].IsSubmodule)
+
+	// Bump the pinned commit
+	r.git("update-index", "--cacheinfo", "160000,1a0b36b3cdad1d2ee32457c102a8c0b7056fa863,six")
+	bumped := r.commit("Bump six")
+
+	putFiles, delFiles, _, err := runEachFileChange(r.open(from, bumped))
+	require.NoError(t, err)
+	require.Empty(t, delFiles)
+	require.Len(t, putFiles, 1)
+	require.Equal(t, "1a0b36b3cdad1d2ee32457c102a8c0b7056fa863", putFiles["six"].Oid)
+
+	// Replace it with a regular file
+	r.git("rm", "--quiet", "--cached", "six")
+	r.write("six", "not a submodule anymore\n")
+	replaced := r.commit("Replace six")
+
+	putFiles, _, _, err = runEachFileChange(r.open(bumped, replaced))
+	require.NoError(t, err)
+	require.False(t, putFiles["six"].IsSubmodule)
+	require.Equal(t, "not a submodule anymore\n", readBlob(t, putFiles["six"]))
+
+	// And remove it
+	r.git("rm", "--quiet", "six")
+	removed := r.commit("Remove six")
+
+	putFiles, delFiles, _, err = runEachFileChange(r.open(replaced, removed))
+	require.NoError(t, err)
+	require.Empty(t, putFiles)
+	require.Equal(t, []string{"six"}, delFiles)
+}
+
+func TestLocalEachCommit(t *testing.T) {
+	r := newLocalTestRepository(t)
+	r.write("README.md", "testme\n")
+	first := r.commit("Initial commit\n")
+	second := r.commit("Second commit")
+	third := r.commit("Third commit")
+
+	_, commitHashes, err := runEachCommit(r.open("", third))
+	require.NoError(t, err)
+	require.Equal(t, []string{first, second, third}, commitHashes)
+
+	commits, commitHashes, err := runEachCommit(r.open(first, third))
+	require.NoError(t, err)
+	require.Equal(t, []string{second, third}, commitHashes)
+
+	commit := commits[second]
+	require.Equal(t, "Second commit\n", commit.Message)
+	require.Equal(t, "Job van der Voort", commit.Author.Name)
+	require.Equal(t, "job@gitlab.com", commit.Author.Email)
+	require.Equal(t, int64(1474987066), commit.Author.When.Unix())
+	require.Equal(t, "Nick Thomas", commit.Committer.Name)
+	require.Equal(t, "nick@gitlab.com", commit.Committer.Email)
+	require.Equal(t, int64(1509205127), commit.Committer.When.Unix())
+
+	_, commitHashes, err = runEachCommit(r.open(third, third))
+	require.NoError(t, err)
+	require.Equal(t, []string{}, commitHashes)
+}
+
+func TestLocalEmptyToSHADefaultsToHeadSHA(t *testing.T) {
+	r := newLocalTestRepository(t)
+	r.write("README.md", "testme\n")
+	first := r.commit("Initial commit")
+	head := r.commit("Second commit")
+
+	repo := r.open(first, "")
+	require.Equal(t, head, repo.GetToHash())
+	require.Equal(t, first, repo.GetFromHash())
+
+	repo = r.open(git.ZeroSHA, "")
+	require.Equal(t, git.NullTreeSHA, repo.GetFromHash())
+}
+
+func TestLocalClientRejectsMissingRepository(t *testing.T) {
+	_, err := git.NewLocalClient(&git.LocalConfig{RepoPath: filepath.Join(t.TempDir(), "missing")}, "", "")
+	require.Error(t, err)
+}
+
+func TestLocalClientStopsOpeningWhenCanceled(t *testing.T) {
+	r := newLocalTestRepository(t)
+	r.write("README.md", "testme\n")
+	r.commit("Initial commit")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := git.NewLocalClientWithContext(ctx, &git.LocalConfig{RepoPath: r.path}, "", "")
+	require.Error(t, err)
+}
+
+func TestReadLocalConfig(t *testing.T) {
+	t.Setenv("GITALY_CONNECTION_INFO", "")
+
+	config, err := git.ReadLocalConfig("/tmp/repo.git")
+	require.NoError(t, err)
+	require.Equal(t, &git.LocalConfig{RepoPath: "/tmp/repo.git", LimitFileSize: 1024 * 1024}, config)
+
+	// The limit is the one Gitaly would apply
+	t.Setenv("GITALY_CONNECTION_INFO", `{"address": "tcp://localhost:8075", "storage": "default", "limit_file_size": 2048}`)
+
+	config, err = git.ReadLocalConfig("/tmp/repo.git")
+	require.NoError(t, err)
+	require.Equal(t, &git.LocalConfig{RepoPath: "/tmp/repo.git", LimitFileSize: 2048}, config)
+
+	t.Setenv("GITALY_CONNECTION_INFO", "not json")
+
+	_, err = git.ReadLocalConfig("/tmp/repo.git")
+	require.Error(t, err)
+}
+
+func TestLocalEachFileChangeStopsWhenCanceled(t *testing.T) {
+	r := newLocalTestRepository(t)
+	r.write("README.md", "testme\n")
+	head := r.commit("Initial commit")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	put := func(*git.File, string, string) error { return nil }
+	del := func(string, string) error { return nil }
+
+	require.Error(t, r.open("", head).EachFileChange(ctx, put, del))
+}
+
+func TestLocalListRefs(t *testing.T) {
+	r := newLocalTestRepository(t)
+	r.write("README.md", "testme\n")
+	head := r.commit("Initial commit")
+
+	r.git("branch", "release-1")
+	r.git("branch", "feature")
+	r.git("tag", "v1.0.0")
+
+	refs, err := r.open("", head).(git.RefRepository).ListRefs(context.Background(), []string{"refs/heads/release-*", "refs/heads/master", "refs/tags/"})
+	require.NoError(t, err)
+
+	require.Equal(t, []git.Ref{
+		{Name: "refs/heads/master", Target: head},
+		{Name: "refs/heads/release-1", Target: head},
+		{Name: "refs/tags/v1.0.0", Target: head},
+	}, refs)
+}
+
+func TestLocalSetRangeSetsPreviousOids(t *testing.T) {
+	r := newLocalTestRepository(t)
+	r.write("README.md", "testme\n")
+	r.write("VERSION", "6.7.0\n")
+	r.write("files/empty", "")
+	from := r.commit("Initial commit")
+
+	r.write("VERSION", "6.7.1\n")
+	r.git("mv", "README.md", "README.txt")
+	r.git("rm", "--quiet", "files/empty")
+	to := r.commit("Modify, rename and remove")
+
+	repo := r.open("", from).(git.RefRepository)
+
+	// Files replace nothing until a range is set
+	putFiles, _, _, err := runEachFileChange(r.open(from, to))
+	require.NoError(t, err)
+	require.Empty(t, putFiles["VERSION"].PreviousOid)
+
+	repo.SetRange(from, to)
+	require.Equal(t, from, repo.GetFromHash())
+	require.Equal(t, to, repo.GetToHash())
+
+	deleted := make(map[string]string)
+	putFiles = make(map[string]*git.File)
+	err = repo.EachFileChange(context.Background(), func(f *git.File, _, _ string) error {
+		putFiles[f.Path] = f
+		return nil
+	}, func(path, oid string) error {
+		deleted[path] = oid
+		return nil
+	})
+	require.NoError(t, err)
+
+	require.Equal(t, r.git("rev-parse", from+":VERSION"), putFiles["VERSION"].PreviousOid)
+	require.Empty(t, putFiles["README.txt"].PreviousOid)
+	require.Equal(t, map[string]string{
+		"README.md":   r.git("rev-parse", from+":README.md"),
+		"files/empty": r.git("rev-parse", from+":files/empty"),
+	}, deleted)
+
+	repo.SetRange("", to)
+	require.Equal(t, git.NullTreeSHA, repo.GetFromHash())
+}
+
+func TestLocalTrackPreviousOids(t *testing.T) {
+	r := newLocalTestRepository(t)
+	r.write("VERSION", "6.7.0\n")
+	from := r.commit("Initial commit")
+
+	r.write("VERSION", "6.7.1\n")
+	r.write("README.md", "testme\n")
+	to := r.commit("Modify and add")
+
+	repo := r.open(from, to)
+	repo.(git.PreviousOidTracker).TrackPreviousOids()
+
+	putFiles, _, _, err := runEachFileChange(repo)
+	require.NoError(t, err)
+	require.Equal(t, r.git("rev-parse", from+":VERSION"), putFiles["VERSION"].PreviousOid)
+	require.Empty(t, putFiles["README.md"].PreviousOid)
+}
+
+func TestLocalReadFile(t *testing.T) {
+	r := newLocalTestRepository(t)
+	r.write(".gitattributes", "*.min.js linguist-generated\n")
+	from := r.commit("Initial commit")
+
+	r.write(".gitattributes", "vendor/** linguist-vendored\n")
+	to := r.commit("Update attributes")
+
+	repo := r.open(from, to).(git.FileReader)
+
+	data, err := repo.ReadFile(context.Background(), ".gitattributes")
+	require.NoError(t, err)
+	require.Equal(t, "vendor/** linguist-vendored\n", string(data))
+
+	data, err = repo.ReadFile(context.Background(), ".gitlab-search-ignore")
+	require.NoError(t, err)
+	require.Nil(t, data)
+
+	// Other errors aren't taken for a missing file
+	require.NoError(t, os.RemoveAll(r.path))
+	_, err = repo.ReadFile(context.Background(), ".gitattributes")
+	require.Error(t, err)
+}
+
+func TestLocalFindFiles(t *testing.T) {
+	r := newLocalTestRepository(t)
+	r.write(".gitattributes", "*.tmpl linguist-language=Go\n")
+	r.write("lib/.gitattributes", "*.tmpl linguist-language=Ruby\n")
+	r.write("lib/gitattributes", "not an attributes file\n")
+	head := r.commit("Initial commit")
+
+	paths, err := r.open("", head).(git.FileReader).FindFiles(context.Background(), ".gitattributes")
+	require.NoError(t, err)
+	require.Equal(t, []string{".gitattributes", "lib/.gitattributes"}, paths)
+}
+
+func TestLocalChangedFiles(t *testing.T) {
+	r := newLocalTestRepository(t)
+	r.write("files/js/commit.js.coffee", "class Commit\n  constructor: ->\n    @foo = 'bar'\n")
+	r.write("files/empty", "")
+	r.write("VERSION", "6.7.0.pre\n")
+	r.commit("Initial commit")
+
+	r.git("mv", "files/js/commit.js.coffee", "files/js/commit.coffee")
+	r.git("rm", "--quiet", "files/empty")
+	r.write("VERSION", "6.7.1\nstable\n")
+	r.write("image.png", "\x89PNG\x00\x00")
+	to := r.commit("Rename, remove, modify and add")
+
+	commits, _, err := runEachCommit(r.open("", to))
+	require.NoError(t, err)
+
+	repo := r.open("", to).(git.DiffReader)
+
+	files, err := repo.ChangedFiles(context.Background(), commits[to])
+	require.NoError(t, err)
+	require.ElementsMatch(t, []git.ChangedFile{
+		{Path: "VERSION", Operation: git.ChangeModified, Additions: 2, Deletions: 1},
+		{Path: "files/empty", Operation: git.ChangeDeleted},
+		{Path: "files/js/commit.coffee", OldPath: "files/js/commit.js.coffee", Operation: git.ChangeRenamed},
+		{Path: "image.png", Operation: git.ChangeAdded},
+	}, files)
+
+	// Root commits are compared to the null tree
+	root := commits[commits[to].Parents[0]]
+	require.Empty(t, root.Parents)
+
+	files, err = repo.ChangedFiles(context.Background(), root)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []git.ChangedFile{
+		{Path: "VERSION", Operation: git.ChangeAdded, Additions: 1},
+		{Path: "files/empty", Operation: git.ChangeAdded},
+		{Path: "files/js/commit.js.coffee", Operation: git.ChangeAdded, Additions: 3},
+	}, files)
+}
+
+func TestLocalDiff(t *testing.T) {
+	r := newLocalTestRepository(t)
+	r.write("VERSION", "6.7.0.pre\n")
+	r.commit("Initial commit")
+	r.write("VERSION", "6.7.1\n")
+	to := r.commit("Bump version")
+
+	commits, _, err := runEachCommit(r.open("", to))
+	require.NoError(t, err)
+
+	repo := r.open("", to).(git.DiffReader)
+
+	diff, err := repo.Diff(context.Background(), commits[to], 1024)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(diff, "diff --git a/VERSION b/VERSION\n"), diff)
+	require.Contains(t, diff, "-6.7.0.pre\n+6.7.1\n")
+
+	cut, err := repo.Diff(context.Background(), commits[to], 10)
+	require.NoError(t, err)
+	require.Equal(t, diff[:10], cut)
+}
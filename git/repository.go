@@ -1,6 +1,7 @@
 package git
 
 import (
+	"context"
 	"io"
 	"time"
 )
@@ -10,6 +11,15 @@ type File struct {
 	Blob         func() (io.ReadCloser, error)
 	Oid          string
 	SkipTooLarge bool
+
+	// Submodules are passed as files with the pinned commit SHA as Oid and
+	// the URL from .gitmodules at ToHash, when there is one
+	IsSubmodule  bool
+	SubmoduleURL string
+
+	// PreviousOid is the blob or submodule commit the file replaces at
+	// Path, if any. It's only set once a range is set with SetRange.
+	PreviousOid string
 }
 
 type Signature struct {
@@ -23,14 +33,132 @@ type Commit struct {
 	Committer Signature
 	Message   string
 	Hash      string
+	Parents   []string
+}
+
+// FirstParent returns the commit the changes of c are relative to, which is
+// the null tree for root commits
+func (c *Commit) FirstParent() string {
+	if len(c.Parents) == 0 {
+		return NullTreeSHA
+	}
+
+	return c.Parents[0]
+}
+
+// Operations of ChangedFile
+const (
+	ChangeAdded    = "added"
+	ChangeModified = "modified"
+	ChangeDeleted  = "deleted"
+	ChangeRenamed  = "renamed"
+)
+
+// ChangedFile is a file changed by a commit, with the number of lines added
+// and deleted. Both are zero for binary files.
+type ChangedFile struct {
+	Path      string
+	Operation string
+	Additions int
+	Deletions int
+
+	// OldPath is only set for renamed files
+	OldPath string
+}
+
+// changeOperation maps the operations of GetRawChanges, which copies are
+// additions to and type changes modifications for
+func changeOperation(operation string) string {
+	switch operation {
+	case "ADDED", "COPIED":
+		return ChangeAdded
+	case "DELETED":
+		return ChangeDeleted
+	case "RENAMED":
+		return ChangeRenamed
+	}
+
+	return ChangeModified
 }
 
+// Repository lists the changes between two commits. EachFileChange and
+// EachCommit stop and return the context's error once it is done.
 type Repository interface {
-	EachFileChange(put PutFunc, del DelFunc) error
-	EachCommit(f CommitFunc) error
+	EachFileChange(ctx context.Context, put PutFunc, del DelFunc) error
+	EachCommit(ctx context.Context, f CommitFunc) error
 	GetLimitFileSize() int64
+	GetFromHash() string
+	GetToHash() string
+}
+
+// Ref is a branch or a tag, and the commit or annotated tag it points to
+type Ref struct {
+	Name   string
+	Target string
+}
+
+// RefRepository is a Repository whose refs can be indexed one after the
+// other
+type RefRepository interface {
+	Repository
+
+	// ListRefs returns the refs matching any of the patterns, which are
+	// git-for-each-ref(1) patterns such as 'refs/heads/release-*'
+	ListRefs(ctx context.Context, patterns []string) ([]Ref, error)
+
+	// SetRange makes the repository list the changes and commits between
+	// fromSHA and toSHA, an empty fromSHA meaning from scratch. Files then
+	// tell the blob they replace in PreviousOid.
+	SetRange(fromSHA, toSHA string)
+}
+
+// FileReader is a Repository able to read the files at ToHash, such as the
+// rules the repository sets for its own indexing
+type FileReader interface {
+	// ReadFile returns the content of the file at path, or nil if there is
+	// no such file
+	ReadFile(ctx context.Context, path string) ([]byte, error)
+
+	// FindFiles returns the paths of the files named name, in any directory
+	FindFiles(ctx context.Context, name string) ([]string, error)
+}
+
+// DiffReader is a Repository able to tell what commits change, compared to
+// their first parent
+type DiffReader interface {
+	// ChangedFiles returns the files changed by commit
+	ChangedFiles(ctx context.Context, commit *Commit) ([]ChangedFile, error)
+
+	// Diff returns the patch of commit, cut after maxSize bytes
+	Diff(ctx context.Context, commit *Commit, maxSize int64) (string, error)
+}
+
+// PrefetchFilter tells whether to fetch the blob of the file at path ahead of
+// its call to PutFunc, given the number of calls to PutFunc and DelFunc before
+// that one. Blobs that aren't fetched ahead are still read when asked for.
+type PrefetchFilter func(path, oid string, calls int64) bool
+
+// PreviousOidTracker is a Repository able to tell the blob files replace in
+// PreviousOid without a range set by SetRange, at the cost of looking up the
+// blobs at FromHash
+type PreviousOidTracker interface {
+	// TrackPreviousOids makes EachFileChange set File.PreviousOid
+	TrackPreviousOids()
+}
+
+// BlobPrefetcher is a Repository fetching the blobs of several changes at
+// once, before their calls to PutFunc
+type BlobPrefetcher interface {
+	// SetPrefetchFilter makes EachFileChange fetch ahead only the blobs
+	// filter returns true for, or all of them if filter is nil
+	SetPrefetchFilter(filter PrefetchFilter)
 }
 
 type PutFunc func(file *File, fromCommit, toCommit string) error
-type DelFunc func(path string) error
+
+// DelFunc receives the path of a deleted file and the blob or submodule
+// commit it was. For renamed files, the latter is only known once a range is
+// set with SetRange.
+type DelFunc func(path, oid string) error
+
 type CommitFunc func(commit *Commit) error
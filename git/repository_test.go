@@ -102,7 +102,7 @@ func runEachCommit(repo git.Repository) (map[string]*git.Commit, []string, error
 	commits := make(map[string]*git.Commit)
 	commitHashes := []string{}
 
-	err := repo.EachCommit(func(commit *git.Commit) error {
+	err := repo.EachCommit(context.Background(), func(commit *git.Commit) error {
 		commits[commit.Hash] = commit
 		commitHashes = append(commitHashes, commit.Hash)
 		return nil
@@ -115,7 +115,7 @@ func setupTestRepository(t *testing.T, fromSha, toSha string) git.Repository {
 	checkDeps(t)
 	require.NoError(t, ensureGitalyRepository(t))
 
-	repo, err := git.NewGitalyClientFromEnv(testRepo, fromSha, toSha, "the-correlation-id", projectID, testProjectPath)
+	repo, err := git.NewGitalyClientFromEnv(context.Background(), testRepo, fromSha, toSha, "the-correlation-id", projectID, testProjectPath)
 	require.NoError(t, err)
 
 	return repo
@@ -250,13 +250,13 @@ func runEachFileChange(repo git.Repository) (map[string]*git.File, []string, []s
 		return nil
 	}
 
-	delStore := func(f string) error {
+	delStore := func(f, _ string) error {
 		delFiles = append(delFiles, f)
 		filePaths = append(filePaths, f)
 		return nil
 	}
 
-	err := repo.EachFileChange(putStore, delStore)
+	err := repo.EachFileChange(context.Background(), putStore, delStore)
 	return putFiles, delFiles, filePaths, err
 }
 
@@ -304,6 +304,8 @@ func TestEachFileChangeAllModifications(t *testing.T) {
 		"files/ruby/version_info.rb",
 		"files/whitespace",
 		"foo/bar/.gitkeep",
+		"gitlab-grack",
+		"six",
 		"with space/README.md",
 	}
 
@@ -323,6 +325,12 @@ func TestEachFileChangeAllModifications(t *testing.T) {
 	require.Equal(t, "VERSION", file.Path)
 	require.Equal(t, "998707b421c89bd9a3063333f9f728ef3e43d101", file.Oid)
 	require.Equal(t, "6.7.0.pre\n", string(data))
+
+	// Submodules are passed along with their pinned commit and URL
+	submodule := putFiles["six"]
+	require.True(t, submodule.IsSubmodule)
+	require.Equal(t, "409f37c4f05865e4fb208c771485f211a22c4c2d", submodule.Oid)
+	require.Equal(t, "git://github.com/randx/six.git", submodule.SubmoduleURL)
 }
 
 func TestEachFileChangeGivenRangeOfThreeCommits(t *testing.T) {
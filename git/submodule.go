@@ -0,0 +1,94 @@
+package git
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strings"
+)
+
+const gitmodulesPath = ".gitmodules"
+
+// isSubmodule tells whether either side of a change is a submodule
+func isSubmodule(oldMode, newMode int64) bool {
+	return oldMode == SubmoduleFileMode || newMode == SubmoduleFileMode
+}
+
+func buildSubmoduleFile(path, commitSHA string, urls map[string]string) *File {
+	return &File{
+		Path:         path,
+		Oid:          commitSHA,
+		Blob:         getBlobReader(io.NopCloser(new(bytes.Buffer))),
+		IsSubmodule:  true,
+		SubmoduleURL: urls[path],
+	}
+}
+
+// parseGitmodules returns the URL of every submodule in a .gitmodules file,
+// keyed by the submodule path
+func parseGitmodules(data []byte) map[string]string {
+	type submodule struct{ path, url string }
+
+	var submodules []*submodule
+	var current *submodule
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+
+		if line[0] == '[' {
+			current = nil
+			if strings.HasPrefix(line, "[submodule") {
+				current = &submodule{}
+				submodules = append(submodules, current)
+			}
+			continue
+		}
+
+		if current == nil {
+			continue
+		}
+
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		switch strings.ToLower(strings.TrimSpace(parts[0])) {
+		case "path":
+			current.path = unquoteGitConfigValue(parts[1])
+		case "url":
+			current.url = unquoteGitConfigValue(parts[1])
+		}
+	}
+
+	urls := make(map[string]string)
+	for _, s := range submodules {
+		if s.path != "" {
+			urls[s.path] = s.url
+		}
+	}
+
+	return urls
+}
+
+func unquoteGitConfigValue(value string) string {
+	value = strings.TrimSpace(value)
+
+	// Drop trailing comments outside of quotes
+	inQuotes := false
+	for i, r := range value {
+		switch {
+		case r == '"':
+			inQuotes = !inQuotes
+		case (r == '#' || r == ';') && !inQuotes:
+			value = strings.TrimSpace(value[:i])
+			return strings.ReplaceAll(value, `"`, "")
+		}
+	}
+
+	return strings.ReplaceAll(value, `"`, "")
+}
@@ -0,0 +1,34 @@
+package git
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseGitmodules(t *testing.T) {
+	gitmodules := `
+[submodule "six"]
+	path = six
+	url = git://github.com/randx/six.git
+; a comment
+[submodule "gitlab-grack"]
+	path = gitlab-grack
+	url = "https://gitlab.com/gitlab-org/gitlab-grack.git" # trailing comment
+[core]
+	path = not-a-submodule
+[submodule "no-path"]
+	url = https://example.com/no-path.git
+`
+
+	require.Equal(
+		t,
+		map[string]string{
+			"six":          "git://github.com/randx/six.git",
+			"gitlab-grack": "https://gitlab.com/gitlab-org/gitlab-grack.git",
+		},
+		parseGitmodules([]byte(gitmodules)),
+	)
+
+	require.Empty(t, parseGitmodules(nil))
+}
@@ -0,0 +1,28 @@
+package git
+
+import (
+	"context"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+)
+
+// startSpan starts a span for a Gitaly call, tagged with the project and the
+// commits being indexed. The span is propagated to Gitaly by the tracing
+// interceptors of the connection.
+func (gc *gitalyClient) startSpan(ctx context.Context, operationName string) (opentracing.Span, context.Context) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, operationName)
+	span.SetTag("project_id", gc.repository.GlRepository)
+	span.SetTag("from_sha", gc.FromHash)
+	span.SetTag("to_sha", gc.ToHash)
+
+	return span, ctx
+}
+
+func finishSpan(span opentracing.Span, err error) {
+	if err != nil {
+		ext.LogError(span, err)
+	}
+
+	span.Finish()
+}
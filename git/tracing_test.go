@@ -0,0 +1,58 @@
+package git
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+	"github.com/stretchr/testify/require"
+	pb "gitlab.com/gitlab-org/gitaly/v14/proto/go/gitalypb"
+)
+
+func setupMockTracer(t *testing.T) *mocktracer.MockTracer {
+	tracer := mocktracer.New()
+	previous := opentracing.GlobalTracer()
+	opentracing.SetGlobalTracer(tracer)
+	t.Cleanup(func() { opentracing.SetGlobalTracer(previous) })
+
+	return tracer
+}
+
+func TestGitalySpansAreTaggedAndNested(t *testing.T) {
+	tracer := setupMockTracer(t)
+
+	client := &gitalyClient{
+		repository: &pb.Repository{GlRepository: "project-1"},
+		FromHash:   testFromCommitSHA,
+		ToHash:     testToCommitSHA,
+	}
+
+	parent, ctx := opentracing.StartSpanFromContext(context.Background(), "index")
+
+	span, _ := client.startSpan(ctx, "gitaly.ListCommits")
+	finishSpan(span, errors.New("broken"))
+	parent.Finish()
+
+	spans := tracer.FinishedSpans()
+	require.Len(t, spans, 2)
+
+	require.Equal(t, "gitaly.ListCommits", spans[0].OperationName)
+	require.Equal(t, spans[1].SpanContext.SpanID, spans[0].ParentID)
+	require.Equal(t, "project-1", spans[0].Tag("project_id"))
+	require.Equal(t, testFromCommitSHA, spans[0].Tag("from_sha"))
+	require.Equal(t, testToCommitSHA, spans[0].Tag("to_sha"))
+	require.Equal(t, true, spans[0].Tag("error"))
+}
+
+func TestBlobStreamReaderFinishesSpanOnClose(t *testing.T) {
+	tracer := setupMockTracer(t)
+
+	span := opentracing.StartSpan("gitaly.GetBlob")
+	reader := &blobStreamReader{oid: "abc", stream: &fakeGetBlobClient{}, cancel: func() {}, span: span}
+
+	require.Empty(t, tracer.FinishedSpans())
+	require.NoError(t, reader.Close())
+	require.Len(t, tracer.FinishedSpans(), 1)
+}
@@ -0,0 +1,179 @@
+package indexer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/go-enry/go-enry/v2"
+	logkit "gitlab.com/gitlab-org/labkit/log"
+
+	"gitlab.com/gitlab-org/gitlab-elasticsearch-indexer/git"
+)
+
+const gitattributesFile = ".gitattributes"
+
+// attributeRule is a line of a .gitattributes file. Values are "true" for
+// set attributes, "false" for unset ones and "" for the ones made
+// unspecified with '!'.
+type attributeRule struct {
+	pattern *pattern
+	values  map[string]string
+}
+
+// attributes are the rules of the .gitattributes files of a repository, in
+// increasing order of precedence
+type attributes struct {
+	rules []*attributeRule
+}
+
+// loadAttributes reads every .gitattributes file of the repository. Those of
+// subdirectories take precedence, as they do with git.
+func loadAttributes(ctx context.Context, reader git.FileReader) (*attributes, error) {
+	paths, err := reader.FindFiles(ctx, gitattributesFile)
+	if err != nil {
+		return nil, fmt.Errorf("finding %s files: %v", gitattributesFile, err)
+	}
+
+	sort.Slice(paths, func(i, j int) bool {
+		depthI, depthJ := strings.Count(paths[i], "/"), strings.Count(paths[j], "/")
+		if depthI != depthJ {
+			return depthI < depthJ
+		}
+		return paths[i] < paths[j]
+	})
+
+	a := &attributes{}
+	for _, file := range paths {
+		data, err := reader.ReadFile(ctx, file)
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %v", file, err)
+		}
+
+		dir := path.Dir(file)
+		if dir == "." {
+			dir = ""
+		}
+
+		a.add(parseAttributes(dir, data))
+	}
+
+	return a, nil
+}
+
+func (a *attributes) add(rules []*attributeRule) {
+	a.rules = append(a.rules, rules...)
+}
+
+// get returns the attributes of a path, the last rule matching it winning.
+// A nil attributes has no rules.
+func (a *attributes) get(name string) attributeValues {
+	values := make(attributeValues)
+	if a == nil {
+		return values
+	}
+
+	for _, rule := range a.rules {
+		if !rule.pattern.match(name) {
+			continue
+		}
+
+		for attr, value := range rule.values {
+			if value == "" {
+				delete(values, attr)
+			} else {
+				values[attr] = value
+			}
+		}
+	}
+
+	return values
+}
+
+// attributeValues are the attributes of a file
+type attributeValues map[string]string
+
+// bool returns the value of a boolean attribute, and whether it's set at all
+func (v attributeValues) bool(attr string) (value bool, set bool) {
+	switch v[attr] {
+	case "":
+		return false, false
+	case "false", "0":
+		return false, true
+	}
+
+	return true, true
+}
+
+// binary tells whether the file is marked as binary, or as not to be diffed.
+// Unsetting text only turns off the conversion of line endings, so it doesn't
+// make a file binary.
+func (v attributeValues) binary() bool {
+	binary, _ := v.bool("binary")
+	diff, diffSet := v.bool("diff")
+
+	return binary || (diffSet && !diff)
+}
+
+// language returns the language set with linguist-language, or detected
+// unless linguist-detectable is false
+func (v attributeValues) language(detected string) string {
+	if value := v["linguist-language"]; value != "" && value != "true" && value != "false" {
+		// Values are often lowercase or aliases, as in linguist-language=js
+		if language, ok := enry.GetLanguageByAlias(value); ok {
+			return language
+		}
+		return value
+	}
+
+	if detectable, set := v.bool("linguist-detectable"); set && !detectable {
+		return defaultLanguage
+	}
+
+	return detected
+}
+
+// parseAttributes parses a .gitattributes file found in dir
+func parseAttributes(dir string, data []byte) []*attributeRule {
+	var rules []*attributeRule
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		// Macros can't be defined outside of the root .gitattributes, and
+		// the only one used here is binary, which is built in
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "#") || strings.HasPrefix(fields[0], "[attr]") {
+			continue
+		}
+
+		compiled, err := newPattern(dir, fields[0])
+		if err != nil {
+			logkit.WithError(err).WithField("pattern", fields[0]).Warnf("Skipping invalid pattern of %s", gitattributesFile)
+			continue
+		}
+
+		rule := &attributeRule{pattern: compiled, values: make(map[string]string)}
+
+		for _, field := range fields[1:] {
+			switch {
+			case strings.HasPrefix(field, "-"):
+				rule.values[field[1:]] = "false"
+			case strings.HasPrefix(field, "!"):
+				rule.values[field[1:]] = ""
+			case strings.Contains(field, "="):
+				parts := strings.SplitN(field, "=", 2)
+				rule.values[parts[0]] = parts[1]
+			default:
+				rule.values[field] = "true"
+			}
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules
+}
@@ -0,0 +1,108 @@
+package indexer_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-elasticsearch-indexer/indexer"
+)
+
+func setupAttributesIndexer(attributes bool, files map[string]string) (*indexer.Indexer, *fakeRepository, *fakeSubmitter) {
+	repo := &fileRepository{fakeRepository: &fakeRepository{}, repositoryFiles: files}
+	submitter := &fakeSubmitter{}
+
+	return indexer.NewIndexerWithOptions(repo, submitter, indexer.Options{Attributes: attributes}), repo.fakeRepository, submitter
+}
+
+func TestAttributesOverrideLanguageAndBinary(t *testing.T) {
+	idx, repo, submit := setupAttributesIndexer(true, map[string]string{
+		".gitattributes": strings.Join([]string{
+			"# Templates",
+			"*.tmpl linguist-language=go",
+			"*.dat binary",
+			"*.txt -diff",
+			"docs/** -linguist-detectable",
+			"docs/*.md linguist-language=Markdown",
+		}, "\n"),
+		// Nested files take precedence for their directory
+		"lib/.gitattributes": strings.Join([]string{
+			"*.tmpl linguist-language=Ruby",
+			"/vendor.txt diff",
+		}, "\n"),
+		"scripts/.gitattributes": "* -text\n",
+	})
+
+	for _, path := range []string{
+		"main.tmpl",
+		"lib/view.tmpl",
+		"lib/sub/view.tmpl",
+		"data.dat",
+		"notes.txt",
+		"lib/vendor.txt",
+		"lib/sub/vendor.txt",
+		"docs/setup.rb",
+		"docs/README.md",
+		"src/app.rb",
+		"scripts/build.sh",
+	} {
+		repo.added = append(repo.added, gitFile(path, "content"))
+	}
+
+	require.NoError(t, idx.IndexBlobs(context.Background(), "blob"))
+
+	blobs := indexedBlobs(submit)
+	require.Len(t, blobs, 11)
+
+	for path, expected := range map[string]struct{ language, content string }{
+		"main.tmpl":          {"Go", "content"},
+		"lib/view.tmpl":      {"Ruby", "content"},
+		"lib/sub/view.tmpl":  {"Ruby", "content"},
+		"data.dat":           {"Text", ""},
+		"notes.txt":          {"Text", ""},
+		"lib/vendor.txt":     {"Text", "content"},
+		"lib/sub/vendor.txt": {"Text", ""},
+		"docs/setup.rb":      {"Text", "content"},
+		"docs/README.md":     {"Markdown", "content"},
+		"src/app.rb":         {"Ruby", "content"},
+		"scripts/build.sh":   {"Shell", "content"},
+	} {
+		require.Equal(t, expected.language, blobs[path].Language, path)
+		require.Equal(t, expected.content, blobs[path].Content, path)
+	}
+}
+
+func TestAttributesAreDisabledByDefault(t *testing.T) {
+	idx, repo, submit := setupAttributesIndexer(false, map[string]string{
+		".gitattributes": "*.dat binary\n*.tmpl linguist-language=go\n",
+	})
+
+	repo.added = append(repo.added, gitFile("data.dat", "content"), gitFile("main.tmpl", "content"))
+
+	require.NoError(t, idx.IndexBlobs(context.Background(), "blob"))
+
+	blobs := indexedBlobs(submit)
+	require.Equal(t, "content", blobs["data.dat"].Content)
+	require.Equal(t, "Text", blobs["main.tmpl"].Language)
+}
+
+func TestNestedAttributesMarkFilesAsVendored(t *testing.T) {
+	idx, repo, submit := setupIgnoringIndexer(indexer.IgnoreSkip, map[string]string{
+		"third_party/.gitattributes": "* linguist-vendored\nlocal/** -linguist-vendored\n",
+	})
+
+	repo.added = append(repo.added,
+		gitFile("third_party/lib.c", "content"),
+		gitFile("third_party/local/patch.c", "content"),
+		gitFile("src/lib.c", "content"),
+	)
+
+	require.NoError(t, idx.IndexBlobs(context.Background(), "blob"))
+
+	require.ElementsMatch(t, []string{
+		parentIDString + "_third_party/local/patch.c",
+		parentIDString + "_src/lib.c",
+	}, submit.indexedID)
+}
@@ -1,8 +1,10 @@
 package indexer
 
 import (
+	"bufio"
 	"bytes"
 	"crypto/sha1"
+	"encoding/json"
 	"fmt"
 	"io"
 	"path"
@@ -18,7 +20,10 @@ var (
 
 const (
 	binarySearchLimit = 8 * 1024 // 8 KiB, Same as git
-	defaultLanguage   = "Text"
+	// Language detection only looks at the start of a blob, like Linguist's
+	// classifier does
+	detectionLimit  = 50 * 1024 // 50 KiB
+	defaultLanguage = "Text"
 )
 
 type Blob struct {
@@ -43,6 +48,19 @@ type Blob struct {
 	Filename string `json:"file_name"`
 
 	Language string `json:"language"`
+
+	// Symbols are only extracted with Options.Symbols
+	Symbols []Symbol `json:"symbols,omitempty"`
+}
+
+func (b *Blob) ToMap() (newMap map[string]interface{}, err error) {
+	data, err := json.Marshal(b)
+	if err != nil {
+		return
+	}
+
+	err = json.Unmarshal(data, &newMap)
+	return
 }
 
 // Avoid Ids that exceed the Elasticsearch limit of 512 bytes
@@ -50,11 +68,37 @@ type Blob struct {
 // This allows support for existing blobs in the index without the need
 // to regenerate the id for each indexed document
 func GenerateBlobID(parentID int64, path string) string {
-	blobID := fmt.Sprintf("%v_%s", parentID, path)
-	if len(blobID) > 512 {
-		blobID = fmt.Sprintf("%v_%s", parentID, hashStr(path))
+	return blobID(fmt.Sprintf("%v_", parentID), path)
+}
+
+// GenerateWikiBlobID keeps wiki blobs apart from the repository blobs with
+// the same path, should both be in the same index. Earlier versions gave wiki
+// blobs the IDs of GenerateBlobID, whose documents are removed by query before
+// a wiki is indexed from scratch once.
+func GenerateWikiBlobID(parentID int64, path string) string {
+	return blobID(fmt.Sprintf("wiki_%v_", parentID), path)
+}
+
+// GenerateRefBlobID identifies the document of a blob by its content too,
+// so that refs with the same file share it. Like GenerateBlobID, the path is
+// hashed when the ID would be too long.
+func GenerateRefBlobID(parentID int64, path, oid string) string {
+	return blobID(fmt.Sprintf("%v_%s_", parentID, oid), path)
+}
+
+// GenerateRefWikiBlobID is GenerateRefBlobID for wiki blobs
+func GenerateRefWikiBlobID(parentID int64, path, oid string) string {
+	return blobID(fmt.Sprintf("wiki_%v_%s_", parentID, oid), path)
+}
+
+// blobID appends a path to the prefix of an ID, hashing it when the ID would
+// be too long
+func blobID(prefix, path string) string {
+	if len(prefix)+len(path) > 512 {
+		return prefix + hashStr(path)
 	}
-	return blobID
+
+	return prefix + path
 }
 
 func hashStr(s string) string {
@@ -64,33 +108,31 @@ func hashStr(s string) string {
 }
 
 func BuildBlob(file *git.File, parentID int64, commitSHA string, blobType string, encoder *Encoder) (*Blob, error) {
+	return buildBlob(file, parentID, commitSHA, blobType, encoder, nil, nil)
+}
+
+// buildBlob is BuildBlob reusing the content of blobs found in cache, which
+// may be nil, and honoring the attributes of the file
+func buildBlob(file *git.File, parentID int64, commitSHA string, blobType string, encoder *Encoder, cache *BlobCache, attrs attributeValues) (*Blob, error) {
 	content := NoCodeContentMsgHolder
 	language := defaultLanguage
 	filename := encoder.tryEncodeString(file.Path)
 
-	// Do not read files that are too large
-	if !file.SkipTooLarge {
-		reader, err := file.Blob()
+	// Do not read files that are too large, nor those marked as binary
+	if !file.SkipTooLarge && attrs.binary() {
+		language = DetectLanguage(filename, nil)
+	} else if !file.SkipTooLarge {
+		derived, err := readBlob(file, filename, encoder, cache)
 		if err != nil {
 			return nil, err
 		}
 
-		defer reader.Close()
-
-		// FIXME(nick): This doesn't look cheap. Check the RAM & CPU pressure, esp.
-		// for large blobs
-		b, err := io.ReadAll(reader)
-		if err != nil {
-			return nil, err
-		}
-
-		if !DetectBinary(b) {
-			content = encoder.tryEncodeBytes(b)
-		}
-
-		language = DetectLanguage(filename, b)
+		content = derived.content
+		language = derived.language
 	}
 
+	language = attrs.language(language)
+
 	blob := &Blob{
 		ID:        GenerateBlobID(parentID, filename),
 		OID:       file.Oid,
@@ -106,6 +148,7 @@ func BuildBlob(file *git.File, parentID int64, commitSHA string, blobType string
 		blob.Type = "blob"
 		blob.RepoID = strconv.FormatInt(parentID, 10)
 	case "wiki_blob":
+		blob.ID = GenerateWikiBlobID(parentID, filename)
 		blob.Type = "wiki_blob"
 		blob.RepoID = fmt.Sprintf("wiki_%d", parentID)
 	}
@@ -113,6 +156,93 @@ func BuildBlob(file *git.File, parentID int64, commitSHA string, blobType string
 	return blob, nil
 }
 
+// readBlob fetches the content of a blob and derives its language, unless
+// the blob is in cache
+func readBlob(file *git.File, filename string, encoder *Encoder, cache *BlobCache) (*blobContent, error) {
+	basename := path.Base(filename)
+
+	if file.Oid == "" {
+		cache = nil
+	}
+
+	if cached, ok := cache.get(file.Oid); ok {
+		if cached.filename == basename {
+			return cached, nil
+		}
+
+		// The language depends on the file name too. The converted content
+		// is close enough to the original for the detection.
+		derived := *cached
+		derived.filename = basename
+		derived.language = DetectLanguage(filename, contentPrefix(cached.content))
+
+		return &derived, nil
+	}
+
+	reader, err := file.Blob()
+	if err != nil {
+		return nil, err
+	}
+
+	// The reader is closed before the content is converted, since it may
+	// hold a stream or a lock of the repository
+	data, binary, err := readContent(reader)
+	reader.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	derived := &blobContent{
+		oid:      file.Oid,
+		content:  NoCodeContentMsgHolder,
+		binary:   binary,
+		filename: basename,
+	}
+
+	if !derived.binary {
+		derived.content = encoder.tryEncodeBytes(data)
+	}
+
+	prefix := data
+	if len(prefix) > detectionLimit {
+		prefix = prefix[:detectionLimit]
+	}
+
+	derived.language = DetectLanguage(filename, prefix)
+
+	cache.put(derived)
+
+	return derived, nil
+}
+
+// readContent reads a blob in full, unless its first bytes tell it's binary.
+// Binary and language detection work on a bounded prefix, so binary blobs are
+// never read in full.
+func readContent(reader io.Reader) ([]byte, bool, error) {
+	buffered := bufio.NewReaderSize(reader, detectionLimit)
+	prefix, err := buffered.Peek(detectionLimit)
+	if err != nil && err != io.EOF {
+		return nil, false, err
+	}
+
+	// The prefix belongs to the buffer of the reader
+	if DetectBinary(prefix) {
+		return append([]byte(nil), prefix...), true, nil
+	}
+
+	data, err := io.ReadAll(buffered)
+
+	return data, false, err
+}
+
+func contentPrefix(content string) []byte {
+	if len(content) > detectionLimit {
+		content = content[:detectionLimit]
+	}
+
+	return []byte(content)
+}
+
 // DetectLanguage returns a string describing the language of the file. This is
 // programming language, rather than natural language.
 //
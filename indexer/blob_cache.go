@@ -0,0 +1,116 @@
+package indexer
+
+import (
+	"container/list"
+	"sync"
+
+	"gitlab.com/gitlab-org/gitlab-elasticsearch-indexer/metrics"
+)
+
+// DefaultBlobCacheSize is the number of bytes of content a BlobCache keeps
+// by default
+const DefaultBlobCacheSize = 64 * 1024 * 1024 // 64 MiB
+
+// blobCacheEntryOverhead roughly accounts for the memory used by an entry
+// besides its content
+const blobCacheEntryOverhead = 256
+
+// BlobCache keeps what BuildBlob derives from the content of a blob, by OID,
+// so that the files sharing a blob are fetched and converted once. The least
+// recently used blobs are evicted once the cached content exceeds the size
+// of the cache. It's safe for concurrent use.
+type BlobCache struct {
+	mu      sync.Mutex
+	maxSize int64
+	size    int64
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+// blobContent is what BuildBlob derives from the content of a blob. The
+// language also depends on the file name, so it's only reused for files
+// with the same base name.
+type blobContent struct {
+	oid      string
+	content  string
+	binary   bool
+	filename string
+	language string
+}
+
+func (b *blobContent) size() int64 {
+	return int64(len(b.content)+len(b.oid)+len(b.filename)+len(b.language)) + blobCacheEntryOverhead
+}
+
+// NewBlobCache creates a BlobCache keeping up to maxSize bytes of content. A
+// nil BlobCache, which is what a maxSize of 0 or less gives, caches nothing.
+func NewBlobCache(maxSize int64) *BlobCache {
+	if maxSize <= 0 {
+		return nil
+	}
+
+	return &BlobCache{
+		maxSize: maxSize,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+func (c *BlobCache) get(oid string) (*blobContent, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[oid]
+	if !ok {
+		metrics.BlobCacheTotal.WithLabelValues("miss").Inc()
+		return nil, false
+	}
+
+	metrics.BlobCacheTotal.WithLabelValues("hit").Inc()
+	c.lru.MoveToFront(element)
+
+	return element.Value.(*blobContent), true
+}
+
+// contains tells whether the blob is in cache, without counting a hit or a
+// miss, nor marking the blob as recently used
+func (c *BlobCache) contains(oid string) bool {
+	if c == nil {
+		return false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, ok := c.entries[oid]
+
+	return ok
+}
+
+func (c *BlobCache) put(blob *blobContent) {
+	if c == nil || blob.size() > c.maxSize {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Two workers may have built the same blob at the same time
+	if _, ok := c.entries[blob.oid]; ok {
+		return
+	}
+
+	c.entries[blob.oid] = c.lru.PushFront(blob)
+	c.size += blob.size()
+
+	for c.size > c.maxSize {
+		oldest := c.lru.Back()
+		evicted := c.lru.Remove(oldest).(*blobContent)
+		delete(c.entries, evicted.oid)
+		c.size -= evicted.size()
+	}
+}
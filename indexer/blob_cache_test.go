@@ -0,0 +1,137 @@
+package indexer_test
+
+import (
+	"context"
+	"io"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-elasticsearch-indexer/git"
+	"gitlab.com/gitlab-org/gitlab-elasticsearch-indexer/indexer"
+)
+
+// countedFile is a file whose blob counts how many times it's fetched
+func countedFile(path, oid, content string, fetched *int32) *git.File {
+	file := gitFile(path, content)
+	file.Oid = oid
+	file.Blob = func() (io.ReadCloser, error) {
+		atomic.AddInt32(fetched, 1)
+		return io.NopCloser(strings.NewReader(content)), nil
+	}
+
+	return file
+}
+
+func indexedBlobs(submit *fakeSubmitter) map[string]*indexer.Blob {
+	blobs := make(map[string]*indexer.Blob)
+	for _, thing := range submit.indexedThing {
+		blob := thing.(map[string]interface{})["blob"].(*indexer.Blob)
+		blobs[blob.Path] = blob
+	}
+
+	return blobs
+}
+
+func TestBlobCacheSkipsRepeatedBlobs(t *testing.T) {
+	for _, concurrency := range []int{1, 4} {
+		var fetched int32
+
+		repo := &fakeRepository{}
+		submit := &fakeSubmitter{}
+		idx := indexer.NewIndexerWithOptions(repo, submit, indexer.Options{
+			Concurrency: concurrency,
+			BlobCache:   indexer.NewBlobCache(indexer.DefaultBlobCacheSize),
+		})
+
+		repo.added = append(repo.added, countedFile("vendor/a/lib.rb", oid, "puts 'hello'", &fetched))
+
+		require.NoError(t, idx.IndexBlobs(context.Background(), "blob"))
+
+		repo.added = []*git.File{
+			countedFile("vendor/b/lib.rb", oid, "puts 'hello'", &fetched),
+			countedFile("vendor/c/lib.txt", oid, "puts 'hello'", &fetched),
+		}
+
+		require.NoError(t, idx.IndexBlobs(context.Background(), "blob"))
+
+		require.Equal(t, int32(1), fetched, "concurrency %d", concurrency)
+		require.Equal(t, 3, submit.indexed)
+
+		blobs := indexedBlobs(submit)
+		require.Equal(t, "puts 'hello'", blobs["vendor/b/lib.rb"].Content)
+		require.Equal(t, "Ruby", blobs["vendor/b/lib.rb"].Language)
+		require.Equal(t, indexer.GenerateBlobID(parentID, "vendor/b/lib.rb"), blobs["vendor/b/lib.rb"].ID)
+
+		// The language is detected again for another file name
+		require.Equal(t, "puts 'hello'", blobs["vendor/c/lib.txt"].Content)
+		require.Equal(t, "Text", blobs["vendor/c/lib.txt"].Language)
+	}
+}
+
+func TestBlobCacheSkipsPrefetchOfCachedBlobs(t *testing.T) {
+	var fetched int32
+
+	repo := &orderedRepository{}
+	submit := &fakeSubmitter{}
+	idx := indexer.NewIndexerWithOptions(repo, submit, indexer.Options{
+		BlobCache: indexer.NewBlobCache(indexer.DefaultBlobCacheSize),
+	})
+
+	repo.changes = []fakeChange{{file: countedFile("a.rb", oid, "puts 'hello'", &fetched)}}
+	require.NoError(t, idx.IndexBlobs(context.Background(), "blob"))
+	require.Equal(t, []string{"a.rb"}, repo.prefetched)
+
+	repo.prefetched = nil
+	repo.changes = []fakeChange{
+		{file: countedFile("b.rb", oid, "puts 'hello'", &fetched)},
+		{file: countedFile("c.rb", "f00", "puts 'world'", &fetched)},
+	}
+	require.NoError(t, idx.IndexBlobs(context.Background(), "blob"))
+	require.Equal(t, []string{"c.rb"}, repo.prefetched)
+}
+
+func TestBlobCacheEvictsLeastRecentlyUsedBlobs(t *testing.T) {
+	var fetched int32
+
+	repo := &fakeRepository{}
+	submit := &fakeSubmitter{}
+	idx := indexer.NewIndexerWithOptions(repo, submit, indexer.Options{
+		// Only one of the blobs fits
+		BlobCache: indexer.NewBlobCache(1024),
+	})
+
+	const otherOid = "1111111111111111111111111111111111111111"
+	content := strings.Repeat("a", 500)
+
+	repo.added = []*git.File{
+		countedFile("a", oid, content, &fetched),
+		countedFile("b", otherOid, content, &fetched),
+		countedFile("c", otherOid, content, &fetched),
+		countedFile("d", oid, content, &fetched),
+	}
+
+	require.NoError(t, idx.IndexBlobs(context.Background(), "blob"))
+
+	require.Equal(t, int32(3), fetched)
+	require.Equal(t, 4, submit.indexed)
+}
+
+func TestBlobCacheIsDisabledWithoutSize(t *testing.T) {
+	var fetched int32
+
+	repo := &fakeRepository{}
+	idx := indexer.NewIndexerWithOptions(repo, &fakeSubmitter{}, indexer.Options{
+		BlobCache: indexer.NewBlobCache(0),
+	})
+
+	repo.added = []*git.File{
+		countedFile("a", oid, "foo", &fetched),
+		countedFile("b", oid, "foo", &fetched),
+	}
+
+	require.NoError(t, idx.IndexBlobs(context.Background(), "blob"))
+	require.Equal(t, int32(2), fetched)
+}
@@ -2,6 +2,8 @@ package indexer_test
 
 import (
 	"encoding/json"
+	"fmt"
+	"io"
 	"strings"
 	"testing"
 
@@ -90,3 +92,50 @@ func TestGenerateBlobID(t *testing.T) {
 	large_filename := strings.Repeat("ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789", 20)
 	require.Equal(t, "12345678_e0264f90b84a0fe08768dc5dcdf27efe60fe6633", indexer.GenerateBlobID(12345678, large_filename))
 }
+
+func TestGenerateWikiBlobID(t *testing.T) {
+	require.Equal(t, "wiki_2147483648_path", indexer.GenerateWikiBlobID(2147483648, "path"))
+	require.Equal(t, "wiki_2147483648_"+oid+"_path", indexer.GenerateRefWikiBlobID(2147483648, "path", oid))
+
+	large_filename := strings.Repeat("ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789", 20)
+	require.Equal(t, "wiki_12345678_e0264f90b84a0fe08768dc5dcdf27efe60fe6633", indexer.GenerateWikiBlobID(12345678, large_filename))
+
+	// The prefix counts towards the limit
+	require.LessOrEqual(t, len(indexer.GenerateWikiBlobID(12345678, strings.Repeat("a", 500))), 512)
+}
+
+type failingReader struct {
+	prefix io.Reader
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	n, err := r.prefix.Read(p)
+	if err == io.EOF {
+		return 0, fmt.Errorf("read past the detection prefix")
+	}
+
+	return n, err
+}
+
+func TestBuildBlobOnlyReadsPrefixOfBinaryBlobs(t *testing.T) {
+	prefix := "foo\x00" + strings.Repeat("a", 64*1024)
+	file := gitFile("foo/bar.bin", "")
+	file.Blob = func() (io.ReadCloser, error) {
+		return io.NopCloser(&failingReader{prefix: strings.NewReader(prefix)}), nil
+	}
+
+	blob, err := indexer.BuildBlob(file, parentID, sha, "blob", setupEncoder())
+	require.NoError(t, err)
+	require.Equal(t, indexer.NoCodeContentMsgHolder, blob.Content)
+	require.Equal(t, "Text", blob.Language)
+}
+
+func TestBuildBlobReadsTextBlobsPastThePrefix(t *testing.T) {
+	content := strings.Repeat("puts 'hello'\n", 10*1024)
+	file := gitFile("foo/bar.rb", content)
+
+	blob, err := indexer.BuildBlob(file, parentID, sha, "blob", setupEncoder())
+	require.NoError(t, err)
+	require.Equal(t, content, blob.Content)
+	require.Equal(t, "Ruby", blob.Language)
+}
@@ -0,0 +1,171 @@
+package indexer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	logkit "gitlab.com/gitlab-org/labkit/log"
+)
+
+const DefaultCheckpointInterval = 1000
+
+// Checkpoint records how far a run got. Everything up to it has been
+// flushed to the Submitter, so a resumed run can skip it.
+type Checkpoint struct {
+	FromSHA  string `json:"from_sha"`
+	ToSHA    string `json:"to_sha"`
+	BlobType string `json:"blob_type"`
+
+	// BlobOffset is the number of changes, deletions and additions alike,
+	// flushed in the order the repository yields them. LastPath is the path
+	// of the last of them, to check the changes are still the same.
+	BlobOffset int64  `json:"blob_offset"`
+	LastPath   string `json:"last_path"`
+	BlobsDone  bool   `json:"blobs_done"`
+
+	LastCommit string `json:"last_commit"`
+}
+
+func (c *Checkpoint) matches(fromSHA, toSHA, blobType string) bool {
+	return c.FromSHA == fromSHA && c.ToSHA == toSHA && c.BlobType == blobType
+}
+
+// CheckpointStore persists the checkpoint of a single project
+type CheckpointStore interface {
+	// Load returns nil when there is no checkpoint
+	Load(ctx context.Context) (*Checkpoint, error)
+	Save(ctx context.Context, checkpoint *Checkpoint) error
+	Clear(ctx context.Context) error
+}
+
+// FileCheckpointStore keeps the checkpoint as JSON in a local file
+type FileCheckpointStore struct {
+	Path string
+}
+
+func NewFileCheckpointStore(path string) *FileCheckpointStore {
+	return &FileCheckpointStore{Path: path}
+}
+
+func (s *FileCheckpointStore) Load(_ context.Context) (*Checkpoint, error) {
+	data, err := os.ReadFile(s.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	checkpoint := new(Checkpoint)
+	if err := json.Unmarshal(data, checkpoint); err != nil {
+		return nil, fmt.Errorf("Checkpoint %s: %s", s.Path, err)
+	}
+
+	return checkpoint, nil
+}
+
+// Save writes to a temporary file first, so a crash never leaves a
+// truncated checkpoint behind
+func (s *FileCheckpointStore) Save(_ context.Context, checkpoint *Checkpoint) error {
+	data, err := json.Marshal(checkpoint)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.Path), filepath.Base(s.Path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), s.Path)
+}
+
+func (s *FileCheckpointStore) Clear(_ context.Context) error {
+	if err := os.Remove(s.Path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
+
+// startCheckpoint loads the checkpoint to resume from, unless it belongs to
+// another run, or starts a new one
+func (i *Indexer) startCheckpoint(ctx context.Context, blobType string) error {
+	if i.checkpoints == nil || i.checkpoint != nil {
+		return nil
+	}
+
+	fromSHA, toSHA := i.Repository.GetFromHash(), i.Repository.GetToHash()
+
+	if i.resume {
+		checkpoint, err := i.checkpoints.Load(ctx)
+		if err != nil {
+			return fmt.Errorf("Cannot load checkpoint: %v", err)
+		}
+
+		if checkpoint != nil && checkpoint.matches(fromSHA, toSHA, blobType) {
+			logkit.WithFields(
+				logkit.Fields{
+					"blobOffset": checkpoint.BlobOffset,
+					"lastPath":   checkpoint.LastPath,
+					"blobsDone":  checkpoint.BlobsDone,
+					"lastCommit": checkpoint.LastCommit,
+				},
+			).Info("Resuming from checkpoint")
+
+			i.checkpoint = checkpoint
+			return nil
+		}
+
+		if checkpoint != nil {
+			logkit.WithFields(
+				logkit.Fields{
+					"fromSHA":  checkpoint.FromSHA,
+					"toSHA":    checkpoint.ToSHA,
+					"blobType": checkpoint.BlobType,
+				},
+			).Info("Ignoring checkpoint of another run")
+		}
+	}
+
+	i.checkpoint = &Checkpoint{FromSHA: fromSHA, ToSHA: toSHA, BlobType: blobType}
+
+	return nil
+}
+
+// saveCheckpoint flushes everything submitted so far, so the checkpoint
+// never gets ahead of what was written
+func (i *Indexer) saveCheckpoint(ctx context.Context) error {
+	if err := i.Submitter.Flush(ctx); err != nil {
+		return err
+	}
+
+	if err := i.checkpoints.Save(ctx, i.checkpoint); err != nil {
+		return fmt.Errorf("Cannot save checkpoint: %v", err)
+	}
+
+	return nil
+}
+
+// ClearCheckpoint drops the checkpoint once the run is complete
+func (i *Indexer) ClearCheckpoint(ctx context.Context) error {
+	if i.checkpoints == nil {
+		return nil
+	}
+
+	return i.checkpoints.Clear(ctx)
+}
@@ -0,0 +1,180 @@
+package indexer_test
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-elasticsearch-indexer/git"
+	"gitlab.com/gitlab-org/gitlab-elasticsearch-indexer/indexer"
+)
+
+type fakeCheckpointStore struct {
+	checkpoint *indexer.Checkpoint
+	saved      []indexer.Checkpoint
+	cleared    bool
+}
+
+func (s *fakeCheckpointStore) Load(_ context.Context) (*indexer.Checkpoint, error) {
+	return s.checkpoint, nil
+}
+
+func (s *fakeCheckpointStore) Save(_ context.Context, checkpoint *indexer.Checkpoint) error {
+	s.checkpoint = checkpoint
+	s.saved = append(s.saved, *checkpoint)
+	return nil
+}
+
+func (s *fakeCheckpointStore) Clear(_ context.Context) error {
+	s.checkpoint = nil
+	s.cleared = true
+	return nil
+}
+
+func setupCheckpointIndexer(store *fakeCheckpointStore, resume bool) (*indexer.Indexer, *orderedRepository, *fakeSubmitter) {
+	repo := &orderedRepository{}
+	submitter := &fakeSubmitter{}
+
+	for _, path := range []string{"a", "b", "c", "d", "e"} {
+		repo.changes = append(repo.changes, fakeChange{file: gitFile(path, path)})
+	}
+
+	for n := 0; n < 5; n++ {
+		commit := gitCommit(fmt.Sprintf("Commit %d", n))
+		commit.Hash = fmt.Sprintf("%040d", n)
+		repo.commits = append(repo.commits, commit)
+	}
+
+	idx := indexer.NewIndexerWithOptions(repo, submitter, indexer.Options{
+		Concurrency:        2,
+		Checkpoints:        store,
+		CheckpointInterval: 2,
+		Resume:             resume,
+	})
+
+	return idx, repo, submitter
+}
+
+func newCheckpoint() *indexer.Checkpoint {
+	return &indexer.Checkpoint{FromSHA: git.NullTreeSHA, ToSHA: sha, BlobType: "blob"}
+}
+
+func TestIndexSavesCheckpoints(t *testing.T) {
+	store := &fakeCheckpointStore{}
+	idx, _, submit := setupCheckpointIndexer(store, false)
+
+	require.NoError(t, index(idx))
+
+	var offsets []int64
+	var lastPaths, lastCommits []string
+	for _, checkpoint := range store.saved {
+		offsets = append(offsets, checkpoint.BlobOffset)
+		lastPaths = append(lastPaths, checkpoint.LastPath)
+		lastCommits = append(lastCommits, checkpoint.LastCommit)
+	}
+
+	require.Equal(t, []int64{2, 4, 4, 4, 4}, offsets)
+	require.Equal(t, []string{"b", "d", "d", "d", "d"}, lastPaths)
+	require.Equal(t, []string{"", "", "", fmt.Sprintf("%040d", 1), fmt.Sprintf("%040d", 3)}, lastCommits)
+	require.True(t, store.saved[2].BlobsDone)
+	require.False(t, store.saved[1].BlobsDone)
+
+	// Every checkpoint is flushed first, then the last flush
+	require.Equal(t, len(store.saved)+1, submit.flushed)
+
+	require.NoError(t, idx.ClearCheckpoint(context.Background()))
+	require.True(t, store.cleared)
+}
+
+func TestIndexResumesFromCheckpoint(t *testing.T) {
+	checkpoint := newCheckpoint()
+	checkpoint.BlobOffset = 2
+	checkpoint.LastPath = "b"
+
+	store := &fakeCheckpointStore{checkpoint: checkpoint}
+	idx, repo, submit := setupCheckpointIndexer(store, true)
+
+	require.NoError(t, idx.IndexBlobs(context.Background(), "blob"))
+	require.ElementsMatch(t, []string{parentIDString + "_c", parentIDString + "_d", parentIDString + "_e"}, submit.indexedID)
+
+	// The blobs of the changes flushed by the previous run aren't fetched
+	require.Equal(t, []string{"c", "d", "e"}, repo.prefetched)
+}
+
+func TestIndexResumesCommitsFromCheckpoint(t *testing.T) {
+	checkpoint := newCheckpoint()
+	checkpoint.BlobsDone = true
+	checkpoint.LastCommit = fmt.Sprintf("%040d", 2)
+
+	store := &fakeCheckpointStore{checkpoint: checkpoint}
+	idx, _, submit := setupCheckpointIndexer(store, true)
+
+	require.NoError(t, index(idx))
+	require.Equal(t, []string{
+		indexer.GenerateCommitID(parentID, fmt.Sprintf("%040d", 3)),
+		indexer.GenerateCommitID(parentID, fmt.Sprintf("%040d", 4)),
+	}, submit.indexedID)
+}
+
+func TestIndexRejectsCheckpointOfOtherChanges(t *testing.T) {
+	checkpoint := newCheckpoint()
+	checkpoint.BlobOffset = 2
+	checkpoint.LastPath = "c"
+
+	store := &fakeCheckpointStore{checkpoint: checkpoint}
+	idx, _, submit := setupCheckpointIndexer(store, true)
+
+	require.Error(t, idx.IndexBlobs(context.Background(), "blob"))
+	require.Equal(t, 0, submit.indexed)
+}
+
+func TestIndexIgnoresCheckpointOfOtherRun(t *testing.T) {
+	checkpoint := newCheckpoint()
+	checkpoint.ToSHA = oid
+	checkpoint.BlobsDone = true
+
+	store := &fakeCheckpointStore{checkpoint: checkpoint}
+	idx, _, submit := setupCheckpointIndexer(store, true)
+
+	require.NoError(t, idx.IndexBlobs(context.Background(), "blob"))
+	require.Equal(t, 5, submit.indexed)
+}
+
+func TestIndexIgnoresCheckpointWithoutResume(t *testing.T) {
+	checkpoint := newCheckpoint()
+	checkpoint.BlobsDone = true
+
+	store := &fakeCheckpointStore{checkpoint: checkpoint}
+	idx, _, submit := setupCheckpointIndexer(store, false)
+
+	require.NoError(t, idx.IndexBlobs(context.Background(), "blob"))
+	require.Equal(t, 5, submit.indexed)
+}
+
+func TestFileCheckpointStore(t *testing.T) {
+	ctx := context.Background()
+	store := indexer.NewFileCheckpointStore(filepath.Join(t.TempDir(), "checkpoint.json"))
+
+	checkpoint, err := store.Load(ctx)
+	require.NoError(t, err)
+	require.Nil(t, checkpoint)
+
+	saved := newCheckpoint()
+	saved.BlobOffset = 1000
+	saved.LastPath = "foo/bar"
+	require.NoError(t, store.Save(ctx, saved))
+
+	checkpoint, err = store.Load(ctx)
+	require.NoError(t, err)
+	require.Equal(t, saved, checkpoint)
+
+	require.NoError(t, store.Clear(ctx))
+	require.NoError(t, store.Clear(ctx))
+
+	checkpoint, err = store.Load(ctx)
+	require.NoError(t, err)
+	require.Nil(t, checkpoint)
+}
@@ -1,7 +1,9 @@
 package indexer
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"strconv"
 
@@ -16,6 +18,20 @@ type Commit struct {
 	RepoID    string  `json:"rid"`
 	Message   string  `json:"message"`
 	SHA       string  `json:"sha"`
+
+	// ChangedFiles and Diff are only set with Options.CommitChanges and
+	// Options.CommitDiffSize
+	ChangedFiles []*ChangedFile `json:"changed_files,omitempty"`
+	Diff         string         `json:"diff,omitempty"`
+}
+
+// ChangedFile is a file changed by a commit, compared to its first parent
+type ChangedFile struct {
+	Path      string `json:"path"`
+	OldPath   string `json:"old_path,omitempty"`
+	Operation string `json:"operation"`
+	Additions int    `json:"additions"`
+	Deletions int    `json:"deletions"`
 }
 
 func (c *Commit) ToMap() (newMap map[string]interface{}, err error) {
@@ -46,3 +62,44 @@ func (i *Indexer) BuildCommit(c *git.Commit) *Commit {
 		SHA:       sha,
 	}
 }
+
+// addChanges sets the changed files and the diff of a commit, as the options
+// require
+func (i *Indexer) addChanges(ctx context.Context, c *git.Commit, commit *Commit) error {
+	if !i.commitChanges && i.commitDiffSize <= 0 {
+		return nil
+	}
+
+	reader, ok := i.Repository.(git.DiffReader)
+	if !ok {
+		return errors.New("the repository can't diff commits")
+	}
+
+	if i.commitChanges {
+		files, err := reader.ChangedFiles(ctx, c)
+		if err != nil {
+			return err
+		}
+
+		for _, f := range files {
+			commit.ChangedFiles = append(commit.ChangedFiles, &ChangedFile{
+				Path:      i.Encoder.tryEncodeString(f.Path),
+				OldPath:   i.Encoder.tryEncodeString(f.OldPath),
+				Operation: f.Operation,
+				Additions: f.Additions,
+				Deletions: f.Deletions,
+			})
+		}
+	}
+
+	if i.commitDiffSize > 0 {
+		diff, err := reader.Diff(ctx, c, i.commitDiffSize)
+		if err != nil {
+			return err
+		}
+
+		commit.Diff = i.Encoder.tryEncodeString(diff)
+	}
+
+	return nil
+}
@@ -1,14 +1,35 @@
 package indexer_test
 
 import (
+	"context"
 	"encoding/json"
 	"testing"
 
 	"github.com/stretchr/testify/require"
 
+	"gitlab.com/gitlab-org/gitlab-elasticsearch-indexer/git"
 	"gitlab.com/gitlab-org/gitlab-elasticsearch-indexer/indexer"
 )
 
+// diffRepository is a fakeRepository whose commits all change the same files
+type diffRepository struct {
+	*fakeRepository
+	files []git.ChangedFile
+	diff  string
+}
+
+func (r *diffRepository) ChangedFiles(_ context.Context, _ *git.Commit) ([]git.ChangedFile, error) {
+	return r.files, nil
+}
+
+func (r *diffRepository) Diff(_ context.Context, _ *git.Commit, maxSize int64) (string, error) {
+	if int64(len(r.diff)) > maxSize {
+		return r.diff[:maxSize], nil
+	}
+
+	return r.diff, nil
+}
+
 func TestBuildCommit(t *testing.T) {
 	gitCommit := gitCommit("Initial commit")
 
@@ -76,3 +97,49 @@ func TestBuildCommitForSeparateIndex(t *testing.T) {
 func TestGenerateCommitID(t *testing.T) {
 	require.Equal(t, "2147483648_sha", indexer.GenerateCommitID(2147483648, "sha"))
 }
+
+func TestIndexCommitsWithChanges(t *testing.T) {
+	repo := &diffRepository{
+		fakeRepository: &fakeRepository{},
+		files: []git.ChangedFile{
+			{Path: "README.md", Operation: git.ChangeModified, Additions: 2, Deletions: 1},
+			{Path: "docs/new.md", OldPath: "docs/old.md", Operation: git.ChangeRenamed},
+		},
+		diff: "diff --git a/README.md b/README.md\n",
+	}
+	submit := &fakeSubmitter{useSeparateIndexForCommits: true}
+	idx := indexer.NewIndexerWithOptions(repo, submit, indexer.Options{CommitChanges: true, CommitDiffSize: 10})
+
+	repo.commits = append(repo.commits, gitCommit("Initial commit"))
+
+	require.NoError(t, idx.IndexCommits(context.Background()))
+	require.Equal(t, 1, submit.indexed)
+
+	commit := submit.indexedThing[0].(map[string]interface{})
+	require.Equal(t, []interface{}{
+		map[string]interface{}{"path": "README.md", "operation": "modified", "additions": 2.0, "deletions": 1.0},
+		map[string]interface{}{"path": "docs/new.md", "old_path": "docs/old.md", "operation": "renamed", "additions": 0.0, "deletions": 0.0},
+	}, commit["changed_files"])
+	require.Equal(t, "diff --git", commit["diff"])
+}
+
+func TestIndexCommitsWithoutChanges(t *testing.T) {
+	idx, repo, submit := setupIndexer(true)
+
+	repo.commits = append(repo.commits, gitCommit("Initial commit"))
+
+	require.NoError(t, idx.IndexCommits(context.Background()))
+
+	commit := submit.indexedThing[0].(map[string]interface{})
+	require.NotContains(t, commit, "changed_files")
+	require.NotContains(t, commit, "diff")
+}
+
+func TestIndexCommitsWithChangesRequiresDiffReader(t *testing.T) {
+	repo := &fakeRepository{}
+	idx := indexer.NewIndexerWithOptions(repo, &fakeSubmitter{}, indexer.Options{CommitChanges: true})
+
+	repo.commits = append(repo.commits, gitCommit("Initial commit"))
+
+	require.EqualError(t, idx.IndexCommits(context.Background()), "Commit "+repo.commits[0].Hash+", the repository can't diff commits")
+}
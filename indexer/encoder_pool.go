@@ -0,0 +1,51 @@
+package indexer
+
+import "sync"
+
+// EncoderPool keeps the Encoders indexers are done with, so that the next
+// indexers reuse them rather than create ICU detectors and converters again.
+// It can be shared by several indexers, and is safe for concurrent use.
+type EncoderPool struct {
+	mu sync.Mutex
+
+	// encoders are kept by the limit on the size of files their converter
+	// was created with
+	encoders map[int64][]*Encoder
+}
+
+func NewEncoderPool() *EncoderPool {
+	return &EncoderPool{encoders: make(map[int64][]*Encoder)}
+}
+
+// get returns an Encoder for files of up to limitFileSize bytes, which is
+// only created if none is in the pool. A nil EncoderPool always creates one.
+func (p *EncoderPool) get(limitFileSize int64) *Encoder {
+	if p == nil {
+		return NewEncoder(limitFileSize)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	encoders := p.encoders[limitFileSize]
+	if len(encoders) == 0 {
+		return NewEncoder(limitFileSize)
+	}
+
+	encoder := encoders[len(encoders)-1]
+	p.encoders[limitFileSize] = encoders[:len(encoders)-1]
+
+	return encoder
+}
+
+// put gives back an Encoder returned by get, once it's not used anymore
+func (p *EncoderPool) put(limitFileSize int64, encoder *Encoder) {
+	if p == nil || encoder == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.encoders[limitFileSize] = append(p.encoders[limitFileSize], encoder)
+}
@@ -6,8 +6,14 @@ import (
 	logkit "gitlab.com/gitlab-org/labkit/log"
 
 	"gitlab.com/lupine/icu"
+
+	"gitlab.com/gitlab-org/gitlab-elasticsearch-indexer/metrics"
 )
 
+// Charset detection only looks at the start of the data, the rest is
+// converted with whatever charset was detected there
+const charsetDetectionLimit = 64 * 1024 // 64 KiB
+
 type Encoder struct {
 	detector  *icu.CharsetDetector
 	converter *icu.CharsetConverter
@@ -30,6 +36,7 @@ func (e *Encoder) tryEncodeString(s string) string {
 	encoded, err := e.encodeString(s)
 	if err != nil {
 		logkit.WithError(err).Error("Encode string failed")
+		metrics.EncoderFallbacksTotal.Inc()
 		return s // TODO: Run it through the UTF-8 replacement encoder
 	}
 
@@ -40,6 +47,7 @@ func (e *Encoder) tryEncodeBytes(b []byte) string {
 	encoded, err := e.encodeBytes(b)
 	if err != nil {
 		logkit.WithError(err).Error("Encode bytes failed")
+		metrics.EncoderFallbacksTotal.Inc()
 		s := string(b)
 		return s // TODO: Run it through the UTF-8 replacement encoder
 	}
@@ -57,7 +65,12 @@ func (e *Encoder) encodeBytes(b []byte) (string, error) {
 		return "", nil
 	}
 
-	matches, err := e.detector.GuessCharset(b)
+	sample := b
+	if len(sample) > charsetDetectionLimit {
+		sample = sample[:charsetDetectionLimit]
+	}
+
+	matches, err := e.detector.GuessCharset(sample)
 	if err != nil {
 		return "", fmt.Errorf("Couldn't guess charset: %s", err)
 	}
@@ -0,0 +1,49 @@
+package indexer
+
+import (
+	"encoding/json"
+	"path"
+	"strconv"
+
+	"gitlab.com/gitlab-org/gitlab-elasticsearch-indexer/git"
+)
+
+// Gitlink is a submodule entry of the repository. It shares its ID with
+// blobs, as a path holds either one or the other.
+type Gitlink struct {
+	Type      string `json:"type"`
+	ID        string `json:"-"`
+	RepoID    string `json:"rid"`
+	CommitSHA string `json:"commit_sha"`
+	Path      string `json:"path"`
+	Filename  string `json:"file_name"`
+
+	// The commit of the submodule repository the path is pinned to
+	SHA string `json:"sha"`
+	URL string `json:"url"`
+}
+
+func (g *Gitlink) ToMap() (newMap map[string]interface{}, err error) {
+	data, err := json.Marshal(g)
+	if err != nil {
+		return
+	}
+
+	err = json.Unmarshal(data, &newMap)
+	return
+}
+
+func BuildGitlink(file *git.File, parentID int64, commitSHA string, encoder *Encoder) *Gitlink {
+	filename := encoder.tryEncodeString(file.Path)
+
+	return &Gitlink{
+		Type:      "gitlink",
+		ID:        GenerateBlobID(parentID, filename),
+		RepoID:    strconv.FormatInt(parentID, 10),
+		CommitSHA: commitSHA,
+		Path:      filename,
+		Filename:  path.Base(filename),
+		SHA:       file.Oid,
+		URL:       encoder.tryEncodeString(file.SubmoduleURL),
+	}
+}
@@ -0,0 +1,32 @@
+package indexer_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-elasticsearch-indexer/indexer"
+)
+
+func TestBuildGitlink(t *testing.T) {
+	file := gitSubmodule("vendor/six", "git://github.com/randx/six.git")
+
+	actual := indexer.BuildGitlink(file, parentID, sha, setupEncoder())
+
+	require.Equal(t, validGitlink(file), actual)
+
+	expectedJSON := `{
+		"commit_sha" : "` + sha + `",
+		"file_name"  : "six",
+		"path"       : "vendor/six",
+		"rid"        : "` + parentIDString + `",
+		"sha"        : "` + oid + `",
+		"type"       : "gitlink",
+		"url"        : "git://github.com/randx/six.git"
+	}`
+
+	actualJSON, err := json.Marshal(actual)
+	require.NoError(t, err)
+	require.JSONEq(t, expectedJSON, string(actualJSON))
+}
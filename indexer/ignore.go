@@ -0,0 +1,178 @@
+package indexer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/go-enry/go-enry/v2"
+	logkit "gitlab.com/gitlab-org/labkit/log"
+
+	"gitlab.com/gitlab-org/gitlab-elasticsearch-indexer/git"
+)
+
+// SearchIgnoreFile lists the files of a repository not to index, with the
+// syntax of .gitignore
+const SearchIgnoreFile = ".gitlab-search-ignore"
+
+// IgnoreMode tells what happens to the files that are ignored, which are the
+// ones listed in SearchIgnoreFile, marked as linguist-vendored or
+// linguist-generated in .gitattributes, or deemed vendored or generated by
+// go-enry
+type IgnoreMode string
+
+const (
+	// IgnoreNone indexes every file
+	IgnoreNone IgnoreMode = ""
+	// IgnoreSkip doesn't index ignored files at all
+	IgnoreSkip IgnoreMode = "skip"
+	// IgnoreFilename only indexes the name of ignored files, as is done for
+	// files that are too large
+	IgnoreFilename IgnoreMode = "filename"
+)
+
+// ParseIgnoreMode checks a mode given on the command line
+func ParseIgnoreMode(mode string) (IgnoreMode, error) {
+	switch IgnoreMode(mode) {
+	case IgnoreNone, IgnoreSkip, IgnoreFilename:
+		return IgnoreMode(mode), nil
+	}
+
+	return IgnoreNone, fmt.Errorf("unknown ignore mode: %v", mode)
+}
+
+// ignorePattern is a line of SearchIgnoreFile
+type ignorePattern struct {
+	*pattern
+	negated bool
+	dirOnly bool
+}
+
+// ignoreRules are the rules read from a repository at ToHash
+type ignoreRules struct {
+	patterns   []*ignorePattern
+	attributes *attributes
+}
+
+// loadIgnoreRules reads SearchIgnoreFile with reader, if any, and combines
+// it with the attributes of the repository
+func loadIgnoreRules(ctx context.Context, reader git.FileReader, attrs *attributes) (*ignoreRules, error) {
+	rules := &ignoreRules{attributes: attrs}
+
+	if reader == nil {
+		return rules, nil
+	}
+
+	data, err := reader.ReadFile(ctx, SearchIgnoreFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %v", SearchIgnoreFile, err)
+	}
+	rules.patterns = parseIgnoreFile(data)
+
+	return rules, nil
+}
+
+func parseIgnoreFile(data []byte) []*ignorePattern {
+	var patterns []*ignorePattern
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := trimTrailingSpaces(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		p := &ignorePattern{}
+
+		if line[0] == '!' {
+			p.negated = true
+			line = line[1:]
+		} else if strings.HasPrefix(line, `\!`) || strings.HasPrefix(line, `\#`) {
+			line = line[1:]
+		}
+
+		if strings.HasSuffix(line, "/") {
+			p.dirOnly = true
+			line = strings.TrimSuffix(line, "/")
+		}
+
+		compiled, err := newPattern("", line)
+		if err != nil {
+			logkit.WithError(err).WithField("pattern", line).Warnf("Skipping invalid pattern of %s", SearchIgnoreFile)
+			continue
+		}
+		p.pattern = compiled
+
+		patterns = append(patterns, p)
+	}
+
+	return patterns
+}
+
+// trimTrailingSpaces drops the trailing spaces of a line, unless they are
+// escaped with a backslash
+func trimTrailingSpaces(line string) string {
+	trimmed := strings.TrimRight(line, " ")
+	if strings.HasSuffix(trimmed, `\`) && len(trimmed) < len(line) {
+		trimmed += " "
+	}
+
+	return trimmed
+}
+
+// listed tells whether a path is listed in SearchIgnoreFile. As with git, a
+// file can't be listed again once a directory containing it is.
+func (r *ignoreRules) listed(name string) bool {
+	dirs := strings.Split(name, "/")
+
+	for i := range dirs {
+		prefix := strings.Join(dirs[:i+1], "/")
+		isDir := i < len(dirs)-1
+
+		ignored := false
+		for _, p := range r.patterns {
+			if p.dirOnly && !isDir {
+				continue
+			}
+			if p.match(prefix) {
+				ignored = !p.negated
+			}
+		}
+
+		if ignored {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ignored tells whether a file is ignored from its path. Attributes set to
+// false override the heuristics of go-enry.
+func (r *ignoreRules) ignored(name string) bool {
+	if r.listed(name) {
+		return true
+	}
+
+	attrs := r.attributes.get(name)
+	vendored, vendoredSet := attrs.bool("linguist-vendored")
+	generated, generatedSet := attrs.bool("linguist-generated")
+
+	if vendored || generated {
+		return true
+	}
+
+	return (!vendoredSet && enry.IsVendor(name)) || (!generatedSet && enry.IsGenerated(name, nil))
+}
+
+// generated tells whether the content of a file that isn't ignored from its
+// path shows that it's generated, as minified files do
+func (r *ignoreRules) generated(name, content string) bool {
+	if _, set := r.attributes.get(name).bool("linguist-generated"); set {
+		return false
+	}
+
+	return enry.IsGenerated(name, contentPrefix(content))
+}
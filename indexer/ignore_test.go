@@ -0,0 +1,205 @@
+package indexer_test
+
+import (
+	"context"
+	"path"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-elasticsearch-indexer/git"
+	"gitlab.com/gitlab-org/gitlab-elasticsearch-indexer/indexer"
+)
+
+// repositoryFiles are the files of a fake repository at ToHash
+type repositoryFiles map[string]string
+
+func (files repositoryFiles) ReadFile(_ context.Context, path string) ([]byte, error) {
+	content, ok := files[path]
+	if !ok {
+		return nil, nil
+	}
+
+	return []byte(content), nil
+}
+
+func (files repositoryFiles) FindFiles(_ context.Context, name string) ([]string, error) {
+	var paths []string
+	for file := range files {
+		if path.Base(file) == name {
+			paths = append(paths, file)
+		}
+	}
+	sort.Strings(paths)
+
+	return paths, nil
+}
+
+// fileRepository is a fakeRepository whose files can be read at ToHash
+type fileRepository struct {
+	*fakeRepository
+	repositoryFiles
+}
+
+// orderedFileRepository is an orderedRepository whose files can be read at
+// ToHash
+type orderedFileRepository struct {
+	*orderedRepository
+	repositoryFiles
+}
+
+func setupIgnoringIndexer(mode indexer.IgnoreMode, files map[string]string) (*indexer.Indexer, *fakeRepository, *fakeSubmitter) {
+	repo := &fileRepository{fakeRepository: &fakeRepository{}, repositoryFiles: files}
+	submitter := &fakeSubmitter{}
+
+	return indexer.NewIndexerWithOptions(repo, submitter, indexer.Options{Ignore: mode}), repo.fakeRepository, submitter
+}
+
+func TestIgnoreSkipsIgnoredFiles(t *testing.T) {
+	idx, repo, submit := setupIgnoringIndexer(indexer.IgnoreSkip, map[string]string{
+		indexer.SearchIgnoreFile: strings.Join([]string{
+			"# Build output",
+			"/build/",
+			"*.log",
+			"!keep.log",
+			"docs/**/*.pdf.txt",
+			"",
+		}, "\n"),
+		".gitattributes": strings.Join([]string{
+			"app/schema.rb linguist-generated=true",
+			"third_party/** linguist-vendored",
+			"dist/** -linguist-vendored",
+		}, "\n"),
+	})
+
+	for _, path := range []string{
+		"build/out.txt",
+		"src/build/out.txt",
+		"debug.log",
+		"logs/keep.log",
+		"docs/guide/a/b.pdf.txt",
+		"docs/c.pdf.txt",
+		"guide/b.pdf.txt",
+		"app/schema.rb",
+		"app/models/user.rb",
+		"third_party/lib.c",
+		"node_modules/left-pad/index.js",
+		"dist/app.js",
+		"assets/app.min.js",
+		"assets/bundle.js",
+	} {
+		content := "content"
+		if path == "assets/bundle.js" {
+			// Minified files are found from their content
+			content = strings.Repeat("var a=1;", 50)
+		}
+
+		repo.added = append(repo.added, gitFile(path, content))
+	}
+
+	require.NoError(t, idx.IndexBlobs(context.Background(), "blob"))
+
+	require.ElementsMatch(t, []string{
+		parentIDString + "_src/build/out.txt",
+		parentIDString + "_logs/keep.log",
+		parentIDString + "_guide/b.pdf.txt",
+		parentIDString + "_app/models/user.rb",
+		parentIDString + "_dist/app.js",
+	}, submit.indexedID)
+	require.Equal(t, 0, submit.removed)
+}
+
+// trackingRepository is a fileRepository telling the blob its modified files
+// replace once asked to
+type trackingRepository struct {
+	*fileRepository
+	tracked bool
+}
+
+func (r *trackingRepository) TrackPreviousOids() {
+	r.tracked = true
+}
+
+func (r *trackingRepository) EachFileChange(ctx context.Context, put git.PutFunc, del git.DelFunc) error {
+	for _, file := range r.modified {
+		if r.tracked {
+			file.PreviousOid = oid
+		}
+	}
+
+	return r.fileRepository.EachFileChange(ctx, put, del)
+}
+
+func TestIgnoreRemovesSkippedFilesReplacingAnother(t *testing.T) {
+	repo := &trackingRepository{fileRepository: &fileRepository{
+		fakeRepository:  &fakeRepository{},
+		repositoryFiles: repositoryFiles{indexer.SearchIgnoreFile: "*.log\n"},
+	}}
+	submit := &fakeSubmitter{}
+	idx := indexer.NewIndexerWithOptions(repo, submit, indexer.Options{Ignore: indexer.IgnoreSkip})
+
+	// Added files were never indexed, unlike the modified ones
+	repo.added = append(repo.added, gitFile("added.log", "content"))
+	repo.modified = append(repo.modified, gitFile("modified.log", "content"))
+
+	require.NoError(t, idx.IndexBlobs(context.Background(), "blob"))
+
+	require.True(t, repo.tracked)
+	require.Empty(t, submit.indexedID)
+	require.Equal(t, []string{parentIDString + "_modified.log"}, submit.removedID)
+}
+
+func TestIgnoreIndexesFilenameOfIgnoredFiles(t *testing.T) {
+	idx, repo, submit := setupIgnoringIndexer(indexer.IgnoreFilename, map[string]string{
+		indexer.SearchIgnoreFile: "*.lock\n",
+	})
+
+	repo.added = append(repo.added, gitFile("Gemfile.lock", "GEM"), gitFile("Gemfile", "gem 'rails'"))
+
+	require.NoError(t, idx.IndexBlobs(context.Background(), "blob"))
+
+	blobs := indexedBlobs(submit)
+	require.Len(t, blobs, 2)
+	require.Empty(t, blobs["Gemfile.lock"].Content)
+	require.Equal(t, "Gemfile.lock", blobs["Gemfile.lock"].Filename)
+	require.Equal(t, "gem 'rails'", blobs["Gemfile"].Content)
+}
+
+func TestIgnoreSkipsPrefetchOfIgnoredFiles(t *testing.T) {
+	for _, mode := range []indexer.IgnoreMode{indexer.IgnoreSkip, indexer.IgnoreFilename, indexer.IgnoreNone} {
+		repo := &orderedFileRepository{&orderedRepository{}, repositoryFiles{indexer.SearchIgnoreFile: "*.lock\n"}}
+		idx := indexer.NewIndexerWithOptions(repo, &fakeSubmitter{}, indexer.Options{Ignore: mode})
+
+		repo.changes = []fakeChange{{file: gitFile("Gemfile.lock", "GEM")}, {file: gitFile("Gemfile", "gem 'rails'")}}
+
+		require.NoError(t, idx.IndexBlobs(context.Background(), "blob"))
+
+		if mode == indexer.IgnoreNone {
+			require.Equal(t, []string{"Gemfile.lock", "Gemfile"}, repo.prefetched, mode)
+		} else {
+			require.Equal(t, []string{"Gemfile"}, repo.prefetched, mode)
+		}
+	}
+}
+
+func TestIgnoreIsDisabledByDefault(t *testing.T) {
+	idx, repo, submit := setupIgnoringIndexer(indexer.IgnoreNone, map[string]string{
+		indexer.SearchIgnoreFile: "*\n",
+	})
+
+	repo.added = append(repo.added, gitFile("node_modules/left-pad/index.js", "content"))
+
+	require.NoError(t, idx.IndexBlobs(context.Background(), "blob"))
+	require.Equal(t, 1, submit.indexed)
+}
+
+func TestParseIgnoreMode(t *testing.T) {
+	mode, err := indexer.ParseIgnoreMode("filename")
+	require.NoError(t, err)
+	require.Equal(t, indexer.IgnoreFilename, mode)
+
+	_, err = indexer.ParseIgnoreMode("everything")
+	require.EqualError(t, err, "unknown ignore mode: everything")
+}
@@ -1,13 +1,17 @@
 package indexer
 
 import (
+	"context"
 	"fmt"
 
 	logkit "gitlab.com/gitlab-org/labkit/log"
 
 	"gitlab.com/gitlab-org/gitlab-elasticsearch-indexer/git"
+	"gitlab.com/gitlab-org/gitlab-elasticsearch-indexer/metrics"
 )
 
+// Submitter receives the documents built by the Indexer. Index and Remove
+// may be called concurrently when blobs are processed by several workers.
 type Submitter interface {
 	ParentID() int64
 	ProjectPermissions() *ProjectPermissions
@@ -16,8 +20,26 @@ type Submitter interface {
 	Remove(documentType, id string)
 
 	UseSeparateIndexForCommits() bool
+	UseSeparateIndexForWikis() bool
+	UseSeparateIndexForBlobs() bool
 
-	Flush() error
+	// Flush waits for every submitted document to be written. It gives up
+	// once ctx is done, abandoning whatever is still in flight.
+	Flush(ctx context.Context) error
+}
+
+// RefSubmitter is a Submitter able to share the documents of blobs between
+// refs, which is needed to index several refs with Options.Ref
+type RefSubmitter interface {
+	Submitter
+
+	// IndexRef creates the document if it doesn't exist yet, and adds ref
+	// to its refs
+	IndexRef(documentType, id, ref string, thing interface{})
+
+	// RemoveRef removes ref from the refs of the document, which is deleted
+	// once no ref is left
+	RemoveRef(documentType, id, ref string)
 }
 
 type Indexer struct {
@@ -25,6 +47,78 @@ type Indexer struct {
 	Submitter
 	*Encoder
 	separateIndexForCommits bool
+	separateIndexForWikis   bool
+	separateIndexForBlobs   bool
+	concurrency             int
+
+	checkpoints        CheckpointStore
+	checkpointInterval int64
+	resume             bool
+	checkpoint         *Checkpoint
+
+	ref string
+
+	blobs    *BlobCache
+	encoders *EncoderPool
+
+	ignoreMode      IgnoreMode
+	applyAttributes bool
+	symbols         bool
+
+	commitChanges  bool
+	commitDiffSize int64
+
+	// The rules of the repository are loaded along with the first file
+	rulesLoaded bool
+	attributes  *attributes
+	ignore      *ignoreRules
+}
+
+type Options struct {
+	// Concurrency is the number of workers building blobs. With 1 or less,
+	// blobs are built one after the other as the repository yields them.
+	Concurrency int
+
+	// Checkpoints, when set, receives a checkpoint every CheckpointInterval
+	// changes or commits. With Resume, the work recorded in the stored
+	// checkpoint is skipped.
+	Checkpoints        CheckpointStore
+	CheckpointInterval int64
+	Resume             bool
+
+	// Ref, when set, is the ref whose changes are indexed. Documents of
+	// blobs are then identified by their content too, and shared by every
+	// ref they are found in, which requires a RefSubmitter.
+	Ref string
+
+	// BlobCache, when set, keeps the content of the blobs already built so
+	// that the files sharing them are not fetched and converted again. It
+	// can be shared by several indexers.
+	BlobCache *BlobCache
+
+	// Encoders, when set, provides the Encoders of the indexer and of its
+	// workers, so that they are reused by the next indexers once Release is
+	// called. It can be shared by several indexers.
+	Encoders *EncoderPool
+
+	// Ignore tells what happens to the repository files that are ignored,
+	// following the rules read from the repository at ToHash
+	Ignore IgnoreMode
+
+	// Attributes makes the language of blobs and whether they are binary
+	// follow the .gitattributes files of the repository at ToHash, with the
+	// linguist-language, linguist-detectable, binary and diff attributes
+	Attributes bool
+
+	// Symbols enables the extraction of the definitions found in blobs, for
+	// the languages ExtractSymbols supports
+	Symbols bool
+
+	// CommitChanges adds the files changed by commits to their documents,
+	// and CommitDiffSize their patch, cut after as many bytes. Both require
+	// a git.DiffReader.
+	CommitChanges  bool
+	CommitDiffSize int64
 }
 
 type ProjectPermissions struct {
@@ -33,17 +127,52 @@ type ProjectPermissions struct {
 }
 
 func NewIndexer(repository git.Repository, submitter Submitter) *Indexer {
-	return &Indexer{
+	return NewIndexerWithOptions(repository, submitter, Options{})
+}
+
+func NewIndexerWithOptions(repository git.Repository, submitter Submitter, options Options) *Indexer {
+	indexer := &Indexer{
 		Repository:              repository,
 		Submitter:               submitter,
-		Encoder:                 NewEncoder(repository.GetLimitFileSize()),
+		Encoder:                 options.Encoders.get(repository.GetLimitFileSize()),
 		separateIndexForCommits: submitter.UseSeparateIndexForCommits(),
+		separateIndexForWikis:   submitter.UseSeparateIndexForWikis(),
+		separateIndexForBlobs:   submitter.UseSeparateIndexForBlobs(),
+		concurrency:             options.Concurrency,
+		checkpoints:             options.Checkpoints,
+		checkpointInterval:      options.CheckpointInterval,
+		resume:                  options.Resume,
+		ref:                     options.Ref,
+		blobs:                   options.BlobCache,
+		encoders:                options.Encoders,
+		ignoreMode:              options.Ignore,
+		applyAttributes:         options.Attributes,
+		symbols:                 options.Symbols,
+		commitChanges:           options.CommitChanges,
+		commitDiffSize:          options.CommitDiffSize,
 	}
+
+	if indexer.checkpointInterval <= 0 {
+		indexer.checkpointInterval = DefaultCheckpointInterval
+	}
+
+	return indexer
 }
 
-func (i *Indexer) submitCommit(c *git.Commit) error {
+// Release gives the Encoder of the indexer back to Options.Encoders, after
+// which the indexer can't be used anymore
+func (i *Indexer) Release() {
+	i.encoders.put(i.Repository.GetLimitFileSize(), i.Encoder)
+	i.Encoder = nil
+}
+
+func (i *Indexer) submitCommit(ctx context.Context, c *git.Commit) error {
 	commit := i.BuildCommit(c)
 
+	if err := i.addChanges(ctx, c, commit); err != nil {
+		return fmt.Errorf("Commit %s, %s", c.Hash, err)
+	}
+
 	commitBody := make(map[string]interface{})
 
 	if i.separateIndexForCommits {
@@ -70,70 +199,455 @@ func (i *Indexer) submitCommit(c *git.Commit) error {
 	return nil
 }
 
-func (i *Indexer) submitRepoBlob(f *git.File, _, toCommit string) error {
-	blob, err := BuildBlob(f, i.Submitter.ParentID(), toCommit, "blob", i.Encoder)
+func (i *Indexer) submitRepoBlob(encoder *Encoder, f *git.File, fromCommit, toCommit string) error {
+	if f.IsSubmodule {
+		return i.submitGitlink(encoder, f, fromCommit, toCommit)
+	}
+
+	ignored := i.ignore != nil && i.ignore.ignored(f.Path)
+	if ignored && i.ignoreMode == IgnoreSkip {
+		return i.dropFile("blob", f)
+	}
+
+	file := f
+	if ignored {
+		file = filenameOnly(f)
+	}
+
+	blob, err := buildBlob(file, i.Submitter.ParentID(), toCommit, "blob", encoder, i.blobs, i.blobAttributes(f.Path))
 	if err != nil {
 		return fmt.Errorf("Blob %s: %s", f.Path, err)
 	}
 
+	if !ignored && i.ignore != nil && i.ignore.generated(f.Path, blob.Content) {
+		if i.ignoreMode == IgnoreSkip {
+			return i.dropFile("blob", f)
+		}
+
+		blob.Content = NoCodeContentMsgHolder
+		blob.Language = defaultLanguage
+	}
+
+	if i.symbols {
+		blob.Symbols = ExtractSymbols(blob.Language, blob.Content)
+	}
+
+	if i.separateIndexForBlobs {
+		blobBody, err := blob.ToMap()
+		if err != nil {
+			return fmt.Errorf("Blob %s: %s", f.Path, err)
+		}
+
+		return i.submitFile("blob", f, blob.ID, i.withPermissions(blobBody, true))
+	}
+
 	joinData := map[string]string{
 		"name":   "blob",
 		"parent": fmt.Sprintf("project_%v", i.Submitter.ParentID())}
 
-	i.Submitter.Index("blob", blob.ID, map[string]interface{}{"project_id": i.Submitter.ParentID(), "blob": blob, "type": "blob", "join_field": joinData})
-	return nil
+	return i.submitFile("blob", f, blob.ID, map[string]interface{}{"project_id": i.Submitter.ParentID(), "blob": blob, "type": "blob", "join_field": joinData})
 }
 
-func (i *Indexer) submitWikiBlob(f *git.File, _, toCommit string) error {
-	wikiBlob, err := BuildBlob(f, i.Submitter.ParentID(), toCommit, "wiki_blob", i.Encoder)
-	if err != nil {
-		return fmt.Errorf("WikiBlob %s: %s", f.Path, err)
+func (i *Indexer) submitGitlink(encoder *Encoder, f *git.File, _, toCommit string) error {
+	gitlink := BuildGitlink(f, i.Submitter.ParentID(), toCommit, encoder)
+
+	// Gitlinks are kept along with blobs
+	if i.separateIndexForBlobs {
+		gitlinkBody, err := gitlink.ToMap()
+		if err != nil {
+			return fmt.Errorf("Gitlink %s: %s", f.Path, err)
+		}
+
+		return i.submitFile("gitlink", f, gitlink.ID, i.withPermissions(gitlinkBody, true))
 	}
 
 	joinData := map[string]string{
-		"name":   "wiki_blob",
+		"name":   "gitlink",
 		"parent": fmt.Sprintf("project_%v", i.Submitter.ParentID())}
 
-	i.Submitter.Index("wiki_blob", wikiBlob.ID, map[string]interface{}{"project_id": i.Submitter.ParentID(), "blob": wikiBlob, "type": "wiki_blob", "join_field": joinData})
+	return i.submitFile("gitlink", f, gitlink.ID, map[string]interface{}{"project_id": i.Submitter.ParentID(), "gitlink": gitlink, "type": "gitlink", "join_field": joinData})
+}
+
+func (i *Indexer) submitWikiBlob(encoder *Encoder, f *git.File, _, toCommit string) error {
+	// Wikis have no use for submodules
+	if f.IsSubmodule {
+		return nil
+	}
+
+	wikiBlob, err := buildBlob(f, i.Submitter.ParentID(), toCommit, "wiki_blob", encoder, i.blobs, i.blobAttributes(f.Path))
+	if err != nil {
+		return fmt.Errorf("WikiBlob %s: %s", f.Path, err)
+	}
+
+	if !i.separateIndexForWikis {
+		joinData := map[string]string{
+			"name":   "wiki_blob",
+			"parent": fmt.Sprintf("project_%v", i.Submitter.ParentID())}
+
+		return i.submitFile("wiki_blob", f, wikiBlob.ID, map[string]interface{}{"project_id": i.Submitter.ParentID(), "blob": wikiBlob, "type": "wiki_blob", "join_field": joinData})
+	}
+
+	wikiBody, err := wikiBlob.ToMap()
+	if err != nil {
+		return fmt.Errorf("WikiBlob %s: %s", f.Path, err)
+	}
+
+	return i.submitFile("wiki_blob", f, wikiBlob.ID, i.withPermissions(wikiBody, false))
+}
+
+// withPermissions adds the project to the document of a separate index,
+// where there is no project to join, along with what permission checks
+// need. The repository access level only applies to repository documents.
+func (i *Indexer) withPermissions(body map[string]interface{}, repository bool) map[string]interface{} {
+	body["project_id"] = i.Submitter.ParentID()
+
+	if permissions := i.Submitter.ProjectPermissions(); permissions != nil {
+		body["visibility_level"] = permissions.VisibilityLevel
+		if repository {
+			body["repository_access_level"] = permissions.RepositoryAccessLevel
+		}
+	}
+
+	return body
+}
+
+// submitFile indexes the document of a file. With a ref, the document is
+// identified by the content of the file instead, the ref is added to it and
+// removed from the document of the blob the file replaces.
+func (i *Indexer) submitFile(documentType string, f *git.File, id string, body map[string]interface{}) error {
+	if i.ref == "" {
+		i.Submitter.Index(documentType, id, body)
+		return nil
+	}
+
+	submitter, err := i.refSubmitter()
+	if err != nil {
+		return err
+	}
+
+	body["refs"] = []string{i.ref}
+	submitter.IndexRef(documentType, i.refDocumentID(documentType, f.Path, f.Oid), i.ref, body)
+
+	if f.PreviousOid != "" && f.PreviousOid != f.Oid {
+		submitter.RemoveRef(documentType, i.refDocumentID(documentType, f.Path, f.PreviousOid), i.ref)
+	}
+
 	return nil
 }
 
-func (i *Indexer) removeBlob(path string) error {
-	blobID := GenerateBlobID(i.Submitter.ParentID(), path)
+// blobAttributes returns the attributes building the blob at path follows,
+// which are none without Options.Attributes
+func (i *Indexer) blobAttributes(path string) attributeValues {
+	if !i.applyAttributes {
+		return nil
+	}
+
+	return i.attributes.get(path)
+}
+
+// filenameOnly returns a copy of a file whose content isn't indexed
+func filenameOnly(f *git.File) *git.File {
+	file := *f
+	file.SkipTooLarge = true
 
-	i.Submitter.Remove("wiki_blob", blobID)
+	return &file
+}
+
+// dropFile is called instead of submitting a file that is ignored, whose
+// document may have been indexed before it was
+func (i *Indexer) dropFile(documentType string, f *git.File) error {
+	// Only the files replacing another one at their path may have been
+	// indexed, which is never the case of a run from scratch
+	if f.PreviousOid == "" {
+		return nil
+	}
+
+	if i.ref != "" {
+		submitter, err := i.refSubmitter()
+		if err != nil {
+			return err
+		}
+
+		submitter.RemoveRef(documentType, i.refDocumentID(documentType, f.Path, f.PreviousOid), i.ref)
+		return nil
+	}
+
+	i.Submitter.Remove(documentType, i.documentID(documentType, f.Path))
 	return nil
 }
 
-func (i *Indexer) indexCommits() error {
-	return i.Repository.EachCommit(i.submitCommit)
+// removeBlob removes the document of a deleted file from the documents of
+// blobType, which gitlinks share with repository blobs
+func (i *Indexer) removeBlob(blobType, path, oid string) error {
+	if i.ref == "" {
+		i.Submitter.Remove(blobType, i.documentID(blobType, path))
+		return nil
+	}
+
+	submitter, err := i.refSubmitter()
+	if err != nil {
+		return err
+	}
+
+	if oid == "" {
+		return fmt.Errorf("Blob %s: unknown object ID of the deleted file", path)
+	}
+
+	submitter.RemoveRef(blobType, i.refDocumentID(blobType, path, oid), i.ref)
+	return nil
+}
+
+// documentID returns the ID of the document of the file at path
+func (i *Indexer) documentID(documentType, path string) string {
+	if documentType == "wiki_blob" {
+		return GenerateWikiBlobID(i.Submitter.ParentID(), path)
+	}
+
+	return GenerateBlobID(i.Submitter.ParentID(), path)
+}
+
+// refDocumentID returns the ID of the document of the file at path, shared
+// between refs
+func (i *Indexer) refDocumentID(documentType, path, oid string) string {
+	if documentType == "wiki_blob" {
+		return GenerateRefWikiBlobID(i.Submitter.ParentID(), path, oid)
+	}
+
+	return GenerateRefBlobID(i.Submitter.ParentID(), path, oid)
 }
 
-func (i *Indexer) indexRepoBlobs() error {
-	return i.Repository.EachFileChange(i.submitRepoBlob, i.removeBlob)
+func (i *Indexer) refSubmitter() (RefSubmitter, error) {
+	submitter, ok := i.Submitter.(RefSubmitter)
+	if !ok {
+		return nil, fmt.Errorf("indexing ref %s: the submitter can't share documents between refs", i.ref)
+	}
+
+	return submitter, nil
+}
+
+func (i *Indexer) indexCommits(ctx context.Context) error {
+	var lastCommit string
+	if i.checkpoint != nil {
+		lastCommit = i.checkpoint.LastCommit
+	}
+
+	var count int64
+	skipping := lastCommit != ""
+
+	err := i.Repository.EachCommit(ctx, func(c *git.Commit) error {
+		metrics.CommitsTotal.Inc()
+
+		// Commits up to the checkpoint were flushed by a previous run
+		if skipping {
+			skipping = c.Hash != lastCommit
+			return nil
+		}
+
+		if err := i.submitCommit(ctx, c); err != nil {
+			return err
+		}
+
+		count++
+		if i.checkpoints != nil && count%i.checkpointInterval == 0 {
+			i.checkpoint.LastCommit = c.Hash
+			return i.saveCheckpoint(ctx)
+		}
+
+		return nil
+	})
+
+	if err == nil && skipping {
+		err = fmt.Errorf("Checkpoint commit %s not found, run without resuming", lastCommit)
+	}
+
+	return err
+}
+
+func (i *Indexer) indexRepoBlobs(ctx context.Context) error {
+	return i.eachFileChange(ctx, "blob", i.submitRepoBlob)
+}
+
+func (i *Indexer) indexWikiBlobs(ctx context.Context) error {
+	return i.eachFileChange(ctx, "wiki_blob", i.submitWikiBlob)
+}
+
+type submitBlobFunc func(encoder *Encoder, f *git.File, fromCommit, toCommit string) error
+
+// eachFileChange hands every change over to the pipeline, which builds and
+// submits the blobs on its workers
+func (i *Indexer) eachFileChange(ctx context.Context, blobType string, submit submitBlobFunc) error {
+	if i.checkpoint != nil && i.checkpoint.BlobsDone {
+		logkit.Info("Blobs were indexed by a previous run, skipping them")
+		return nil
+	}
+
+	p := newPipeline(ctx, i.concurrency, i.Repository.GetLimitFileSize(), i.Encoder, i.encoders)
+
+	var offset, resumeOffset int64
+	if i.checkpoint != nil {
+		resumeOffset = i.checkpoint.BlobOffset
+	}
+
+	// each skips the changes flushed by a previous run, and checkpoints
+	// every checkpointInterval changes
+	each := func(path string, job pipelineJob) error {
+		offset++
+
+		if offset < resumeOffset {
+			return nil
+		}
+
+		if offset == resumeOffset {
+			if path != i.checkpoint.LastPath {
+				return fmt.Errorf("Checkpoint expected %s as change %d but got %s, run without resuming", i.checkpoint.LastPath, offset, path)
+			}
+			return nil
+		}
+
+		if err := p.submit(path, job); err != nil {
+			return err
+		}
+
+		if i.checkpoints == nil || offset%i.checkpointInterval != 0 {
+			return nil
+		}
+
+		if err := p.wait(); err != nil {
+			return err
+		}
+
+		i.checkpoint.BlobOffset = offset
+		i.checkpoint.LastPath = path
+
+		return i.saveCheckpoint(ctx)
+	}
+
+	put := func(f *git.File, fromCommit, toCommit string) error {
+		metrics.FilesTotal.WithLabelValues("put").Inc()
+
+		if err := i.loadRules(ctx); err != nil {
+			return err
+		}
+
+		return each(f.Path, func(encoder *Encoder) error {
+			return submit(encoder, f, fromCommit, toCommit)
+		})
+	}
+
+	del := func(path, oid string) error {
+		metrics.FilesTotal.WithLabelValues("delete").Inc()
+
+		return each(path, func(_ *Encoder) error {
+			return i.removeBlob(blobType, path, oid)
+		})
+	}
+
+	// prefetch skips the blobs of the changes flushed by a previous run, the
+	// repository counting the changes before them as each does, the blobs in
+	// cache and those of ignored files, whose content is never read. Blobs
+	// evicted from the cache in the meantime are fetched when read.
+	prefetch := func(path, oid string, calls int64) bool {
+		if calls+1 <= resumeOffset || i.blobs.contains(oid) {
+			return false
+		}
+
+		// The rules are needed before the first call to put. Their error is
+		// returned by put.
+		if blobType != "blob" || i.loadRules(ctx) != nil {
+			return true
+		}
+
+		return i.ignore == nil || !i.ignore.ignored(path)
+	}
+
+	if prefetcher, ok := i.Repository.(git.BlobPrefetcher); ok {
+		prefetcher.SetPrefetchFilter(prefetch)
+		defer prefetcher.SetPrefetchFilter(nil)
+	}
+
+	// Skipped files are dropped according to the blob they replace
+	if tracker, ok := i.Repository.(git.PreviousOidTracker); ok && blobType == "blob" && i.ignoreMode == IgnoreSkip {
+		tracker.TrackPreviousOids()
+	}
+
+	err := i.Repository.EachFileChange(ctx, put, del)
+	if pipelineErr := p.close(); err == nil {
+		err = pipelineErr
+	}
+
+	if err == nil && offset < resumeOffset {
+		err = fmt.Errorf("Checkpoint expected %d changes but got %d, run without resuming", resumeOffset, offset)
+	}
+
+	if err == nil && i.checkpoints != nil {
+		i.checkpoint.BlobsDone = true
+		err = i.saveCheckpoint(ctx)
+	}
+
+	return err
 }
 
-func (i *Indexer) indexWikiBlobs() error {
-	return i.Repository.EachFileChange(i.submitWikiBlob, i.removeBlob)
+// loadRules reads the rules of the repository at ToHash: its .gitattributes
+// files with Options.Attributes or an IgnoreMode, which also reads its ignore
+// rules. Without a git.FileReader, only the heuristics of go-enry apply.
+func (i *Indexer) loadRules(ctx context.Context) error {
+	if i.rulesLoaded {
+		return nil
+	}
+
+	reader, _ := i.Repository.(git.FileReader)
+	if reader != nil && (i.applyAttributes || i.ignoreMode != IgnoreNone) {
+		attrs, err := loadAttributes(ctx, reader)
+		if err != nil {
+			return err
+		}
+		i.attributes = attrs
+	}
+
+	if i.ignoreMode != IgnoreNone {
+		rules, err := loadIgnoreRules(ctx, reader, i.attributes)
+		if err != nil {
+			return err
+		}
+		i.ignore = rules
+	}
+
+	i.rulesLoaded = true
+
+	return nil
 }
 
-func (i *Indexer) Flush() error {
-	return i.Submitter.Flush()
+func (i *Indexer) Flush(ctx context.Context) error {
+	defer metrics.StageTimer("flush").ObserveDuration()
+
+	return i.Submitter.Flush(ctx)
 }
 
-func (i *Indexer) IndexBlobs(blobType string) error {
+func (i *Indexer) IndexBlobs(ctx context.Context, blobType string) error {
+	defer metrics.StageTimer("blobs").ObserveDuration()
+
+	if err := i.startCheckpoint(ctx, blobType); err != nil {
+		return err
+	}
+
 	switch blobType {
 	case "blob":
-		return i.indexRepoBlobs()
+		return i.indexRepoBlobs(ctx)
 	case "wiki_blob":
-		return i.indexWikiBlobs()
+		return i.indexWikiBlobs(ctx)
 	}
 
 	return fmt.Errorf("unknown blob type: %v", blobType)
 }
 
-func (i *Indexer) IndexCommits() error {
-	if err := i.indexCommits(); err != nil {
+func (i *Indexer) IndexCommits(ctx context.Context) error {
+	defer metrics.StageTimer("commits").ObserveDuration()
+
+	if err := i.startCheckpoint(ctx, "blob"); err != nil {
+		return err
+	}
+
+	if err := i.indexCommits(ctx); err != nil {
 		logkit.WithError(err).Error("error while indexing commits")
 		return err
 	}
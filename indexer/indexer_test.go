@@ -1,17 +1,21 @@
 package indexer_test
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"path"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/require"
 
 	"gitlab.com/gitlab-org/gitlab-elasticsearch-indexer/git"
 	"gitlab.com/gitlab-org/gitlab-elasticsearch-indexer/indexer"
+	"gitlab.com/gitlab-org/gitlab-elasticsearch-indexer/metrics"
 )
 
 const (
@@ -28,6 +32,8 @@ func setupEncoder() *indexer.Encoder {
 }
 
 type fakeSubmitter struct {
+	mu sync.Mutex
+
 	flushed int
 
 	indexed      int
@@ -35,9 +41,15 @@ type fakeSubmitter struct {
 	indexedThing []interface{}
 
 	useSeparateIndexForCommits bool
+	useSeparateIndexForWikis   bool
+	useSeparateIndexForBlobs   bool
+
+	removed     int
+	removedID   []string
+	removedType []string
 
-	removed   int
-	removedID []string
+	// events records every Index and Remove call, in order
+	events []string
 }
 
 type fakeRepository struct {
@@ -58,26 +70,43 @@ func (f *fakeSubmitter) ProjectPermissions() *indexer.ProjectPermissions {
 }
 
 func (f *fakeSubmitter) Index(documentType, id string, thing interface{}) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.events = append(f.events, "index "+id)
 	f.indexed++
 	f.indexedID = append(f.indexedID, id)
 	f.indexedThing = append(f.indexedThing, thing)
 }
 
 func (f *fakeSubmitter) Remove(documentType, id string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.events = append(f.events, "remove "+id)
 	f.removed++
 	f.removedID = append(f.removedID, id)
+	f.removedType = append(f.removedType, documentType)
 }
 
 func (f *fakeSubmitter) UseSeparateIndexForCommits() bool {
 	return f.useSeparateIndexForCommits
 }
 
-func (f *fakeSubmitter) Flush() error {
+func (f *fakeSubmitter) UseSeparateIndexForWikis() bool {
+	return f.useSeparateIndexForWikis
+}
+
+func (f *fakeSubmitter) UseSeparateIndexForBlobs() bool {
+	return f.useSeparateIndexForBlobs
+}
+
+func (f *fakeSubmitter) Flush(ctx context.Context) error {
 	f.flushed++
 	return nil
 }
 
-func (r *fakeRepository) EachFileChange(put git.PutFunc, del git.DelFunc) error {
+func (r *fakeRepository) EachFileChange(ctx context.Context, put git.PutFunc, del git.DelFunc) error {
 	for _, file := range r.added {
 		if err := put(file, sha, sha); err != nil {
 			return err
@@ -91,7 +120,7 @@ func (r *fakeRepository) EachFileChange(put git.PutFunc, del git.DelFunc) error
 	}
 
 	for _, file := range r.removed {
-		if err := del(file.Path); err != nil {
+		if err := del(file.Path, file.Oid); err != nil {
 			return err
 		}
 	}
@@ -99,7 +128,7 @@ func (r *fakeRepository) EachFileChange(put git.PutFunc, del git.DelFunc) error
 	return nil
 }
 
-func (r *fakeRepository) EachCommit(f git.CommitFunc) error {
+func (r *fakeRepository) EachCommit(ctx context.Context, f git.CommitFunc) error {
 	for _, commit := range r.commits {
 		if err := f(commit); err != nil {
 			return err
@@ -112,6 +141,14 @@ func (r *fakeRepository) GetLimitFileSize() int64 {
 	return 1024 * 1024
 }
 
+func (r *fakeRepository) GetFromHash() string {
+	return git.NullTreeSHA
+}
+
+func (r *fakeRepository) GetToHash() string {
+	return sha
+}
+
 func setupIndexer(useSeparateIndexForCommits bool) (*indexer.Indexer, *fakeRepository, *fakeSubmitter) {
 	repo := &fakeRepository{}
 	submitter := &fakeSubmitter{
@@ -136,6 +173,14 @@ func gitFile(path, content string) *git.File {
 	}
 }
 
+func gitSubmodule(path, url string) *git.File {
+	file := gitFile(path, "")
+	file.IsSubmodule = true
+	file.SubmoduleURL = url
+
+	return file
+}
+
 func gitCommit(message string) *git.Commit {
 	return &git.Commit{
 		Author: git.Signature{
@@ -167,6 +212,19 @@ func validBlob(file *git.File, content, language string) *indexer.Blob {
 	}
 }
 
+func validGitlink(file *git.File) *indexer.Gitlink {
+	return &indexer.Gitlink{
+		Type:      "gitlink",
+		ID:        indexer.GenerateBlobID(parentID, file.Path),
+		RepoID:    parentIDString,
+		CommitSHA: sha,
+		Path:      file.Path,
+		Filename:  path.Base(file.Path),
+		SHA:       oid,
+		URL:       file.SubmoduleURL,
+	}
+}
+
 func validCommit(gitCommit *git.Commit) *indexer.Commit {
 	return &indexer.Commit{
 		Type:      "commit",
@@ -187,15 +245,15 @@ func validProjectPermissions() indexer.ProjectPermissions {
 }
 
 func index(idx *indexer.Indexer) error {
-	if err := idx.IndexBlobs("blob"); err != nil {
+	if err := idx.IndexBlobs(context.Background(), "blob"); err != nil {
 		return err
 	}
 
-	if err := idx.IndexCommits(); err != nil {
+	if err := idx.IndexCommits(context.Background()); err != nil {
 		return err
 	}
 
-	if err := idx.Flush(); err != nil {
+	if err := idx.Flush(context.Background()); err != nil {
 		return err
 	}
 
@@ -261,6 +319,26 @@ func TestIndex(t *testing.T) {
 	require.Equal(t, submit.flushed, 1)
 }
 
+func TestIndexRecordsMetrics(t *testing.T) {
+	idx, repo, _ := setupIndexer(false)
+
+	repo.commits = append(repo.commits, gitCommit("Initial commit"))
+	repo.added = append(repo.added, gitFile("foo/bar", "added file"))
+	repo.modified = append(repo.modified, gitFile("foo/baz", "modified file"))
+	repo.removed = append(repo.removed, gitFile("foo/qux", "removed file"))
+
+	puts := testutil.ToFloat64(metrics.FilesTotal.WithLabelValues("put"))
+	deletes := testutil.ToFloat64(metrics.FilesTotal.WithLabelValues("delete"))
+	commits := testutil.ToFloat64(metrics.CommitsTotal)
+
+	require.NoError(t, index(idx))
+
+	require.Equal(t, 2.0, testutil.ToFloat64(metrics.FilesTotal.WithLabelValues("put"))-puts)
+	require.Equal(t, 1.0, testutil.ToFloat64(metrics.FilesTotal.WithLabelValues("delete"))-deletes)
+	require.Equal(t, 1.0, testutil.ToFloat64(metrics.CommitsTotal)-commits)
+	require.Equal(t, 3, testutil.CollectAndCount(metrics.StageDuration))
+}
+
 func TestCommitIndex(t *testing.T) {
 	idx, repo, submit := setupIndexer(true)
 
@@ -303,3 +381,170 @@ func TestErrorIndexingSkipsRemainder(t *testing.T) {
 	require.Equal(t, submit.removed, 0)
 	require.Equal(t, submit.flushed, 0)
 }
+
+func TestIndexGitlinks(t *testing.T) {
+	idx, repo, submit := setupIndexer(false)
+
+	gitAdded := gitSubmodule("six", "git://github.com/randx/six.git")
+	gitRemoved := gitSubmodule("gitlab-grack", "")
+
+	repo.added = append(repo.added, gitAdded)
+	repo.removed = append(repo.removed, gitRemoved)
+
+	joinData := map[string]string{"name": "gitlink", "parent": "project_" + parentIDString}
+
+	require.NoError(t, index(idx))
+
+	require.Equal(t, 1, submit.indexed)
+	require.Equal(t, parentIDString+"_six", submit.indexedID[0])
+	require.Equal(t, map[string]interface{}{"project_id": parentID, "gitlink": validGitlink(gitAdded), "join_field": joinData, "type": "gitlink"}, submit.indexedThing[0])
+
+	require.Equal(t, 1, submit.removed)
+	require.Equal(t, parentIDString+"_gitlab-grack", submit.removedID[0])
+}
+
+func TestIndexWikiBlobsSkipsGitlinks(t *testing.T) {
+	idx, repo, submit := setupIndexer(false)
+
+	repo.added = append(repo.added, gitSubmodule("six", "git://github.com/randx/six.git"))
+
+	require.NoError(t, idx.IndexBlobs(context.Background(), "wiki_blob"))
+	require.Equal(t, 0, submit.indexed)
+}
+
+func TestIndexBlobsRemovesDocumentsOfBlobType(t *testing.T) {
+	for blobType, prefix := range map[string]string{
+		"blob":      parentIDString + "_",
+		"wiki_blob": "wiki_" + parentIDString + "_",
+	} {
+		idx, repo, submit := setupIndexer(false)
+
+		repo.added = append(repo.added, gitFile("added.md", "added file"))
+		repo.removed = append(repo.removed, gitFile("removed.md", "removed file"))
+
+		require.NoError(t, idx.IndexBlobs(context.Background(), blobType))
+
+		require.Equal(t, []string{prefix + "added.md"}, submit.indexedID, blobType)
+		require.Equal(t, []string{prefix + "removed.md"}, submit.removedID, blobType)
+		require.Equal(t, []string{blobType}, submit.removedType, blobType)
+	}
+}
+
+func TestIndexWikiBlobsInSeparateIndex(t *testing.T) {
+	idx, repo, submit := setupIndexer(false)
+	submit.useSeparateIndexForWikis = true
+	idx = indexer.NewIndexer(repo, submit)
+
+	repo.added = append(repo.added, gitFile("home.md", "# Home"))
+
+	require.NoError(t, idx.IndexBlobs(context.Background(), "wiki_blob"))
+	require.Equal(t, []string{"wiki_" + parentIDString + "_home.md"}, submit.indexedID)
+
+	require.Equal(t, map[string]interface{}{
+		"type":             "wiki_blob",
+		"project_id":       parentID,
+		"visibility_level": visibilityLevel,
+		"oid":              oid,
+		"rid":              "wiki_" + parentIDString,
+		"commit_sha":       sha,
+		"content":          "# Home",
+		"path":             "home.md",
+		"file_name":        "home.md",
+		"language":         "Markdown",
+	}, submit.indexedThing[0])
+}
+
+func TestIndexBlobsInSeparateIndex(t *testing.T) {
+	repo := &fakeRepository{}
+	submit := &fakeSubmitter{useSeparateIndexForBlobs: true}
+	idx := indexer.NewIndexer(repo, submit)
+
+	repo.added = append(repo.added, gitFile("foo/bar", "added file"), gitSubmodule("six", "git://github.com/randx/six.git"))
+
+	require.NoError(t, idx.IndexBlobs(context.Background(), "blob"))
+	require.Equal(t, []string{parentIDString + "_foo/bar", parentIDString + "_six"}, submit.indexedID)
+
+	require.Equal(t, map[string]interface{}{
+		"type":                    "blob",
+		"project_id":              parentID,
+		"visibility_level":        visibilityLevel,
+		"repository_access_level": repositoryAccessLevel,
+		"oid":                     oid,
+		"rid":                     parentIDString,
+		"commit_sha":              sha,
+		"content":                 "added file",
+		"path":                    "foo/bar",
+		"file_name":               "bar",
+		"language":                "Text",
+	}, submit.indexedThing[0])
+
+	gitlink := submit.indexedThing[1].(map[string]interface{})
+	require.Equal(t, "gitlink", gitlink["type"])
+	require.Equal(t, "git://github.com/randx/six.git", gitlink["url"])
+	require.Equal(t, parentID, gitlink["project_id"])
+	require.Equal(t, repositoryAccessLevel, gitlink["repository_access_level"])
+	require.NotContains(t, gitlink, "join_field")
+}
+
+// fakeRefSubmitter records IndexRef and RemoveRef calls as events
+type fakeRefSubmitter struct {
+	fakeSubmitter
+
+	refThing []interface{}
+}
+
+func (f *fakeRefSubmitter) IndexRef(documentType, id, ref string, thing interface{}) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.events = append(f.events, "index "+ref+" "+id)
+	f.refThing = append(f.refThing, thing)
+}
+
+func (f *fakeRefSubmitter) RemoveRef(documentType, id, ref string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.events = append(f.events, "remove "+ref+" "+id)
+}
+
+func TestIndexRef(t *testing.T) {
+	repo := &fakeRepository{}
+	submit := &fakeRefSubmitter{}
+	idx := indexer.NewIndexerWithOptions(repo, submit, indexer.Options{Ref: "refs/heads/release-1"})
+
+	const previousOid = "1111111111111111111111111111111111111111"
+
+	gitAdded := gitFile("foo/bar", "added")
+	gitModified := gitFile("foo/baz", "modified")
+	gitModified.PreviousOid = previousOid
+	gitRemoved := gitFile("foo/qux", "")
+
+	repo.added = append(repo.added, gitAdded)
+	repo.modified = append(repo.modified, gitModified)
+	repo.removed = append(repo.removed, gitRemoved)
+
+	require.NoError(t, idx.IndexBlobs(context.Background(), "blob"))
+
+	require.Equal(t, []string{
+		"index refs/heads/release-1 " + parentIDString + "_" + oid + "_foo/bar",
+		"index refs/heads/release-1 " + parentIDString + "_" + oid + "_foo/baz",
+		"remove refs/heads/release-1 " + parentIDString + "_" + previousOid + "_foo/baz",
+		"remove refs/heads/release-1 " + parentIDString + "_" + oid + "_foo/qux",
+	}, submit.events)
+	require.Equal(t, 0, submit.indexed)
+	require.Equal(t, 0, submit.removed)
+
+	body := submit.refThing[0].(map[string]interface{})
+	require.Equal(t, []string{"refs/heads/release-1"}, body["refs"])
+	require.Equal(t, validBlob(gitAdded, "added", "Text"), body["blob"])
+}
+
+func TestIndexRefRequiresRefSubmitter(t *testing.T) {
+	repo := &fakeRepository{}
+	idx := indexer.NewIndexerWithOptions(repo, &fakeSubmitter{}, indexer.Options{Ref: "refs/heads/main"})
+
+	repo.added = append(repo.added, gitFile("foo/bar", "added"))
+
+	require.EqualError(t, idx.IndexBlobs(context.Background(), "blob"), "indexing ref refs/heads/main: the submitter can't share documents between refs")
+}
@@ -0,0 +1,129 @@
+package indexer
+
+import (
+	"path"
+	"regexp"
+	"strings"
+)
+
+// pattern is a path pattern as found in .gitignore and .gitattributes files,
+// relative to the directory of the file it comes from. Patterns without a
+// slash match the base name of files at any depth, the others match paths
+// relative to the directory. Wildcards don't match slashes, except for '**'
+// which matches any number of directories.
+type pattern struct {
+	dir    string
+	regexp *regexp.Regexp
+
+	// basename is set on patterns matching the base name of files
+	basename bool
+}
+
+// newPattern compiles a pattern found in a file of dir, which is empty for
+// the root of the repository
+func newPattern(dir, expr string) (*pattern, error) {
+	p := &pattern{dir: dir}
+
+	anchored := strings.HasPrefix(expr, "/")
+	expr = strings.TrimPrefix(expr, "/")
+
+	if !anchored && !strings.Contains(expr, "/") {
+		p.basename = true
+	}
+
+	re, err := regexp.Compile("^" + wildcardRegexp(expr) + "$")
+	if err != nil {
+		return nil, err
+	}
+	p.regexp = re
+
+	return p, nil
+}
+
+// match tells whether the pattern matches a path of the repository
+func (p *pattern) match(name string) bool {
+	if p.dir != "" {
+		if !strings.HasPrefix(name, p.dir+"/") {
+			return false
+		}
+		name = name[len(p.dir)+1:]
+	}
+
+	if p.basename {
+		name = path.Base(name)
+	}
+
+	return p.regexp.MatchString(name)
+}
+
+// wildcardRegexp translates a wildcard pattern to a regular expression
+func wildcardRegexp(expr string) string {
+	var re strings.Builder
+
+	for i := 0; i < len(expr); i++ {
+		c := expr[i]
+
+		switch {
+		case c == '*' && strings.HasPrefix(expr[i:], "**") && (i == 0 || expr[i-1] == '/'):
+			rest := expr[i+2:]
+			switch {
+			case rest == "":
+				// Trailing '**' matches everything inside
+				re.WriteString(".*")
+				i++
+			case strings.HasPrefix(rest, "/"):
+				// '**/' matches zero or more directories
+				re.WriteString("(?:.*/)?")
+				i += 2
+			default:
+				re.WriteString("[^/]*")
+				i++
+			}
+		case c == '*':
+			re.WriteString("[^/]*")
+		case c == '?':
+			re.WriteString("[^/]")
+		case c == '[':
+			end := classEnd(expr, i)
+			if end < 0 {
+				re.WriteString(`\[`)
+				continue
+			}
+
+			class := expr[i+1 : end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			re.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i = end
+		case c == '\\' && i+1 < len(expr):
+			i++
+			re.WriteString(regexp.QuoteMeta(string(expr[i])))
+		default:
+			re.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+
+	return re.String()
+}
+
+// classEnd returns the index of the bracket closing the character class
+// opened at start, or -1 if there is none
+func classEnd(expr string, start int) int {
+	i := start + 1
+	if i < len(expr) && expr[i] == '!' {
+		i++
+	}
+	// A closing bracket right after the opening one is part of the class
+	if i < len(expr) && expr[i] == ']' {
+		i++
+	}
+
+	for ; i < len(expr); i++ {
+		if expr[i] == ']' {
+			return i
+		}
+	}
+
+	return -1
+}
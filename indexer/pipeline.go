@@ -0,0 +1,147 @@
+package indexer
+
+import (
+	"context"
+	"hash/fnv"
+	"sync"
+)
+
+// pipelineJob runs on a worker, with the worker's own Encoder since ICU
+// converters are not safe for concurrent use
+type pipelineJob func(encoder *Encoder) error
+
+// pipeline runs blob jobs on a bounded pool of workers. Jobs for the same
+// path always go to the same worker, so a delete followed by a put of that
+// path can't be reordered. The first error stops the pipeline: later
+// submissions fail with it and queued jobs are dropped. The same goes
+// once ctx is done.
+//
+// A pipeline without workers runs every job inline, as it is submitted.
+type pipeline struct {
+	ctx     context.Context
+	encoder *Encoder
+	workers []chan pipelineJob
+
+	// encoders provides the Encoders of the workers, which are given back
+	// once they stop
+	encoders      *EncoderPool
+	limitFileSize int64
+
+	wg      sync.WaitGroup
+	pending sync.WaitGroup
+
+	failed  chan struct{}
+	errOnce sync.Once
+	err     error
+}
+
+func newPipeline(ctx context.Context, concurrency int, limitFileSize int64, encoder *Encoder, encoders *EncoderPool) *pipeline {
+	p := &pipeline{
+		ctx:           ctx,
+		encoder:       encoder,
+		encoders:      encoders,
+		limitFileSize: limitFileSize,
+		failed:        make(chan struct{}),
+	}
+
+	if concurrency <= 1 {
+		return p
+	}
+
+	for n := 0; n < concurrency; n++ {
+		jobs := make(chan pipelineJob, 1)
+		p.workers = append(p.workers, jobs)
+
+		p.wg.Add(1)
+		go p.work(jobs, encoders.get(limitFileSize))
+	}
+
+	return p
+}
+
+func (p *pipeline) work(jobs <-chan pipelineJob, encoder *Encoder) {
+	defer p.wg.Done()
+	defer p.encoders.put(p.limitFileSize, encoder)
+
+	for job := range jobs {
+		if !p.stopped() {
+			if err := job(encoder); err != nil {
+				p.fail(err)
+			}
+		}
+
+		p.pending.Done()
+	}
+}
+
+func (p *pipeline) fail(err error) {
+	p.errOnce.Do(func() {
+		p.err = err
+		close(p.failed)
+	})
+}
+
+func (p *pipeline) stopped() bool {
+	select {
+	case <-p.failed:
+		return true
+	case <-p.ctx.Done():
+		return true
+	default:
+		return false
+	}
+}
+
+func (p *pipeline) submit(path string, job pipelineJob) error {
+	if err := p.ctx.Err(); err != nil {
+		return err
+	}
+
+	if len(p.workers) == 0 {
+		return job(p.encoder)
+	}
+
+	hash := fnv.New32a()
+	hash.Write([]byte(path))
+	worker := p.workers[hash.Sum32()%uint32(len(p.workers))]
+
+	p.pending.Add(1)
+
+	select {
+	case worker <- job:
+		return nil
+	case <-p.failed:
+		p.pending.Done()
+		return p.err
+	case <-p.ctx.Done():
+		p.pending.Done()
+		return p.ctx.Err()
+	}
+}
+
+// wait blocks until every job submitted so far has run, and returns the
+// same error close would
+func (p *pipeline) wait() error {
+	p.pending.Wait()
+
+	return p.result()
+}
+
+// close waits for all the submitted jobs and returns the first error any of
+// them failed with, or the context's error if jobs may have been dropped
+func (p *pipeline) close() error {
+	for _, worker := range p.workers {
+		close(worker)
+	}
+	p.wg.Wait()
+
+	return p.result()
+}
+
+func (p *pipeline) result() error {
+	if p.err == nil && len(p.workers) > 0 {
+		return p.ctx.Err()
+	}
+
+	return p.err
+}
@@ -0,0 +1,169 @@
+package indexer_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-elasticsearch-indexer/git"
+	"gitlab.com/gitlab-org/gitlab-elasticsearch-indexer/indexer"
+)
+
+type fakeChange struct {
+	file    *git.File
+	deleted bool
+}
+
+// orderedRepository yields its changes in the given order, so puts and
+// deletes of the same path can be interleaved
+type orderedRepository struct {
+	fakeRepository
+
+	changes []fakeChange
+
+	// prefetched are the paths the filter set by SetPrefetchFilter lets
+	// through, all of the changes being fetched ahead at once
+	filter     git.PrefetchFilter
+	prefetched []string
+}
+
+func (r *orderedRepository) SetPrefetchFilter(filter git.PrefetchFilter) {
+	r.filter = filter
+}
+
+func (r *orderedRepository) EachFileChange(ctx context.Context, put git.PutFunc, del git.DelFunc) error {
+	for n, change := range r.changes {
+		if r.filter != nil && !change.deleted && r.filter(change.file.Path, change.file.Oid, int64(n)) {
+			r.prefetched = append(r.prefetched, change.file.Path)
+		}
+	}
+
+	for _, change := range r.changes {
+		var err error
+		if change.deleted {
+			err = del(change.file.Path, change.file.Oid)
+		} else {
+			err = put(change.file, sha, sha)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func setupConcurrentIndexer(concurrency int) (*indexer.Indexer, *orderedRepository, *fakeSubmitter) {
+	repo := &orderedRepository{}
+	submitter := &fakeSubmitter{}
+
+	return indexer.NewIndexerWithOptions(repo, submitter, indexer.Options{Concurrency: concurrency}), repo, submitter
+}
+
+func TestConcurrentIndexKeepsOrderPerPath(t *testing.T) {
+	idx, repo, submit := setupConcurrentIndexer(4)
+
+	for n := 0; n < 100; n++ {
+		file := gitFile(fmt.Sprintf("dir/file-%d.txt", n), "content")
+		repo.changes = append(repo.changes, fakeChange{file: file, deleted: true}, fakeChange{file: file})
+	}
+
+	require.NoError(t, idx.IndexBlobs(context.Background(), "blob"))
+	require.Equal(t, 100, submit.indexed)
+	require.Equal(t, 100, submit.removed)
+
+	position := make(map[string]int)
+	for n, event := range submit.events {
+		position[event] = n
+	}
+
+	for n := 0; n < 100; n++ {
+		id := indexer.GenerateBlobID(parentID, fmt.Sprintf("dir/file-%d.txt", n))
+		require.Less(t, position["remove "+id], position["index "+id], id)
+	}
+}
+
+func TestConcurrentIndexMatchesSerialIndex(t *testing.T) {
+	var files []*git.File
+	for n := 0; n < 20; n++ {
+		files = append(files, gitFile(fmt.Sprintf("file-%d.rb", n), fmt.Sprintf("puts %d", n)))
+	}
+
+	indexed := func(concurrency int) map[string]interface{} {
+		idx, repo, submit := setupConcurrentIndexer(concurrency)
+		for _, file := range files {
+			repo.changes = append(repo.changes, fakeChange{file: file})
+		}
+
+		require.NoError(t, idx.IndexBlobs(context.Background(), "blob"))
+
+		things := make(map[string]interface{})
+		for n, id := range submit.indexedID {
+			things[id] = submit.indexedThing[n]
+		}
+
+		return things
+	}
+
+	require.Equal(t, indexed(1), indexed(8))
+}
+
+func TestConcurrentIndexStopsOnError(t *testing.T) {
+	idx, repo, submit := setupConcurrentIndexer(2)
+
+	gitBreakingFile := gitFile("broken", "")
+	gitBreakingFile.Blob = readerFunc("", fmt.Errorf("Error"))
+	repo.changes = append(repo.changes, fakeChange{file: gitBreakingFile})
+
+	for n := 0; n < 1000; n++ {
+		repo.changes = append(repo.changes, fakeChange{file: gitFile(fmt.Sprintf("file-%d", n), "")})
+	}
+
+	err := idx.IndexBlobs(context.Background(), "blob")
+	require.EqualError(t, err, "Blob broken: Error")
+
+	// The remaining work is abandoned rather than waited for
+	require.Less(t, submit.indexed, 1000)
+	require.Equal(t, 0, submit.flushed)
+
+	require.NotContains(t, submit.indexedID, indexer.GenerateBlobID(parentID, "broken"))
+}
+
+func TestConcurrentIndexStopsWhenCanceled(t *testing.T) {
+	idx, repo, submit := setupConcurrentIndexer(2)
+
+	for n := 0; n < 10; n++ {
+		repo.changes = append(repo.changes, fakeChange{file: gitFile(fmt.Sprintf("file-%d", n), "")})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	require.Equal(t, context.Canceled, idx.IndexBlobs(ctx, "blob"))
+	require.Equal(t, 0, submit.indexed)
+}
+
+func TestConcurrentIndexersReuseEncoders(t *testing.T) {
+	encoders := indexer.NewEncoderPool()
+
+	index := func() *indexer.Encoder {
+		repo := &orderedRepository{}
+		for n := 0; n < 10; n++ {
+			repo.changes = append(repo.changes, fakeChange{file: gitFile(fmt.Sprintf("file-%d.rb", n), "puts 1")})
+		}
+
+		idx := indexer.NewIndexerWithOptions(repo, &fakeSubmitter{}, indexer.Options{Concurrency: 2, Encoders: encoders})
+		defer idx.Release()
+
+		require.NoError(t, idx.IndexBlobs(context.Background(), "blob"))
+
+		return idx.Encoder
+	}
+
+	first := index()
+	require.NotNil(t, first)
+	require.Same(t, first, index())
+}
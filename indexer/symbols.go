@@ -0,0 +1,211 @@
+package indexer
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"regexp"
+	"strings"
+)
+
+// maxSymbols bounds the symbols kept for a blob, so that large generated
+// files don't make huge documents
+const maxSymbols = 1000
+
+// Kinds of symbols
+const (
+	SymbolFunction = "function"
+	SymbolMethod   = "method"
+	SymbolType     = "type"
+	SymbolConstant = "constant"
+)
+
+// Symbol is a definition found in a blob, with the line it starts on
+type Symbol struct {
+	Name string `json:"name"`
+	Kind string `json:"kind"`
+	Line int    `json:"line"`
+}
+
+// ExtractSymbols returns the definitions found in content, for the
+// languages that are supported. Like ctags, it works on a best-effort basis
+// and doesn't require the content to be valid.
+func ExtractSymbols(language, content string) []Symbol {
+	if content == "" {
+		return nil
+	}
+
+	var symbols []Symbol
+
+	switch language {
+	case "Go":
+		symbols = goSymbols(content)
+	case "Ruby":
+		symbols = matchSymbols(content, rubySymbolPatterns, nil)
+	case "Python":
+		symbols = pythonSymbols(content)
+	case "JavaScript", "JSX", "TypeScript", "TSX":
+		symbols = matchSymbols(content, javaScriptSymbolPatterns, javaScriptKeywords)
+	}
+
+	if len(symbols) > maxSymbols {
+		symbols = symbols[:maxSymbols]
+	}
+
+	return symbols
+}
+
+func goSymbols(content string) []Symbol {
+	fset := token.NewFileSet()
+
+	// A partial syntax tree is returned along with syntax errors
+	file, _ := parser.ParseFile(fset, "", content, parser.SkipObjectResolution)
+	if file == nil {
+		return nil
+	}
+
+	var symbols []Symbol
+	add := func(name *ast.Ident, kind string) {
+		if name != nil && name.Name != "_" {
+			symbols = append(symbols, Symbol{Name: name.Name, Kind: kind, Line: fset.Position(name.Pos()).Line})
+		}
+	}
+
+	for _, decl := range file.Decls {
+		switch decl := decl.(type) {
+		case *ast.FuncDecl:
+			if decl.Recv != nil {
+				add(decl.Name, SymbolMethod)
+			} else {
+				add(decl.Name, SymbolFunction)
+			}
+		case *ast.GenDecl:
+			for _, spec := range decl.Specs {
+				switch spec := spec.(type) {
+				case *ast.TypeSpec:
+					add(spec.Name, SymbolType)
+				case *ast.ValueSpec:
+					if decl.Tok != token.CONST {
+						continue
+					}
+					for _, name := range spec.Names {
+						add(name, SymbolConstant)
+					}
+				}
+			}
+		}
+	}
+
+	return symbols
+}
+
+// symbolPattern matches a line defining a symbol, whose name is the last
+// capturing group
+type symbolPattern struct {
+	kind   string
+	regexp *regexp.Regexp
+}
+
+var (
+	rubySymbolPatterns = []symbolPattern{
+		{SymbolMethod, regexp.MustCompile(`^\s*def\s+(?:self\.)?([A-Za-z_]\w*[?!=]?)`)},
+		{SymbolType, regexp.MustCompile(`^\s*(?:class|module)\s+((?:[A-Z]\w*::)*[A-Z]\w*)`)},
+		{SymbolConstant, regexp.MustCompile(`^\s*([A-Z][A-Z0-9_]*)\s*=[^=~]`)},
+	}
+
+	javaScriptSymbolPatterns = []symbolPattern{
+		{SymbolFunction, regexp.MustCompile(`^\s*(?:export\s+)?(?:default\s+)?(?:async\s+)?function\s*\*?\s*([A-Za-z_$][\w$]*)`)},
+		{SymbolFunction, regexp.MustCompile(`^\s*(?:export\s+)?(?:const|let|var)\s+([A-Za-z_$][\w$]*)\s*(?::[^=]+)?=\s*(?:async\s+)?(?:function\b|(?:\([^)]*\)|[A-Za-z_$][\w$]*)\s*(?::[^=]+)?=>)`)},
+		{SymbolType, regexp.MustCompile(`^\s*(?:export\s+)?(?:default\s+)?(?:declare\s+)?(?:abstract\s+)?(?:class|interface|enum|type)\s+([A-Za-z_$][\w$]*)`)},
+		{SymbolConstant, regexp.MustCompile(`^\s*(?:export\s+)?const\s+([A-Z][A-Z0-9_]*)\s*(?::[^=]+)?=`)},
+		// Methods of class bodies and object literals start their line and
+		// have no parentheses in their parameters, unlike calls passing a
+		// callback such as `describe("x", () => {`
+		{SymbolMethod, regexp.MustCompile(`^\s+(?:(?:static|async|public|private|protected|readonly|override|get|set)\s+)*\*?([A-Za-z_$#][\w$]*)\s*\([^()]*\)\s*(?::[^{]+)?\{`)},
+	}
+
+	// javaScriptKeywords are followed by parentheses and braces like method
+	// definitions are
+	javaScriptKeywords = map[string]bool{
+		"if": true, "for": true, "while": true, "switch": true, "catch": true,
+		"function": true, "return": true, "with": true,
+	}
+)
+
+// matchSymbols returns the symbols of the lines matching patterns, the first
+// matching pattern winning
+func matchSymbols(content string, patterns []symbolPattern, keywords map[string]bool) []Symbol {
+	var symbols []Symbol
+
+	for n, line := range strings.Split(content, "\n") {
+		for _, p := range patterns {
+			match := p.regexp.FindStringSubmatch(line)
+			if match == nil {
+				continue
+			}
+
+			name := match[len(match)-1]
+			if keywords[name] {
+				break
+			}
+
+			symbols = append(symbols, Symbol{Name: name, Kind: p.kind, Line: n + 1})
+			break
+		}
+	}
+
+	return symbols
+}
+
+var (
+	pythonDefPattern      = regexp.MustCompile(`^(\s*)(?:async\s+)?def\s+([A-Za-z_]\w*)`)
+	pythonClassPattern    = regexp.MustCompile(`^(\s*)class\s+([A-Za-z_]\w*)`)
+	pythonConstantPattern = regexp.MustCompile(`^([A-Z][A-Z0-9_]*)\s*(?::[^=]+)?=[^=]`)
+)
+
+// pythonSymbols tells functions and methods apart from the indentation of
+// the blocks they're defined in
+func pythonSymbols(content string) []Symbol {
+	type block struct {
+		indent  int
+		isClass bool
+	}
+
+	var symbols []Symbol
+	var blocks []block
+
+	for n, line := range strings.Split(content, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+
+		indent := len(line) - len(strings.TrimLeft(line, " \t"))
+		for len(blocks) > 0 && blocks[len(blocks)-1].indent >= indent {
+			blocks = blocks[:len(blocks)-1]
+		}
+
+		if match := pythonClassPattern.FindStringSubmatch(line); match != nil {
+			symbols = append(symbols, Symbol{Name: match[2], Kind: SymbolType, Line: n + 1})
+			blocks = append(blocks, block{indent: indent, isClass: true})
+			continue
+		}
+
+		if match := pythonDefPattern.FindStringSubmatch(line); match != nil {
+			kind := SymbolFunction
+			if len(blocks) > 0 && blocks[len(blocks)-1].isClass {
+				kind = SymbolMethod
+			}
+
+			symbols = append(symbols, Symbol{Name: match[2], Kind: kind, Line: n + 1})
+			blocks = append(blocks, block{indent: indent})
+			continue
+		}
+
+		if match := pythonConstantPattern.FindStringSubmatch(line); match != nil {
+			symbols = append(symbols, Symbol{Name: match[1], Kind: SymbolConstant, Line: n + 1})
+		}
+	}
+
+	return symbols
+}
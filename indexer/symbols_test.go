@@ -0,0 +1,181 @@
+package indexer_test
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-elasticsearch-indexer/indexer"
+)
+
+func TestExtractSymbols(t *testing.T) {
+	for _, tc := range []struct {
+		language string
+		content  string
+		expected []indexer.Symbol
+	}{
+		{
+			language: "Go",
+			content: `package main
+
+const (
+	Version = "1.0"
+	_       = 0
+)
+
+var notASymbol = 1
+
+type Server struct{}
+
+func (s *Server) Serve() {}
+
+func main() {
+`,
+			expected: []indexer.Symbol{
+				{Name: "Version", Kind: indexer.SymbolConstant, Line: 4},
+				{Name: "Server", Kind: indexer.SymbolType, Line: 10},
+				{Name: "Serve", Kind: indexer.SymbolMethod, Line: 12},
+				{Name: "main", Kind: indexer.SymbolFunction, Line: 14},
+			},
+		},
+		{
+			language: "Ruby",
+			content: `module Gitlab
+  class Project::Repository
+    MAX_SIZE = 10
+
+    def self.find(id)
+    end
+
+    def empty?
+      MAX_SIZE == 0
+    end
+  end
+end
+`,
+			expected: []indexer.Symbol{
+				{Name: "Gitlab", Kind: indexer.SymbolType, Line: 1},
+				{Name: "Project::Repository", Kind: indexer.SymbolType, Line: 2},
+				{Name: "MAX_SIZE", Kind: indexer.SymbolConstant, Line: 3},
+				{Name: "find", Kind: indexer.SymbolMethod, Line: 5},
+				{Name: "empty?", Kind: indexer.SymbolMethod, Line: 8},
+			},
+		},
+		{
+			language: "TypeScript",
+			content: `export const MAX_SIZE: number = 10;
+
+export interface Options {}
+
+export default class Client {
+  async fetch(id: string): Promise<void> {
+    if (id) {
+    }
+  }
+}
+
+export async function search(query) {}
+
+const render = (props) => null;
+`,
+			expected: []indexer.Symbol{
+				{Name: "MAX_SIZE", Kind: indexer.SymbolConstant, Line: 1},
+				{Name: "Options", Kind: indexer.SymbolType, Line: 3},
+				{Name: "Client", Kind: indexer.SymbolType, Line: 5},
+				{Name: "fetch", Kind: indexer.SymbolMethod, Line: 6},
+				{Name: "search", Kind: indexer.SymbolFunction, Line: 12},
+				{Name: "render", Kind: indexer.SymbolFunction, Line: 14},
+			},
+		},
+		{
+			language: "JavaScript",
+			content: `const api = {
+  get(path) {
+    return fetch(path);
+  },
+};
+
+describe("api", () => {
+  beforeEach(function () {
+  });
+
+  it("gets", async () => {
+    api.get("/");
+  });
+});
+`,
+			expected: []indexer.Symbol{
+				{Name: "get", Kind: indexer.SymbolMethod, Line: 2},
+			},
+		},
+		{
+			language: "Python",
+			content: `TIMEOUT = 10
+
+class Client:
+    # Not a constant
+    RETRIES = 3
+
+    def fetch(self):
+        def parse(data):
+            pass
+
+async def main():
+    pass
+`,
+			expected: []indexer.Symbol{
+				{Name: "TIMEOUT", Kind: indexer.SymbolConstant, Line: 1},
+				{Name: "Client", Kind: indexer.SymbolType, Line: 3},
+				{Name: "fetch", Kind: indexer.SymbolMethod, Line: 7},
+				{Name: "parse", Kind: indexer.SymbolFunction, Line: 8},
+				{Name: "main", Kind: indexer.SymbolFunction, Line: 11},
+			},
+		},
+		{
+			language: "Markdown",
+			content:  "def main():\n",
+		},
+	} {
+		t.Run(tc.language, func(t *testing.T) {
+			require.Equal(t, tc.expected, indexer.ExtractSymbols(tc.language, tc.content))
+		})
+	}
+}
+
+func TestExtractSymbolsIsBounded(t *testing.T) {
+	var content strings.Builder
+	for n := 0; n < 2000; n++ {
+		fmt.Fprintf(&content, "def method_%d\nend\n", n)
+	}
+
+	symbols := indexer.ExtractSymbols("Ruby", content.String())
+	require.Len(t, symbols, 1000)
+	require.Equal(t, indexer.Symbol{Name: "method_999", Kind: indexer.SymbolMethod, Line: 1999}, symbols[999])
+}
+
+func TestIndexBlobsExtractsSymbols(t *testing.T) {
+	for _, enabled := range []bool{true, false} {
+		repo := &fakeRepository{}
+		submit := &fakeSubmitter{}
+		idx := indexer.NewIndexerWithOptions(repo, submit, indexer.Options{Symbols: enabled})
+
+		repo.added = append(repo.added,
+			gitFile("main.go", "package main\n\nfunc main() {}\n"),
+			gitFile("README.md", "# main\n"),
+		)
+
+		require.NoError(t, idx.IndexBlobs(context.Background(), "blob"))
+
+		blobs := indexedBlobs(submit)
+		require.Empty(t, blobs["README.md"].Symbols)
+
+		if enabled {
+			require.Equal(t, []indexer.Symbol{{Name: "main", Kind: indexer.SymbolFunction, Line: 3}}, blobs["main.go"].Symbols)
+		} else {
+			require.Empty(t, blobs["main.go"].Symbols)
+		}
+	}
+}
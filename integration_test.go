@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
@@ -22,6 +23,7 @@ import (
 
 var (
 	binary         = flag.String("binary", "./bin/gitlab-elasticsearch-indexer", "Path to `gitlab-elasticsearch-indexer` binary for integration tests")
+	localRepo      = flag.String("local-repo", "", "Path to a local clone of gitlab-test. When set, integration tests use the local git backend instead of Gitaly")
 	gitalyConnInfo *gitalyConnectionInfo
 )
 
@@ -81,6 +83,10 @@ func TestIndexingRenamesFiles(t *testing.T) {
 }
 
 func ensureGitalyRepository(t *testing.T) {
+	if *localRepo != "" {
+		return
+	}
+
 	conn, err := gitalyClient.Dial(gitalyConnInfo.Address, gitalyClient.DefaultDialOpts)
 	require.NoError(t, err)
 
@@ -104,7 +110,7 @@ func checkDeps(t *testing.T) {
 		t.Skip("ELASTIC_CONNECTION_INFO not set")
 	}
 
-	if os.Getenv("GITALY_CONNECTION_INFO") == "" {
+	if os.Getenv("GITALY_CONNECTION_INFO") == "" && *localRepo == "" {
 		t.Skip("GITALY_CONNECTION_INFO is not set")
 	}
 
@@ -159,6 +165,9 @@ func buildIndex(t *testing.T, working, separateIndexForCommits bool) (*elastic.C
 				require.NoError(t, err)
 			}
 		}
+
+		// Only created by successful runs
+		_ = client.DeleteIndex(client.StatusIndexName())
 	}
 }
 
@@ -181,7 +190,13 @@ func run(from, to string, args ...string) (error, string, string) {
 	var stdout bytes.Buffer
 	var stderr bytes.Buffer
 
-	arguments := append(args, projectIDString, testRepo)
+	repoPath := testRepo
+	if *localRepo != "" {
+		args = append(args, "--git-backend=local")
+		repoPath = *localRepo
+	}
+
+	arguments := append(args, projectIDString, repoPath)
 	cmd := exec.Command(*binary, arguments...)
 	cmd.Env = os.Environ()
 	cmd.Stdout = &stdout
@@ -223,6 +238,75 @@ func TestIndexingRemovesFiles(t *testing.T) {
 	require.Error(t, err)
 }
 
+func TestIndexingRecordsStatus(t *testing.T) {
+	checkDeps(t)
+	ensureGitalyRepository(t)
+	c, td := buildWorkingIndex(t, false)
+
+	defer td()
+
+	err, _, _ := run("", "19e2e9b4ef76b422ce1154af39a91323ccc57434")
+	require.NoError(t, err)
+
+	status, err := c.GetIndexStatus(context.Background(), "blob")
+	require.NoError(t, err)
+	require.Equal(t, "19e2e9b4ef76b422ce1154af39a91323ccc57434", status.LastCommit)
+	require.Equal(t, int64(projectID), status.ProjectID)
+}
+
+func TestIndexingWithoutCommitsRecordsNoStatus(t *testing.T) {
+	checkDeps(t)
+	ensureGitalyRepository(t)
+	c, td := buildWorkingIndex(t, false)
+
+	defer td()
+
+	err, _, _ := run("", "19e2e9b4ef76b422ce1154af39a91323ccc57434", "--skip-commits")
+	require.NoError(t, err)
+
+	status, err := c.GetIndexStatus(context.Background(), "blob")
+	require.NoError(t, err)
+	require.Nil(t, status)
+}
+
+func TestIndexingDryRun(t *testing.T) {
+	checkDeps(t)
+	ensureGitalyRepository(t)
+	c, td := buildWorkingIndex(t, false)
+
+	defer td()
+
+	err, stdout, stderr := run("", "19e2e9b4ef76b422ce1154af39a91323ccc57434", "--dry-run=-")
+	require.NoError(t, err)
+
+	// Only the bulk requests go to stdout
+	require.Contains(t, stdout, `{"index":{"_index":"`+c.IndexNameDefault+`","_id":"667_files/empty","routing":"project_667"}}`)
+	require.NotContains(t, stdout, "level=")
+	require.NotContains(t, stderr, `"_index"`)
+
+	// Nothing was sent to Elasticsearch
+	_, err = c.GetBlob("files/empty")
+	require.Error(t, err)
+}
+
+func TestReplayingDryRun(t *testing.T) {
+	checkDeps(t)
+	ensureGitalyRepository(t)
+	c, td := buildWorkingIndex(t, false)
+
+	defer td()
+
+	bulkFile := filepath.Join(t.TempDir(), "bulk.ndjson")
+	err, _, _ := run("", "19e2e9b4ef76b422ce1154af39a91323ccc57434", "--dry-run="+bulkFile)
+	require.NoError(t, err)
+
+	out, err := exec.Command(*binary, "replay", bulkFile).CombinedOutput()
+	require.NoError(t, err, string(out))
+
+	_, err = c.GetBlob("files/empty")
+	require.NoError(t, err)
+}
+
 func TestIndexingTimeout(t *testing.T) {
 	checkDeps(t)
 	ensureGitalyRepository(t)
@@ -235,6 +319,10 @@ func TestIndexingTimeout(t *testing.T) {
 	require.Error(t, err)
 	require.Regexp(t, `The process has timed out`, stdout)
 
+	var exitErr *exec.ExitError
+	require.ErrorAs(t, err, &exitErr)
+	require.Equal(t, 3, exitErr.ExitCode())
+
 	err, stdout, _ = run("", "e2c7507b72f55cc272bbd5fde5bfa46eb4aeeebf", "--timeout=100")
 
 	require.Error(t, err)
@@ -386,6 +474,27 @@ func TestIndexingGitlabTest(t *testing.T) {
 	require.Equal(t, projectIDString+"_Gemfile.zip", blob.Id)
 	require.Equal(t, "project_"+projectIDString, blob.Routing)
 
+	// Check that a submodule is indexed as a gitlink
+	gitlink, err := c.GetBlob("six")
+	require.NoError(t, err)
+	require.True(t, gitlink.Found)
+
+	data = make(map[string]interface{})
+	require.NoError(t, json.Unmarshal(gitlink.Source, &data))
+	require.Equal(
+		t,
+		map[string]interface{}{
+			"type":       "gitlink",
+			"path":       "six",
+			"file_name":  "six",
+			"rid":        projectIDString,
+			"commit_sha": headSHA,
+			"sha":        "409f37c4f05865e4fb208c771485f211a22c4c2d",
+			"url":        "git://github.com/randx/six.git",
+		},
+		data["gitlink"],
+	)
+
 	// Test that timezones are preserved
 	commit, err = c.GetCommit("498214de67004b1da3d820901307bed2a68a8ef6")
 	require.NoError(t, err)
@@ -460,10 +569,10 @@ func TestIndexingWikiBlobs(t *testing.T) {
 	require.Empty(t, commit)
 
 	// Check that blobs are indexed
-	blob, err := c.GetBlob("README.md")
+	blob, err := c.GetWikiBlob("README.md")
 	require.NoError(t, err)
 	require.True(t, blob.Found)
-	require.Equal(t, projectIDString+"_README.md", blob.Id)
+	require.Equal(t, "wiki_"+projectIDString+"_README.md", blob.Id)
 	require.Equal(t, "project_"+projectIDString, blob.Routing)
 
 	data := make(map[string]interface{})
@@ -1,20 +1,32 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"strconv"
 	"time"
 
+	"github.com/opentracing/opentracing-go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/push"
+	"github.com/sirupsen/logrus"
+
 	"gitlab.com/gitlab-org/gitlab-elasticsearch-indexer/elastic"
 	"gitlab.com/gitlab-org/gitlab-elasticsearch-indexer/git"
 	"gitlab.com/gitlab-org/gitlab-elasticsearch-indexer/indexer"
+	"gitlab.com/gitlab-org/gitlab-elasticsearch-indexer/server"
 	"gitlab.com/gitlab-org/labkit/correlation"
 	logkit "gitlab.com/gitlab-org/labkit/log"
+	"gitlab.com/gitlab-org/labkit/tracing"
 )
 
 var (
@@ -25,35 +37,93 @@ var (
 	repositoryAccessLevelFlag = flag.Int("repository-access-level", -1, "Project repository_access_level. Accepted values: 0, 10, 20")
 	projectPathFlag           = flag.String("project-path", "", "Project path")
 	timeoutOptionFlag         = flag.String("timeout", "", "The timeout of the process.  Empty string means no timeout. Accepted formats: '1s', '5m', '24h'")
+	gitBackendFlag            = flag.String("git-backend", "gitaly", "The backend to read the repository with. Accepted values: 'gitaly', 'local'")
+	blobConcurrencyFlag       = flag.Int("blob-concurrency", 1, "The number of blobs built concurrently")
+	blobCacheSizeFlag         = flag.Int64("blob-cache-size", indexer.DefaultBlobCacheSize, "The number of bytes of blob content kept so that files with the same content are only fetched and converted once. Zero disables the cache")
+	ignoreFlag                = flag.String("ignore", "", "What to do with the files listed in .gitlab-search-ignore, marked as vendored or generated in .gitattributes, or deemed so by go-enry. Empty string indexes them. Accepted values: 'skip', 'filename'")
+	attributesFlag            = flag.Bool("attributes", false, "Detect the language of blobs and whether they are binary following the linguist-language, linguist-detectable, binary and diff attributes of .gitattributes files")
+	symbolsFlag               = flag.Bool("symbols", false, "Extract the functions, methods, types and constants defined in Go, Ruby, JavaScript, TypeScript and Python blobs")
+	commitChangesFlag         = flag.Bool("commit-changes", false, "Add the files changed by commits, with the lines they add and delete, to commit documents")
+	commitDiffSizeFlag        = flag.Int64("commit-diff-size", 0, "The number of bytes of the patch of commits added to commit documents. Zero leaves the patch out")
+	incrementalFlag           = flag.Bool("incremental", false, "Index from the last commit recorded in the index status when FROM_SHA is not set")
+	resumeFlag                = flag.Bool("resume", false, "Skip the work recorded in the checkpoint of a previous run with the same FROM_SHA and TO_SHA")
+	checkpointStoreFlag       = flag.String("checkpoint-store", "", "Where to keep checkpoints. Empty string means no checkpoints. Accepted values: 'file', 'elasticsearch'")
+	checkpointFileFlag        = flag.String("checkpoint-file", "", "The file checkpoints are kept in with --checkpoint-store=file")
+	checkpointIntervalFlag    = flag.Int64("checkpoint-interval", indexer.DefaultCheckpointInterval, "The number of changes or commits between two checkpoints")
+	dryRunFlag                = flag.String("dry-run", "", "Write the bulk requests to the given file, or to stdout with '-', instead of sending them to Elasticsearch")
+	failureReportFlag         = flag.String("failure-report", "", "Write the documents Elasticsearch failed to index to the given file, as JSON")
+	metricsListenFlag         = flag.String("metrics-listen", "", "Expose Prometheus metrics on the given address, such as ':9236'")
+	metricsPushgatewayFlag    = flag.String("metrics-pushgateway", "", "Push Prometheus metrics to the pushgateway at the given URL when the process exits")
+	serverConcurrencyFlag     = flag.Int("server-concurrency", server.DefaultConcurrency, "The number of jobs run at the same time by serve")
+	batchConcurrencyFlag      = flag.Int("batch-concurrency", server.DefaultConcurrency, "The number of projects indexed at the same time by batch")
+	batchReportFlag           = flag.String("batch-report", "", "Write the outcome of every job of batch to the given file, as JSON")
+	refsFlag                  = flag.String("refs", "", "Index the refs matching the given comma-separated patterns, such as 'refs/heads/main,refs/heads/release-*', instead of a single commit")
+	shutdownTimeoutFlag       = flag.Duration("shutdown-timeout", 10*time.Second, "How long to keep flushing documents already submitted once the process times out or is interrupted. Zero abandons them")
 
 	// Overriden in the makefile
 	Version   = "dev"
 	BuildTime = ""
 
 	envCorrelationIDKey = "CORRELATION_ID"
+	serviceName         = "gitlab-elasticsearch-indexer"
 	Permissions         *indexer.ProjectPermissions
 )
 
+const (
+	// Exit codes telling a timeout and an interruption apart from errors,
+	// which exit with 1
+	exitCodeTimedOut    = 3
+	exitCodeInterrupted = 4
+)
+
 func main() {
-	closer, err := configureLogger()
+	flag.Parse()
+
+	// The dry run output must not be mixed up with logs
+	logOutput := "stdout"
+	if *dryRunFlag == "-" {
+		logOutput = "stderr"
+	}
+
+	closer, err := configureLogger(logOutput)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "error initializing logkit %v", err)
 		os.Exit(1)
 	}
 	defer closer.Close()
 
-	flag.Parse()
-
 	if *versionFlag {
 		fmt.Fprintf(os.Stdout, "%s %s (built at: %s)", os.Args[0], Version, BuildTime)
 		os.Exit(0)
 	}
 
+	startMetrics()
+	defer pushMetrics()
+
+	if _, err := indexer.ParseIgnoreMode(*ignoreFlag); err != nil {
+		logkit.WithError(err).Fatal("Error parsing --ignore")
+	}
+
 	args := flag.Args()
 
+	if len(args) > 0 && args[0] == "replay" {
+		replay(args[1:])
+		return
+	}
+
+	if len(args) > 0 && args[0] == "serve" {
+		serve(args[1:])
+		return
+	}
+
+	if len(args) > 0 && args[0] == "batch" {
+		batch(args[1:])
+		return
+	}
+
 	if len(args) != 2 {
 		error := errors.New("WrongArguments")
-		logkit.WithError(error).Fatalf("Usage: %s [ --version | [--blob-type=(blob|wiki_blob)] [--skip-commits] [--project-path=<project-path>] [--timeout=<timeout>] [--visbility-level=<visbility-level>] [--repository-access-level=<repository-access-level>] <project-id> <repo-path> ]", os.Args[0])
+		logkit.WithError(error).Fatalf("Usage: %s [ --version | [--blob-type=(blob|wiki_blob)] [--skip-commits] [--git-backend=(gitaly|local)] [--blob-concurrency=<blob-concurrency>] [--blob-cache-size=<bytes>] [--ignore=(skip|filename)] [--attributes] [--symbols] [--commit-changes] [--commit-diff-size=<bytes>] [--project-path=<project-path>] [--timeout=<timeout>] [--shutdown-timeout=<shutdown-timeout>] [--checkpoint-store=(file|elasticsearch)] [--checkpoint-file=<checkpoint-file>] [--checkpoint-interval=<checkpoint-interval>] [--resume] [--incremental] [--refs=<patterns>] [--dry-run=(<path>|-)] [--failure-report=<path>] [--metrics-listen=<address>] [--metrics-pushgateway=<url>] [--visbility-level=<visbility-level>] [--repository-access-level=<repository-access-level>] <project-id> <repo-path> | replay (<bulk-file>|-) | [--server-concurrency=<server-concurrency>] serve <listen-address> | [--batch-concurrency=<batch-concurrency>] [--batch-report=<path>] batch (<manifest>|-) ]", os.Args[0])
 	}
 
 	projectID, err := strconv.ParseInt(args[0], 10, 64)
@@ -71,10 +141,85 @@ func main() {
 	timeoutOption := *timeoutOptionFlag
 	correlationID := generateCorrelationID()
 
-	repo, err := git.NewGitalyClientFromEnv(repoPath, fromSHA, toSHA, correlationID, args[0], projectPath)
+	config, err := loadConfig(projectID, *dryRunFlag != "")
+	if err != nil {
+		logkit.WithError(err).WithField("projectID", projectID).Fatalf("Error loading config")
+	}
+
+	span, spanCtx, finishTracing := startTracing("index")
+	defer finishTracing()
+
+	span.SetTag("project_id", projectID)
+	span.SetTag("blob_type", blobType)
+
+	// esClient is nil on dry runs, which never contact Elasticsearch
+	var esClient *elastic.Client
+	var submitter indexer.Submitter
+
+	if *dryRunFlag != "" {
+		output, err := openDryRunOutput(*dryRunFlag)
+		if err != nil {
+			logkit.WithError(err).WithField("dryRun", *dryRunFlag).Fatal("Error opening dry run output")
+		}
+		defer output.Close()
+
+		submitter = elastic.NewDryRun(config, output)
+	} else {
+		esClient, err = elastic.NewClientWithContext(spanCtx, config, correlationID)
+		if err != nil {
+			logkit.WithError(err).Fatal("Error creating elastic client")
+		}
+
+		submitter = esClient
+	}
+
+	// Once the context is done no new work is fetched, see exitIfStopped. It
+	// also bounds opening the repository.
+	ctx, stop := signal.NotifyContext(spanCtx, syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	if timeoutOption != "" {
+		timeout, err := time.ParseDuration(timeoutOption)
+		if err != nil {
+			logkit.WithError(err).WithField("timeoutOption", timeoutOption).Fatalf("Error parsing timeout")
+		} else {
+			logkit.WithField("timeout", timeout).Info("Setting timeout")
+
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+	}
+
+	if *refsFlag != "" && (fromSHA != "" || toSHA != "" || *incrementalFlag || *checkpointStoreFlag != "") {
+		logkit.WithError(errors.New("WrongArguments")).Fatal("--refs can't be used with FROM_SHA, TO_SHA, --incremental or --checkpoint-store")
+	}
+
+	if fromSHA == "" && *incrementalFlag {
+		if esClient == nil {
+			logkit.WithError(errors.New("WrongArguments")).Fatal("--incremental can't be used with --dry-run")
+		}
+
+		fromSHA = lastIndexedSHA(ctx, esClient, blobType)
+	}
+
+	// indexRefs takes care of the wikis of refs, whose status differs
+	if blobType == "wiki_blob" && esClient != nil && *refsFlag == "" {
+		fromScratch, err := removeLegacyWikiBlobs(ctx, esClient)
+		if err != nil {
+			logkit.WithError(err).Fatal("Error removing legacy wiki blobs")
+		}
+
+		if fromScratch {
+			fromSHA = ""
+		}
+	}
+
+	repo, err := newRepository(ctx, *gitBackendFlag, repoPath, fromSHA, toSHA, correlationID, args[0], projectPath)
 	if err != nil {
 		logkit.WithFields(
 			logkit.Fields{
+				"gitBackend":    *gitBackendFlag,
 				"repoPath":      repoPath,
 				"fromSHA":       fromSHA,
 				"toSHA":         toSHA,
@@ -82,62 +227,354 @@ func main() {
 				"projectID":     args[0],
 				"projectPath":   projectPath,
 			},
-		).WithError(err).Fatal("Error creating gitaly client")
+		).WithError(err).Fatal("Error creating git client")
 	}
+	defer repo.Close()
 
-	config, err := loadConfig(projectID)
-	if err != nil {
-		logkit.WithError(err).WithField("projectID", projectID).Fatalf("Error loading config")
+	span.SetTag("from_sha", repo.GetFromHash())
+	span.SetTag("to_sha", repo.GetToHash())
+
+	if *refsFlag != "" {
+		indexRefs(ctx, repo, submitter, esClient, blobType, skipCommits)
+		return
 	}
 
-	esClient, err := elastic.NewClient(config, correlationID)
+	checkpoints, err := newCheckpointStore(*checkpointStoreFlag, *checkpointFileFlag, esClient, blobType)
 	if err != nil {
-		logkit.WithError(err).Fatal("Error creating elastic client")
+		logkit.WithError(err).WithField("checkpointStore", *checkpointStoreFlag).Fatal("Error creating checkpoint store")
 	}
 
-	if timeoutOption != "" {
-		timeout, err := time.ParseDuration(timeoutOption)
-		if err != nil {
-			logkit.WithError(err).WithField("timeoutOption", timeoutOption).Fatalf("Error parsing timeout")
-		} else {
-			logkit.WithField("timeout", timeout).Info("Setting timeout")
-
-			time.AfterFunc(timeout, func() {
-				error := errors.New("TimedOut")
-				logkit.WithError(error).WithField("timeout", timeout).Fatalf("The process has timed out")
-			})
-		}
+	if *resumeFlag && checkpoints == nil {
+		logkit.WithError(errors.New("WrongArguments")).Fatal("--resume requires a --checkpoint-store")
 	}
 
-	idx := indexer.NewIndexer(repo, esClient)
+	idx := indexer.NewIndexerWithOptions(repo, submitter, indexer.Options{
+		Concurrency:        *blobConcurrencyFlag,
+		Checkpoints:        checkpoints,
+		CheckpointInterval: *checkpointIntervalFlag,
+		Resume:             *resumeFlag,
+		BlobCache:          indexer.NewBlobCache(*blobCacheSizeFlag),
+		Ignore:             indexer.IgnoreMode(*ignoreFlag),
+		Attributes:         *attributesFlag,
+		Symbols:            *symbolsFlag,
+		CommitChanges:      *commitChangesFlag,
+		CommitDiffSize:     *commitDiffSizeFlag,
+	})
 
 	logkit.WithFields(
 		logkit.Fields{
-			"IndexNameDefault": esClient.IndexNameDefault,
-			"IndexNameCommits": esClient.IndexNameCommits,
-			"projectID":        esClient.ParentID(),
+			"IndexNameDefault": config.IndexNameDefault,
+			"IndexNameCommits": config.IndexNameCommits,
+			"IndexNameWikis":   config.IndexNameWikis,
+			"IndexNameBlobs":   config.IndexNameBlobs,
+			"IndexNames":       config.IndexNames,
+			"projectID":        submitter.ParentID(),
+			"dryRun":           *dryRunFlag,
 			"blobType":         blobType,
 			"skipCommits":      skipCommits,
+			"blobConcurrency":  *blobConcurrencyFlag,
+			"checkpointStore":  *checkpointStoreFlag,
+			"resume":           *resumeFlag,
 			"Permissions":      config.Permissions,
 		},
-	).Debugf("Indexing from %s to %s", repo.FromHash, repo.ToHash)
+	).Debugf("Indexing from %s to %s", repo.GetFromHash(), repo.GetToHash())
 
-	if err := idx.IndexBlobs(blobType); err != nil {
+	if err := idx.IndexBlobs(ctx, blobType); err != nil {
+		exitIfStopped(ctx, idx, esClient)
 		logkit.WithError(err).Fatalln("Indexing error")
 	}
 
 	if !skipCommits && blobType == "blob" {
-		if err := idx.IndexCommits(); err != nil {
+		if err := idx.IndexCommits(ctx); err != nil {
+			exitIfStopped(ctx, idx, esClient)
 			logkit.WithError(err).Fatalln("Indexing error")
 		}
 	}
 
-	if err := idx.Flush(); err != nil {
-		logkit.WithError(err).Fatalln("Flushing error")
+	if err := idx.Flush(ctx); err != nil {
+		exitIfStopped(ctx, idx, esClient)
+		logkit.WithFields(reportFailures(esClient)).WithError(err).Fatalln("Flushing error")
+	}
+
+	reportFailures(esClient)
+
+	if esClient != nil && recordsIndexStatus(blobType, skipCommits) {
+		if err := esClient.SetIndexStatus(ctx, blobType, repo.GetToHash(), Version); err != nil {
+			logkit.WithError(err).Error("Error writing index status")
+		}
+	}
+
+	if err := idx.ClearCheckpoint(ctx); err != nil {
+		logkit.WithError(err).Error("Error clearing checkpoint")
 	}
 }
 
-func configureLogger() (io.Closer, error) {
+// replay sends a bulk file, such as one written by --dry-run, to
+// Elasticsearch
+func replay(args []string) {
+	if len(args) != 1 {
+		error := errors.New("WrongArguments")
+		logkit.WithError(error).Fatalf("Usage: %s replay (<bulk-file>|-)", os.Args[0])
+	}
+
+	input := os.Stdin
+	if args[0] != "-" {
+		file, err := os.Open(args[0])
+		if err != nil {
+			logkit.WithError(err).WithField("bulkFile", args[0]).Fatal("Error opening bulk file")
+		}
+		defer file.Close()
+
+		input = file
+	}
+
+	config, err := elastic.ConfigFromEnv()
+	if err != nil {
+		logkit.WithError(err).Fatalf("Error loading config")
+	}
+
+	_, spanCtx, finishTracing := startTracing("replay")
+	defer finishTracing()
+
+	esClient, err := elastic.NewClientWithContext(spanCtx, config, generateCorrelationID())
+	if err != nil {
+		logkit.WithError(err).Fatal("Error creating elastic client")
+	}
+
+	ctx, stop := signal.NotifyContext(spanCtx, syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	count, err := esClient.Replay(ctx, input)
+	if err != nil {
+		logkit.WithFields(reportFailures(esClient)).WithError(err).WithField("requests", count).Fatal("Replay error")
+	}
+
+	reportFailures(esClient)
+	logkit.WithField("requests", count).Info("Replayed bulk file")
+}
+
+// reportFailures writes the documents Elasticsearch failed to index to
+// --failure-report, and returns log fields summarizing them
+func reportFailures(esClient *elastic.Client) logkit.Fields {
+	if esClient == nil {
+		return logkit.Fields{}
+	}
+
+	report := esClient.FailureReport()
+
+	if *failureReportFlag != "" {
+		if err := writeFailureReport(*failureReportFlag, report); err != nil {
+			logkit.WithError(err).WithField("failureReport", *failureReportFlag).Error("Error writing failure report")
+		}
+	}
+
+	return logkit.Fields{
+		"failedDocuments":  len(report.Failures),
+		"failedErrorTypes": report.ErrorTypes,
+	}
+}
+
+func writeFailureReport(path string, report *elastic.FailureReport) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	if err := report.Write(file); err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+// removeLegacyWikiBlobs removes the documents earlier versions indexed a wiki
+// with, which had the IDs of repository blobs, until the index status of the
+// wiki tells they're gone. It returns whether the wiki must then be indexed
+// from scratch, which a previous run may have removed the documents for.
+func removeLegacyWikiBlobs(ctx context.Context, esClient *elastic.Client) (bool, error) {
+	status, err := esClient.GetIndexStatus(ctx, "wiki_blob")
+	if err != nil {
+		return false, err
+	}
+
+	if status != nil && status.WikiBlobIDs {
+		return false, nil
+	}
+
+	count, err := esClient.RemoveLegacyWikiBlobs(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	logkit.WithField("documents", count).Info("Removed the wiki blobs indexed by earlier versions, indexing the wiki from scratch")
+
+	return true, nil
+}
+
+// recordsIndexStatus tells whether a run records the index status. The status
+// of repository blobs stands for their commits too, so it isn't recorded when
+// commits are skipped, or incremental runs would never index them.
+func recordsIndexStatus(blobType string, skipCommits bool) bool {
+	return blobType != "blob" || !skipCommits
+}
+
+// lastIndexedSHA returns the commit recorded by the last successful run, or
+// an empty string to index everything
+func lastIndexedSHA(ctx context.Context, esClient *elastic.Client, blobType string) string {
+	status, err := esClient.GetIndexStatus(ctx, blobType)
+	if err != nil {
+		logkit.WithError(err).Fatal("Error reading index status")
+	}
+
+	if status == nil {
+		logkit.WithField("blobType", blobType).Info("No index status found, indexing from scratch")
+		return ""
+	}
+
+	logkit.WithFields(
+		logkit.Fields{
+			"blobType":   blobType,
+			"lastCommit": status.LastCommit,
+			"indexedAt":  status.IndexedAt,
+		},
+	).Info("Indexing from the last indexed commit")
+
+	return status.LastCommit
+}
+
+// exitIfStopped exits when ctx was cancelled by the timeout or a signal.
+// Documents submitted so far are flushed for up to --shutdown-timeout, and
+// abandoned after that.
+func exitIfStopped(ctx context.Context, idx *indexer.Indexer, esClient *elastic.Client) {
+	if ctx.Err() == nil {
+		return
+	}
+
+	exitCode := exitCodeInterrupted
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		exitCode = exitCodeTimedOut
+		error := errors.New("TimedOut")
+		logkit.WithError(error).WithField("timeoutOption", *timeoutOptionFlag).Error("The process has timed out")
+	} else {
+		logkit.WithError(ctx.Err()).Error("The process was interrupted")
+	}
+
+	flushCtx, cancel := context.WithTimeout(context.Background(), *shutdownTimeoutFlag)
+	if err := idx.Flush(flushCtx); err != nil {
+		logkit.WithFields(reportFailures(esClient)).WithError(err).Error("Abandoning documents that were not flushed")
+	} else {
+		reportFailures(esClient)
+	}
+	cancel()
+
+	// Unlike os.Exit, this runs the handlers pushing metrics and flushing
+	// spans
+	logrus.Exit(exitCode)
+}
+
+// startMetrics exposes the metrics on --metrics-listen. Runs are usually
+// too short to be scraped, so the metrics are also pushed to
+// --metrics-pushgateway when the process exits, fatal errors included.
+func startMetrics() {
+	if *metricsListenFlag != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.Handler())
+
+		go func() {
+			err := http.ListenAndServe(*metricsListenFlag, mux)
+			logkit.WithError(err).WithField("metricsListen", *metricsListenFlag).Error("Metrics listener stopped")
+		}()
+	}
+
+	if *metricsPushgatewayFlag != "" {
+		logrus.RegisterExitHandler(pushMetrics)
+	}
+}
+
+func pushMetrics() {
+	if *metricsPushgatewayFlag == "" {
+		return
+	}
+
+	pusher := push.New(*metricsPushgatewayFlag, serviceName).Gatherer(prometheus.DefaultGatherer)
+	if hostname, err := os.Hostname(); err == nil {
+		pusher = pusher.Grouping("instance", hostname)
+	}
+
+	if err := pusher.Push(); err != nil {
+		logkit.WithError(err).WithField("metricsPushgateway", *metricsPushgatewayFlag).Error("Error pushing metrics")
+	}
+}
+
+// startTracing initializes tracing from `GITLAB_TRACING` and starts the span
+// of the whole run. The returned function finishes the span and flushes it,
+// and also runs when the process exits on a fatal error.
+func startTracing(operationName string) (opentracing.Span, context.Context, func()) {
+	closer := tracing.Initialize(tracing.WithServiceName(serviceName))
+	span, ctx := opentracing.StartSpanFromContext(context.Background(), operationName)
+
+	finish := func() {
+		span.Finish()
+		closer.Close()
+	}
+	logrus.RegisterExitHandler(finish)
+
+	return span, ctx, finish
+}
+
+type repository interface {
+	git.RefRepository
+	Close()
+}
+
+func newRepository(ctx context.Context, backend, repoPath, fromSHA, toSHA, correlationID, projectID, projectPath string) (repository, error) {
+	switch backend {
+	case "gitaly":
+		return git.NewGitalyClientFromEnv(ctx, repoPath, fromSHA, toSHA, correlationID, projectID, projectPath)
+	case "local":
+		return git.NewLocalClientFromEnv(ctx, repoPath, fromSHA, toSHA)
+	}
+
+	return nil, fmt.Errorf("unknown git backend: %v", backend)
+}
+
+func newCheckpointStore(store, checkpointFile string, esClient *elastic.Client, blobType string) (indexer.CheckpointStore, error) {
+	switch store {
+	case "":
+		return nil, nil
+	case "file":
+		if checkpointFile == "" {
+			return nil, errors.New("--checkpoint-file is required")
+		}
+		return indexer.NewFileCheckpointStore(checkpointFile), nil
+	case "elasticsearch":
+		if esClient == nil {
+			return nil, errors.New("not available with --dry-run")
+		}
+		return esClient.NewCheckpointStore(blobType), nil
+	}
+
+	return nil, fmt.Errorf("unknown checkpoint store: %v", store)
+}
+
+func openDryRunOutput(path string) (io.WriteCloser, error) {
+	if path == "-" {
+		return nopWriteCloser{os.Stdout}, nil
+	}
+
+	return os.Create(path)
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+func configureLogger(output string) (io.Closer, error) {
 	_, debug := os.LookupEnv("DEBUG")
 
 	level := "info"
@@ -148,12 +585,23 @@ func configureLogger() (io.Closer, error) {
 	return logkit.Initialize(
 		logkit.WithLogLevel(level),
 		logkit.WithFormatter("text"),
-		logkit.WithOutputName("stdout"),
+		logkit.WithOutputName(output),
 	)
 }
 
-func loadConfig(projectID int64) (*elastic.Config, error) {
-	config, err := elastic.ConfigFromEnv()
+func loadConfig(projectID int64, dryRun bool) (*elastic.Config, error) {
+	var config *elastic.Config
+	var err error
+
+	if dryRun {
+		config, err = elastic.DryRunConfigFromEnv()
+	} else {
+		config, err = elastic.ConfigFromEnv()
+	}
+	if err != nil {
+		return nil, err
+	}
+
 	config.Permissions = generateProjectPermissions()
 	config.ProjectID = projectID
 
@@ -0,0 +1,98 @@
+// Package metrics holds the Prometheus metrics of the indexer. They are
+// registered with the default registry, which is exposed by
+// --metrics-listen or pushed to a pushgateway by --metrics-pushgateway.
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const namespace = "gitlab_elasticsearch_indexer"
+
+var (
+	// FilesTotal counts the files yielded by EachFileChange, by action: put
+	// or delete
+	FilesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "files_total",
+		Help:      "Number of changed files processed, by action",
+	}, []string{"action"})
+
+	CommitsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "commits_total",
+		Help:      "Number of commits processed",
+	})
+
+	BlobBytesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "blob_bytes_total",
+		Help:      "Number of blob bytes fetched from the repository",
+	})
+
+	BulkRequestsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "bulk_requests_total",
+		Help:      "Number of bulk requests sent to Elasticsearch",
+	})
+
+	BulkBytesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "bulk_bytes_total",
+		Help:      "Number of bytes sent to Elasticsearch in bulk requests",
+	})
+
+	BulkRequestDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "bulk_request_duration_seconds",
+		Help:      "Time taken by bulk requests, including the retries of the bulk processor",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 12),
+	})
+
+	// BulkFailuresTotal counts failures by kind: request when a whole bulk
+	// request failed, document when Elasticsearch rejected a document and
+	// retry when a document failed but is retried
+	BulkFailuresTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "bulk_failures_total",
+		Help:      "Number of bulk failures, by kind",
+	}, []string{"kind"})
+
+	// BlobCacheTotal counts the lookups of blobs in the cache of the
+	// indexer, by result: hit or miss
+	BlobCacheTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "blob_cache_total",
+		Help:      "Number of blob cache lookups, by result",
+	}, []string{"result"})
+
+	EncoderFallbacksTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "encoder_fallbacks_total",
+		Help:      "Number of strings or blobs that couldn't be converted to UTF-8 and were kept as they are",
+	})
+
+	// StageDuration observes the duration of each stage of a run: blobs,
+	// commits and flush
+	StageDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "stage_duration_seconds",
+		Help:      "Time taken by each stage of indexing",
+		Buckets:   prometheus.ExponentialBuckets(0.1, 4, 10),
+	}, []string{"stage"})
+
+	// JobsTotal counts the jobs run by the server, by final status:
+	// succeeded, failed or canceled
+	JobsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "jobs_total",
+		Help:      "Number of jobs run by the server, by status",
+	}, []string{"status"})
+)
+
+// StageTimer starts timing a stage, which is observed when ObserveDuration
+// is called on the returned timer
+func StageTimer(stage string) *prometheus.Timer {
+	return prometheus.NewTimer(StageDuration.WithLabelValues(stage))
+}
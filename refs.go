@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	"gitlab.com/gitlab-org/gitlab-elasticsearch-indexer/elastic"
+	"gitlab.com/gitlab-org/gitlab-elasticsearch-indexer/indexer"
+	logkit "gitlab.com/gitlab-org/labkit/log"
+)
+
+// indexRefs indexes the refs matching --refs one after the other, each from
+// the commit it was last indexed at. Blobs found in several refs are shared
+// by their documents, so refs are always indexed incrementally: this is how
+// the documents of the blobs a ref doesn't have anymore are found. Refs that
+// don't match anymore are removed from the documents.
+func indexRefs(ctx context.Context, repo repository, submitter indexer.Submitter, esClient *elastic.Client, blobType string, skipCommits bool) {
+	// Refs are only recorded in the index status, which dry runs can't read
+	indexed := make(map[string]string)
+	if esClient != nil {
+		var fromScratch bool
+		if blobType == "wiki_blob" {
+			var err error
+			fromScratch, err = removeLegacyWikiBlobs(ctx, esClient)
+			if err != nil {
+				logkit.WithError(err).Fatal("Error removing legacy wiki blobs")
+			}
+		}
+
+		status, err := esClient.GetIndexStatus(ctx, blobType)
+		if err != nil {
+			logkit.WithError(err).Fatal("Error reading index status")
+		}
+
+		if status != nil {
+			for name, commit := range status.Refs {
+				// Refs indexed from scratch are still removed if they don't
+				// match anymore
+				if fromScratch {
+					commit = ""
+				}
+				indexed[name] = commit
+			}
+		}
+	}
+
+	refs, err := repo.ListRefs(ctx, strings.Split(*refsFlag, ","))
+	if err != nil {
+		logkit.WithError(err).WithField("refs", *refsFlag).Fatal("Error listing refs")
+	}
+
+	matched := make(map[string]bool)
+
+	// Refs mostly have the same blobs
+	blobs := indexer.NewBlobCache(*blobCacheSizeFlag)
+
+	for _, ref := range refs {
+		matched[ref.Name] = true
+
+		if indexed[ref.Name] == ref.Target {
+			logkit.WithField("ref", ref.Name).Debug("Ref is already indexed")
+			continue
+		}
+
+		repo.SetRange(indexed[ref.Name], ref.Target)
+
+		idx := indexer.NewIndexerWithOptions(repo, submitter, indexer.Options{
+			Concurrency:    *blobConcurrencyFlag,
+			Ref:            ref.Name,
+			BlobCache:      blobs,
+			Ignore:         indexer.IgnoreMode(*ignoreFlag),
+			Attributes:     *attributesFlag,
+			Symbols:        *symbolsFlag,
+			CommitChanges:  *commitChangesFlag,
+			CommitDiffSize: *commitDiffSizeFlag,
+		})
+
+		logkit.WithField("ref", ref.Name).Debugf("Indexing from %s to %s", repo.GetFromHash(), repo.GetToHash())
+
+		if err := idx.IndexBlobs(ctx, blobType); err != nil {
+			exitIfStopped(ctx, idx, esClient)
+			logkit.WithError(err).WithField("ref", ref.Name).Fatalln("Indexing error")
+		}
+
+		if !skipCommits && blobType == "blob" {
+			if err := idx.IndexCommits(ctx); err != nil {
+				exitIfStopped(ctx, idx, esClient)
+				logkit.WithError(err).WithField("ref", ref.Name).Fatalln("Indexing error")
+			}
+		}
+
+		if err := idx.Flush(ctx); err != nil {
+			exitIfStopped(ctx, idx, esClient)
+			logkit.WithFields(reportFailures(esClient)).WithError(err).WithField("ref", ref.Name).Fatalln("Flushing error")
+		}
+
+		indexed[ref.Name] = ref.Target
+
+		if esClient != nil {
+			if err := esClient.SetRefsIndexStatus(ctx, blobType, indexed, Version); err != nil {
+				logkit.WithError(err).WithField("ref", ref.Name).Error("Error writing index status")
+			}
+		}
+	}
+
+	reportFailures(esClient)
+
+	if esClient == nil {
+		return
+	}
+
+	for name := range indexed {
+		if matched[name] {
+			continue
+		}
+
+		count, err := esClient.RemoveRefFromProject(ctx, blobType, name)
+		if err != nil {
+			logkit.WithError(err).WithField("ref", name).Error("Error removing ref")
+			continue
+		}
+
+		delete(indexed, name)
+		logkit.WithFields(logkit.Fields{"ref": name, "documents": count}).Info("Removed ref")
+
+		if err := esClient.SetRefsIndexStatus(ctx, blobType, indexed, Version); err != nil {
+			logkit.WithError(err).WithField("ref", name).Error("Error writing index status")
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	gitalyclient "gitlab.com/gitlab-org/gitaly/v14/client"
+	logkit "gitlab.com/gitlab-org/labkit/log"
+	"gitlab.com/gitlab-org/labkit/tracing"
+
+	"gitlab.com/gitlab-org/gitlab-elasticsearch-indexer/elastic"
+	"gitlab.com/gitlab-org/gitlab-elasticsearch-indexer/git"
+	"gitlab.com/gitlab-org/gitlab-elasticsearch-indexer/indexer"
+	"gitlab.com/gitlab-org/gitlab-elasticsearch-indexer/server"
+)
+
+// serverTokenEnv names the variable holding the token every request to the
+// server must be authenticated with
+const serverTokenEnv = "INDEXER_SERVER_TOKEN"
+
+// serve runs jobs submitted over HTTP until the process is interrupted,
+// sharing one Elasticsearch client, a pool of Gitaly connections and the
+// encoders of the indexers between them
+func serve(args []string) {
+	if len(args) != 1 {
+		error := errors.New("WrongArguments")
+		logkit.WithError(error).Fatalf("Usage: %s [--server-concurrency=<server-concurrency>] serve <listen-address>", os.Args[0])
+	}
+
+	token := os.Getenv(serverTokenEnv)
+	if token == "" {
+		error := errors.New("MissingToken")
+		logkit.WithError(error).Fatalf("%s must be set to the token authenticating requests", serverTokenEnv)
+	}
+
+	config, err := elastic.ConfigFromEnv()
+	if err != nil {
+		logkit.WithError(err).Fatalf("Error loading config")
+	}
+
+	// Every job has a span of its own
+	closer := tracing.Initialize(tracing.WithServiceName(serviceName))
+	defer closer.Close()
+
+	esClient, err := elastic.NewClient(config, generateCorrelationID())
+	if err != nil {
+		logkit.WithError(err).Fatal("Error creating elastic client")
+	}
+	defer esClient.Close()
+
+	pool := git.NewConnectionPool()
+	defer pool.Close()
+
+	encoders := indexer.NewEncoderPool()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	srv := server.New(ctx, func(ctx context.Context, request *server.JobRequest) (*server.JobResult, error) {
+		return runJob(ctx, esClient, pool, encoders, request)
+	}, server.Options{Concurrency: *serverConcurrencyFlag})
+
+	jobs := srv.Handler()
+	mux := http.NewServeMux()
+	mux.Handle("/jobs", jobs)
+	mux.Handle("/jobs/", jobs)
+	mux.Handle("/metrics", promhttp.Handler())
+
+	httpServer := &http.Server{Addr: args[0], Handler: server.RequireToken(token, mux)}
+
+	go func() {
+		<-ctx.Done()
+		logkit.Info("Shutting down, running jobs are stopped and queued ones canceled")
+
+		if err := httpServer.Shutdown(context.Background()); err != nil {
+			logkit.WithError(err).Error("Error shutting down the server")
+		}
+	}()
+
+	logkit.WithFields(
+		logkit.Fields{
+			"listen":      args[0],
+			"concurrency": *serverConcurrencyFlag,
+		},
+	).Info("Serving jobs")
+
+	if err := httpServer.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		logkit.WithError(err).WithField("listen", args[0]).Fatal("Error serving jobs")
+	}
+
+	srv.Wait()
+}
+
+// runJob indexes the repository of a job with a client of esClient for its
+// project, a Gitaly connection from pool and encoders from encoders
+func runJob(ctx context.Context, esClient *elastic.Client, pool *gitalyclient.Pool, encoders *indexer.EncoderPool, request *server.JobRequest) (*server.JobResult, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "index")
+	defer span.Finish()
+
+	span.SetTag("project_id", request.ProjectID)
+	span.SetTag("blob_type", request.BlobType)
+
+	projectClient, err := esClient.ForProject(ctx, request.ProjectID, request.Permissions())
+	if err != nil {
+		return nil, err
+	}
+	defer projectClient.Close()
+
+	if request.BlobType == "wiki_blob" {
+		fromScratch, err := removeLegacyWikiBlobs(ctx, projectClient)
+		if err != nil {
+			return nil, err
+		}
+
+		if fromScratch {
+			scratch := *request
+			scratch.FromSHA = ""
+			request = &scratch
+		}
+	}
+
+	repo, err := newPooledRepository(ctx, pool, request)
+	if err != nil {
+		return nil, err
+	}
+	defer repo.Close()
+
+	span.SetTag("from_sha", repo.GetFromHash())
+	span.SetTag("to_sha", repo.GetToHash())
+
+	result := &server.JobResult{FromSHA: repo.GetFromHash(), ToSHA: repo.GetToHash()}
+
+	idx := indexer.NewIndexerWithOptions(repo, projectClient, indexer.Options{
+		Concurrency:    *blobConcurrencyFlag,
+		BlobCache:      indexer.NewBlobCache(*blobCacheSizeFlag),
+		Ignore:         indexer.IgnoreMode(*ignoreFlag),
+		Attributes:     *attributesFlag,
+		Symbols:        *symbolsFlag,
+		CommitChanges:  *commitChangesFlag,
+		CommitDiffSize: *commitDiffSizeFlag,
+		Encoders:       encoders,
+	})
+	defer idx.Release()
+
+	err = indexRepository(ctx, idx, request)
+	if err != nil && ctx.Err() != nil {
+		// Documents submitted so far are flushed for up to
+		// --shutdown-timeout, as a single run does when it's stopped
+		flushCtx, cancel := context.WithTimeout(context.Background(), *shutdownTimeoutFlag)
+		if err := idx.Flush(flushCtx); err != nil {
+			logkit.WithError(err).WithField("projectID", request.ProjectID).Error("Abandoning documents that were not flushed")
+		}
+		cancel()
+	}
+
+	report := projectClient.FailureReport()
+	result.FailedDocuments = len(report.Failures)
+	result.FailedErrorTypes = report.ErrorTypes
+
+	if err != nil {
+		return result, err
+	}
+
+	if !recordsIndexStatus(request.BlobType, request.SkipCommits) {
+		return result, nil
+	}
+
+	if err := projectClient.SetIndexStatus(ctx, request.BlobType, repo.GetToHash(), Version); err != nil {
+		logkit.WithError(err).WithField("projectID", request.ProjectID).Error("Error writing index status")
+	}
+
+	return result, nil
+}
+
+func indexRepository(ctx context.Context, idx *indexer.Indexer, request *server.JobRequest) error {
+	if err := idx.IndexBlobs(ctx, request.BlobType); err != nil {
+		return err
+	}
+
+	if !request.SkipCommits && request.BlobType == "blob" {
+		if err := idx.IndexCommits(ctx); err != nil {
+			return err
+		}
+	}
+
+	return idx.Flush(ctx)
+}
+
+// newPooledRepository is like newRepository, except that Gitaly connections
+// are taken from pool
+func newPooledRepository(ctx context.Context, pool *gitalyclient.Pool, request *server.JobRequest) (repository, error) {
+	projectID := strconv.FormatInt(request.ProjectID, 10)
+
+	if *gitBackendFlag != "gitaly" {
+		return newRepository(ctx, *gitBackendFlag, request.RepoPath, request.FromSHA, request.ToSHA, request.CorrelationID, projectID, request.ProjectPath)
+	}
+
+	config, err := git.ReadConfig(request.RepoPath, request.ProjectPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return git.NewGitalyClientWithPool(ctx, pool, config, request.FromSHA, request.ToSHA, request.CorrelationID, projectID)
+}
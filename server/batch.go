@@ -0,0 +1,186 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// ManifestEntry is a project listed in a batch manifest. Its repository is
+// indexed once for each of BlobTypes, or once for BlobType if BlobTypes is
+// empty. Wikis have a repository of their own, so they are listed on lines
+// of their own, which ReadManifest enforces.
+type ManifestEntry struct {
+	JobRequest
+	BlobTypes []string `json:"blob_types,omitempty"`
+}
+
+// validate rejects the entries indexing the same repository as a wiki and
+// as something else
+func (e *ManifestEntry) validate() error {
+	wiki := false
+	for _, blobType := range e.BlobTypes {
+		wiki = wiki || blobType == "wiki_blob"
+	}
+
+	if wiki && len(e.BlobTypes) > 1 {
+		return errors.New("wiki_blob can't be listed with other blob types, the wiki has a repository of its own")
+	}
+
+	return nil
+}
+
+// Requests returns the jobs of the entry
+func (e *ManifestEntry) Requests() []JobRequest {
+	if len(e.BlobTypes) == 0 {
+		return []JobRequest{e.JobRequest}
+	}
+
+	requests := make([]JobRequest, 0, len(e.BlobTypes))
+	for _, blobType := range e.BlobTypes {
+		request := e.JobRequest
+		request.BlobType = blobType
+		requests = append(requests, request)
+	}
+
+	return requests
+}
+
+// ReadManifest reads the entries of a manifest, which is either a JSON array
+// or newline-delimited JSON
+func ReadManifest(r io.Reader) ([]ManifestEntry, error) {
+	var data bytes.Buffer
+	if _, err := data.ReadFrom(r); err != nil {
+		return nil, err
+	}
+
+	decoder := json.NewDecoder(&data)
+	decoder.DisallowUnknownFields()
+
+	if bytes.HasPrefix(bytes.TrimSpace(data.Bytes()), []byte("[")) {
+		var entries []ManifestEntry
+		if err := decoder.Decode(&entries); err != nil {
+			return nil, fmt.Errorf("invalid manifest: %v", err)
+		}
+
+		for n := range entries {
+			if err := entries[n].validate(); err != nil {
+				return nil, fmt.Errorf("invalid manifest entry %d: %v", n+1, err)
+			}
+		}
+
+		return entries, nil
+	}
+
+	var entries []ManifestEntry
+	for decoder.More() {
+		var entry ManifestEntry
+		if err := decoder.Decode(&entry); err != nil {
+			return nil, fmt.Errorf("invalid manifest entry %d: %v", len(entries)+1, err)
+		}
+
+		if err := entry.validate(); err != nil {
+			return nil, fmt.Errorf("invalid manifest entry %d: %v", len(entries)+1, err)
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// BatchReport holds the outcome of every job of a batch, in the order of
+// the manifest
+type BatchReport struct {
+	Jobs    []Job        `json:"jobs"`
+	Summary BatchSummary `json:"summary"`
+}
+
+type BatchSummary struct {
+	Jobs      int `json:"jobs"`
+	Succeeded int `json:"succeeded"`
+	Failed    int `json:"failed"`
+	Canceled  int `json:"canceled"`
+
+	// FailedProjects lists the projects with a failed or canceled job
+	FailedProjects []int64 `json:"failed_projects"`
+}
+
+// Write writes the report as JSON
+func (r *BatchReport) Write(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+
+	return encoder.Encode(r)
+}
+
+// RunBatch runs the jobs of every entry with run, up to opts.Concurrency at
+// the same time. A failing job doesn't stop the others, and an invalid one
+// is reported as failed without being run. Once ctx is done, the remaining
+// jobs are canceled.
+func RunBatch(ctx context.Context, run Runner, entries []ManifestEntry, opts Options) *BatchReport {
+	var mu sync.Mutex
+	finished := make(map[string]Job)
+
+	onFinish := opts.OnFinish
+	opts.OnFinish = func(job Job) {
+		mu.Lock()
+		finished[job.ID] = job
+		mu.Unlock()
+
+		if onFinish != nil {
+			onFinish(job)
+		}
+	}
+
+	srv := New(ctx, run, opts)
+
+	var jobs []Job
+	for _, entry := range entries {
+		for _, request := range entry.Requests() {
+			job, err := srv.Submit(request)
+			if err != nil {
+				job = Job{Request: request, Status: JobFailed, Error: err.Error()}
+				if err == ErrShuttingDown {
+					job.Status = JobCanceled
+				}
+			}
+
+			jobs = append(jobs, job)
+		}
+	}
+
+	srv.Wait()
+
+	report := &BatchReport{Jobs: jobs, Summary: BatchSummary{FailedProjects: []int64{}}}
+	failedProjects := make(map[int64]bool)
+
+	for i, job := range jobs {
+		if job.ID != "" {
+			job = finished[job.ID]
+			report.Jobs[i] = job
+		}
+
+		switch job.Status {
+		case JobSucceeded:
+			report.Summary.Succeeded++
+		case JobFailed:
+			report.Summary.Failed++
+		case JobCanceled:
+			report.Summary.Canceled++
+		}
+
+		if job.Status != JobSucceeded && !failedProjects[job.Request.ProjectID] {
+			failedProjects[job.Request.ProjectID] = true
+			report.Summary.FailedProjects = append(report.Summary.FailedProjects, job.Request.ProjectID)
+		}
+	}
+
+	report.Summary.Jobs = len(jobs)
+
+	return report
+}
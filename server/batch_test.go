@@ -0,0 +1,134 @@
+package server_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-elasticsearch-indexer/server"
+)
+
+func TestReadManifest(t *testing.T) {
+	for name, manifest := range map[string]string{
+		"NDJSON": `{"project_id":1,"repo_path":"project-1.git","visibility_level":20,"repository_access_level":20}
+{"project_id":2,"repo_path":"project-2.wiki.git","blob_types":["wiki_blob"],"to_sha":"abc"}
+`,
+		"JSON array": `[
+  {"project_id":1,"repo_path":"project-1.git","visibility_level":20,"repository_access_level":20},
+  {"project_id":2,"repo_path":"project-2.wiki.git","blob_types":["wiki_blob"],"to_sha":"abc"}
+]`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			entries, err := server.ReadManifest(strings.NewReader(manifest))
+			require.NoError(t, err)
+			require.Len(t, entries, 2)
+
+			require.Equal(t, int64(1), entries[0].ProjectID)
+			require.Equal(t, int8(20), entries[0].Permissions().VisibilityLevel)
+			require.Len(t, entries[0].Requests(), 1)
+
+			requests := entries[1].Requests()
+			require.Len(t, requests, 1)
+			require.Equal(t, "wiki_blob", requests[0].BlobType)
+			require.Equal(t, "abc", requests[0].ToSHA)
+		})
+	}
+}
+
+func TestReadManifestRejectsInvalidEntries(t *testing.T) {
+	_, err := server.ReadManifest(strings.NewReader("{\"project_id\":1,\"repo_path\":\"project-1.git\"}\n{\"project\":2}\n"))
+	require.EqualError(t, err, `invalid manifest entry 2: json: unknown field "project"`)
+
+	_, err = server.ReadManifest(strings.NewReader(`[{"project_id":1},`))
+	require.Error(t, err)
+
+	// The repository of a project isn't its wiki
+	for _, manifest := range []string{
+		"{\"project_id\":1,\"repo_path\":\"project-1.git\"}\n{\"project_id\":2,\"repo_path\":\"project-2.git\",\"blob_types\":[\"blob\",\"wiki_blob\"]}\n",
+		`[{"project_id":1,"repo_path":"project-1.git"},{"project_id":2,"repo_path":"project-2.git","blob_types":["blob","wiki_blob"]}]`,
+	} {
+		_, err = server.ReadManifest(strings.NewReader(manifest))
+		require.EqualError(t, err, "invalid manifest entry 2: wiki_blob can't be listed with other blob types, the wiki has a repository of its own")
+	}
+}
+
+func TestRunBatch(t *testing.T) {
+	var mu sync.Mutex
+	var ran []string
+
+	run := func(ctx context.Context, request *server.JobRequest) (*server.JobResult, error) {
+		mu.Lock()
+		ran = append(ran, request.RepoPath+":"+request.BlobType)
+		mu.Unlock()
+
+		if request.ProjectID == 2 {
+			return &server.JobResult{FailedDocuments: 3}, errors.New("Failed to perform all operations")
+		}
+
+		return &server.JobResult{ToSHA: "head"}, nil
+	}
+
+	entries, err := server.ReadManifest(strings.NewReader(`{"project_id":1,"repo_path":"project-1.git"}
+{"project_id":2,"repo_path":"project-2.git"}
+{"project_id":3,"repo_path":"project-3.git","blob_type":"issue"}
+{"project_id":4,"repo_path":"project-4.git"}
+{"project_id":4,"repo_path":"project-4.wiki.git","blob_types":["wiki_blob"]}
+`))
+	require.NoError(t, err)
+
+	report := server.RunBatch(context.Background(), run, entries, server.Options{Concurrency: 2})
+
+	require.ElementsMatch(t, []string{"project-1.git:blob", "project-2.git:blob", "project-4.git:blob", "project-4.wiki.git:wiki_blob"}, ran)
+
+	require.Len(t, report.Jobs, 5)
+	require.Equal(t, server.JobSucceeded, report.Jobs[0].Status)
+	require.Equal(t, "head", report.Jobs[0].Result.ToSHA)
+	require.Equal(t, server.JobFailed, report.Jobs[1].Status)
+	require.Equal(t, 3, report.Jobs[1].Result.FailedDocuments)
+	require.Equal(t, server.JobFailed, report.Jobs[2].Status)
+	require.Equal(t, "unknown blob_type: issue", report.Jobs[2].Error)
+	require.Equal(t, "wiki_blob", report.Jobs[4].Request.BlobType)
+	require.Equal(t, server.JobSucceeded, report.Jobs[4].Status)
+
+	require.Equal(t, server.BatchSummary{
+		Jobs:           5,
+		Succeeded:      3,
+		Failed:         2,
+		FailedProjects: []int64{2, 3},
+	}, report.Summary)
+
+	var buf bytes.Buffer
+	require.NoError(t, report.Write(&buf))
+
+	var written map[string]interface{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &written))
+	require.Contains(t, written, "jobs")
+	require.Contains(t, written, "summary")
+}
+
+func TestRunBatchCancelsRemainingJobs(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	run := func(ctx context.Context, request *server.JobRequest) (*server.JobResult, error) {
+		cancel()
+		<-ctx.Done()
+
+		return nil, ctx.Err()
+	}
+
+	entries := []server.ManifestEntry{
+		{JobRequest: server.JobRequest{ProjectID: 1, RepoPath: "project-1.git"}},
+		{JobRequest: server.JobRequest{ProjectID: 2, RepoPath: "project-2.git"}},
+	}
+
+	report := server.RunBatch(ctx, run, entries, server.Options{Concurrency: 1})
+
+	require.Equal(t, 2, report.Summary.Canceled)
+	require.Equal(t, []int64{1, 2}, report.Summary.FailedProjects)
+}
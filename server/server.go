@@ -0,0 +1,374 @@
+// Package server runs indexing jobs submitted over HTTP or listed in a batch
+// manifest, so that a single process keeps its Gitaly and Elasticsearch
+// connections warm across projects.
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"gitlab.com/gitlab-org/labkit/correlation"
+	logkit "gitlab.com/gitlab-org/labkit/log"
+
+	"gitlab.com/gitlab-org/gitlab-elasticsearch-indexer/indexer"
+	"gitlab.com/gitlab-org/gitlab-elasticsearch-indexer/metrics"
+)
+
+const (
+	// DefaultConcurrency is the number of jobs run at the same time
+	DefaultConcurrency = 4
+
+	// maxFinishedJobs is the number of finished jobs whose status is kept,
+	// the oldest are forgotten first
+	maxFinishedJobs = 1000
+)
+
+type JobStatus string
+
+const (
+	JobQueued    JobStatus = "queued"
+	JobRunning   JobStatus = "running"
+	JobSucceeded JobStatus = "succeeded"
+	JobFailed    JobStatus = "failed"
+	JobCanceled  JobStatus = "canceled"
+)
+
+// ErrShuttingDown is returned when a job is submitted after the server
+// started shutting down
+var ErrShuttingDown = errors.New("the server is shutting down")
+
+// JobRequest describes the repository to index, as the command line does
+// for a single run
+type JobRequest struct {
+	ProjectID   int64  `json:"project_id"`
+	RepoPath    string `json:"repo_path"`
+	ProjectPath string `json:"project_path,omitempty"`
+	FromSHA     string `json:"from_sha,omitempty"`
+	ToSHA       string `json:"to_sha,omitempty"`
+	BlobType    string `json:"blob_type,omitempty"`
+	SkipCommits bool   `json:"skip_commits,omitempty"`
+
+	// Both levels have to be set for the permissions to be indexed
+	VisibilityLevel       *int8 `json:"visibility_level,omitempty"`
+	RepositoryAccessLevel *int8 `json:"repository_access_level,omitempty"`
+
+	// Timeout is a duration such as '5m'. Empty string means no timeout.
+	Timeout string `json:"timeout,omitempty"`
+
+	// CorrelationID defaults to the ID of the job
+	CorrelationID string `json:"correlation_id,omitempty"`
+}
+
+// Permissions returns the permissions to index, or nil if they are not
+// both set
+func (r *JobRequest) Permissions() *indexer.ProjectPermissions {
+	if r.VisibilityLevel == nil || r.RepositoryAccessLevel == nil {
+		return nil
+	}
+
+	return &indexer.ProjectPermissions{
+		VisibilityLevel:       *r.VisibilityLevel,
+		RepositoryAccessLevel: *r.RepositoryAccessLevel,
+	}
+}
+
+func (r *JobRequest) validate() (time.Duration, error) {
+	if r.ProjectID <= 0 {
+		return 0, errors.New("project_id is required")
+	}
+
+	if r.RepoPath == "" {
+		return 0, errors.New("repo_path is required")
+	}
+
+	switch r.BlobType {
+	case "":
+		r.BlobType = "blob"
+	case "blob", "wiki_blob":
+	default:
+		return 0, fmt.Errorf("unknown blob_type: %v", r.BlobType)
+	}
+
+	if r.Timeout == "" {
+		return 0, nil
+	}
+
+	timeout, err := time.ParseDuration(r.Timeout)
+	if err != nil {
+		return 0, fmt.Errorf("invalid timeout: %v", err)
+	}
+
+	return timeout, nil
+}
+
+// JobResult is what a Runner reports about a job
+type JobResult struct {
+	// FromSHA and ToSHA are the commits actually indexed, ToSHA being HEAD
+	// when the request didn't set it
+	FromSHA string `json:"from_sha,omitempty"`
+	ToSHA   string `json:"to_sha,omitempty"`
+
+	FailedDocuments  int            `json:"failed_documents"`
+	FailedErrorTypes map[string]int `json:"failed_error_types,omitempty"`
+}
+
+type Job struct {
+	ID      string     `json:"id"`
+	Request JobRequest `json:"request"`
+	Status  JobStatus  `json:"status"`
+	Error   string     `json:"error,omitempty"`
+	Result  *JobResult `json:"result,omitempty"`
+
+	CreatedAt  time.Time  `json:"created_at"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+
+	timeout time.Duration
+}
+
+// Options tunes a Server
+type Options struct {
+	// Concurrency is the number of jobs run at the same time, which
+	// defaults to DefaultConcurrency
+	Concurrency int
+
+	// OnFinish, if set, is called with every job once it's finished
+	OnFinish func(Job)
+}
+
+// Runner indexes the repository of a job. Once ctx is done it should stop
+// fetching new work and return.
+type Runner func(ctx context.Context, request *JobRequest) (*JobResult, error)
+
+// Server queues jobs and runs up to a given number of them at the same time.
+// Jobs of the same project run one after the other, in the order they were
+// submitted.
+type Server struct {
+	ctx      context.Context
+	run      Runner
+	onFinish func(Job)
+	slots    chan struct{}
+	wg       sync.WaitGroup
+
+	mu   sync.Mutex
+	jobs map[string]*Job
+
+	// finished holds the IDs of the finished jobs, oldest first
+	finished []string
+
+	// queues holds the jobs waiting for each project with a job running
+	queues map[int64][]*Job
+}
+
+// New creates a Server running jobs with run. Once ctx is done, submitted
+// jobs are refused, queued ones are canceled and running ones are stopped.
+func New(ctx context.Context, run Runner, opts Options) *Server {
+	concurrency := opts.Concurrency
+	if concurrency <= 0 {
+		concurrency = DefaultConcurrency
+	}
+
+	return &Server{
+		ctx:      ctx,
+		run:      run,
+		onFinish: opts.OnFinish,
+		slots:    make(chan struct{}, concurrency),
+		jobs:     make(map[string]*Job),
+		queues:   make(map[int64][]*Job),
+	}
+}
+
+// Submit queues a job and returns a snapshot of it
+func (s *Server) Submit(request JobRequest) (Job, error) {
+	timeout, err := request.validate()
+	if err != nil {
+		return Job{}, err
+	}
+
+	id, err := correlation.RandomID()
+	if err != nil {
+		return Job{}, err
+	}
+
+	if request.CorrelationID == "" {
+		request.CorrelationID = id
+	}
+
+	job := &Job{
+		ID:        id,
+		Request:   request,
+		Status:    JobQueued,
+		CreatedAt: time.Now(),
+		timeout:   timeout,
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.ctx.Err() != nil {
+		return Job{}, ErrShuttingDown
+	}
+
+	s.jobs[job.ID] = job
+
+	queue, active := s.queues[request.ProjectID]
+	s.queues[request.ProjectID] = append(queue, job)
+
+	if !active {
+		s.wg.Add(1)
+		go s.runProject(request.ProjectID)
+	}
+
+	return *job, nil
+}
+
+// Job returns a snapshot of a job, if it's known
+func (s *Server) Job(id string) (Job, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job, ok := s.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+
+	return *job, true
+}
+
+// Jobs returns a snapshot of the known jobs, in the order they were
+// submitted
+func (s *Server) Jobs() []Job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	jobs := make([]Job, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		jobs = append(jobs, *job)
+	}
+
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].CreatedAt.Before(jobs[j].CreatedAt)
+	})
+
+	return jobs
+}
+
+// Wait waits for every job to finish. Unless the context of the server is
+// done, jobs submitted in the meantime are waited for too.
+func (s *Server) Wait() {
+	s.wg.Wait()
+}
+
+// runProject runs the queued jobs of a project until there is none left
+func (s *Server) runProject(projectID int64) {
+	defer s.wg.Done()
+
+	for {
+		s.mu.Lock()
+		queue := s.queues[projectID]
+		if len(queue) == 0 {
+			delete(s.queues, projectID)
+			s.mu.Unlock()
+			return
+		}
+		job := queue[0]
+		s.queues[projectID] = queue[1:]
+		s.mu.Unlock()
+
+		s.runJob(job)
+	}
+}
+
+func (s *Server) runJob(job *Job) {
+	// A free slot may be picked over the done context, so it's checked
+	// first
+	if err := s.ctx.Err(); err != nil {
+		s.finish(job, nil, err)
+		return
+	}
+
+	select {
+	case s.slots <- struct{}{}:
+	case <-s.ctx.Done():
+		s.finish(job, nil, s.ctx.Err())
+		return
+	}
+	defer func() { <-s.slots }()
+
+	s.start(job)
+
+	ctx := s.ctx
+	if job.timeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, job.timeout)
+		defer cancel()
+	}
+
+	result, err := s.run(ctx, &job.Request)
+	s.finish(job, result, err)
+}
+
+func (s *Server) start(job *Job) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	job.Status = JobRunning
+	job.StartedAt = &now
+
+	logkit.WithFields(jobFields(job)).Info("Starting job")
+}
+
+func (s *Server) finish(job *Job, result *JobResult, err error) {
+	snapshot := s.record(job, result, err)
+
+	if s.onFinish != nil {
+		s.onFinish(snapshot)
+	}
+}
+
+func (s *Server) record(job *Job, result *JobResult, err error) Job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	job.FinishedAt = &now
+	job.Result = result
+
+	switch {
+	case err == nil:
+		job.Status = JobSucceeded
+		logkit.WithFields(jobFields(job)).Info("Job succeeded")
+	case s.ctx.Err() != nil:
+		job.Status = JobCanceled
+		job.Error = err.Error()
+		logkit.WithFields(jobFields(job)).WithError(err).Warn("Job canceled")
+	default:
+		job.Status = JobFailed
+		job.Error = err.Error()
+		logkit.WithFields(jobFields(job)).WithError(err).Error("Job failed")
+	}
+
+	metrics.JobsTotal.WithLabelValues(string(job.Status)).Inc()
+
+	s.finished = append(s.finished, job.ID)
+	if len(s.finished) > maxFinishedJobs {
+		delete(s.jobs, s.finished[0])
+		s.finished = s.finished[1:]
+	}
+
+	return *job
+}
+
+func jobFields(job *Job) logkit.Fields {
+	return logkit.Fields{
+		"jobID":         job.ID,
+		"projectID":     job.Request.ProjectID,
+		"blobType":      job.Request.BlobType,
+		"correlationID": job.Request.CorrelationID,
+	}
+}
@@ -0,0 +1,297 @@
+package server_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-elasticsearch-indexer/server"
+)
+
+// blockingRunner runs jobs until they are released, recording the order
+// they started in and how many ran at the same time
+type blockingRunner struct {
+	mu         sync.Mutex
+	started    []int64
+	running    int
+	maxRunning int
+	release    chan struct{}
+}
+
+func newBlockingRunner() *blockingRunner {
+	return &blockingRunner{release: make(chan struct{})}
+}
+
+func (r *blockingRunner) run(ctx context.Context, request *server.JobRequest) (*server.JobResult, error) {
+	r.mu.Lock()
+	r.started = append(r.started, request.ProjectID)
+	r.running++
+	if r.running > r.maxRunning {
+		r.maxRunning = r.running
+	}
+	r.mu.Unlock()
+
+	defer func() {
+		r.mu.Lock()
+		r.running--
+		r.mu.Unlock()
+	}()
+
+	select {
+	case <-r.release:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	if request.FromSHA == "broken" {
+		return &server.JobResult{FailedDocuments: 1}, errors.New("Failed to perform all operations")
+	}
+
+	return &server.JobResult{ToSHA: "head"}, nil
+}
+
+func (r *blockingRunner) startedCount() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return len(r.started)
+}
+
+func waitForStatus(t *testing.T, srv *server.Server, id string, status server.JobStatus) server.Job {
+	var job server.Job
+
+	require.Eventually(t, func() bool {
+		job, _ = srv.Job(id)
+		return job.Status == status
+	}, time.Second, time.Millisecond)
+
+	return job
+}
+
+func TestJobsOfAProjectRunOneAfterTheOther(t *testing.T) {
+	runner := newBlockingRunner()
+	srv := server.New(context.Background(), runner.run, server.Options{Concurrency: 4})
+
+	first, err := srv.Submit(server.JobRequest{ProjectID: 1, RepoPath: "project-1.git"})
+	require.NoError(t, err)
+	second, err := srv.Submit(server.JobRequest{ProjectID: 1, RepoPath: "project-1.git", FromSHA: "broken"})
+	require.NoError(t, err)
+
+	waitForStatus(t, srv, first.ID, server.JobRunning)
+	job, _ := srv.Job(second.ID)
+	require.Equal(t, server.JobQueued, job.Status)
+
+	runner.release <- struct{}{}
+	job = waitForStatus(t, srv, first.ID, server.JobSucceeded)
+	require.Equal(t, "head", job.Result.ToSHA)
+	require.NotNil(t, job.StartedAt)
+	require.NotNil(t, job.FinishedAt)
+
+	waitForStatus(t, srv, second.ID, server.JobRunning)
+	runner.release <- struct{}{}
+	job = waitForStatus(t, srv, second.ID, server.JobFailed)
+	require.Equal(t, "Failed to perform all operations", job.Error)
+	require.Equal(t, 1, job.Result.FailedDocuments)
+
+	srv.Wait()
+	require.Equal(t, 1, runner.maxRunning)
+}
+
+func TestConcurrencyIsBounded(t *testing.T) {
+	runner := newBlockingRunner()
+	srv := server.New(context.Background(), runner.run, server.Options{Concurrency: 2})
+
+	for projectID := int64(1); projectID <= 3; projectID++ {
+		_, err := srv.Submit(server.JobRequest{ProjectID: projectID, RepoPath: "project.git"})
+		require.NoError(t, err)
+	}
+
+	require.Eventually(t, func() bool { return runner.startedCount() == 2 }, time.Second, time.Millisecond)
+
+	for i := 0; i < 3; i++ {
+		runner.release <- struct{}{}
+	}
+	srv.Wait()
+
+	require.Equal(t, 2, runner.maxRunning)
+	require.ElementsMatch(t, []int64{1, 2, 3}, runner.started)
+}
+
+func TestJobsAreStoppedOnShutdown(t *testing.T) {
+	runner := newBlockingRunner()
+	ctx, cancel := context.WithCancel(context.Background())
+	srv := server.New(ctx, runner.run, server.Options{Concurrency: 1})
+
+	running, err := srv.Submit(server.JobRequest{ProjectID: 1, RepoPath: "project-1.git"})
+	require.NoError(t, err)
+	waitForStatus(t, srv, running.ID, server.JobRunning)
+
+	queued, err := srv.Submit(server.JobRequest{ProjectID: 2, RepoPath: "project-2.git"})
+	require.NoError(t, err)
+
+	cancel()
+	srv.Wait()
+
+	job, _ := srv.Job(running.ID)
+	require.Equal(t, server.JobCanceled, job.Status)
+	job, _ = srv.Job(queued.ID)
+	require.Equal(t, server.JobCanceled, job.Status)
+	require.Nil(t, job.StartedAt)
+	require.Equal(t, 1, runner.startedCount())
+
+	_, err = srv.Submit(server.JobRequest{ProjectID: 3, RepoPath: "project-3.git"})
+	require.ErrorIs(t, err, server.ErrShuttingDown)
+}
+
+func TestJobTimeout(t *testing.T) {
+	runner := newBlockingRunner()
+	srv := server.New(context.Background(), runner.run, server.Options{Concurrency: 1})
+
+	job, err := srv.Submit(server.JobRequest{ProjectID: 1, RepoPath: "project-1.git", Timeout: "10ms"})
+	require.NoError(t, err)
+
+	job = waitForStatus(t, srv, job.ID, server.JobFailed)
+	require.Equal(t, context.DeadlineExceeded.Error(), job.Error)
+}
+
+func TestSubmitValidatesRequests(t *testing.T) {
+	srv := server.New(context.Background(), newBlockingRunner().run, server.Options{Concurrency: 1})
+
+	for _, tc := range []struct {
+		request server.JobRequest
+		err     string
+	}{
+		{server.JobRequest{RepoPath: "project.git"}, "project_id is required"},
+		{server.JobRequest{ProjectID: 1}, "repo_path is required"},
+		{server.JobRequest{ProjectID: 1, RepoPath: "project.git", BlobType: "issue"}, "unknown blob_type: issue"},
+		{server.JobRequest{ProjectID: 1, RepoPath: "project.git", Timeout: "soon"}, `invalid timeout: time: invalid duration "soon"`},
+	} {
+		_, err := srv.Submit(tc.request)
+		require.EqualError(t, err, tc.err)
+	}
+
+	require.Empty(t, srv.Jobs())
+}
+
+func TestJobRequestPermissions(t *testing.T) {
+	level := int8(20)
+
+	require.Nil(t, (&server.JobRequest{VisibilityLevel: &level}).Permissions())
+
+	permissions := (&server.JobRequest{VisibilityLevel: &level, RepositoryAccessLevel: &level}).Permissions()
+	require.Equal(t, int8(20), permissions.VisibilityLevel)
+	require.Equal(t, int8(20), permissions.RepositoryAccessLevel)
+}
+
+func TestHandler(t *testing.T) {
+	runner := newBlockingRunner()
+	srv := server.New(context.Background(), runner.run, server.Options{Concurrency: 1})
+
+	ts := httptest.NewServer(srv.Handler())
+	defer ts.Close()
+
+	resp, err := http.Post(ts.URL+"/jobs", "application/json", strings.NewReader(`{"project_id":1,"repo_path":"project-1.git","to_sha":"abc","visibility_level":20,"repository_access_level":10}`))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	var submitted server.Job
+	require.Equal(t, http.StatusAccepted, resp.StatusCode)
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&submitted))
+	require.Equal(t, "/jobs/"+submitted.ID, resp.Header.Get("Location"))
+	require.Equal(t, "blob", submitted.Request.BlobType)
+	require.Equal(t, submitted.ID, submitted.Request.CorrelationID)
+	require.Equal(t, int8(10), *submitted.Request.RepositoryAccessLevel)
+
+	runner.release <- struct{}{}
+	waitForStatus(t, srv, submitted.ID, server.JobSucceeded)
+
+	resp, err = http.Get(ts.URL + "/jobs/" + submitted.ID)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	var job server.Job
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&job))
+	require.Equal(t, server.JobSucceeded, job.Status)
+	require.Equal(t, "head", job.Result.ToSHA)
+
+	resp, err = http.Get(ts.URL + "/jobs")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	var jobs []server.Job
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&jobs))
+	require.Len(t, jobs, 1)
+	require.Equal(t, submitted.ID, jobs[0].ID)
+}
+
+func TestHandlerErrors(t *testing.T) {
+	srv := server.New(context.Background(), newBlockingRunner().run, server.Options{Concurrency: 1})
+
+	ts := httptest.NewServer(srv.Handler())
+	defer ts.Close()
+
+	for _, tc := range []struct {
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{http.MethodPost, "/jobs", `{"project_id":1}`, http.StatusBadRequest},
+		{http.MethodPost, "/jobs", `{"project_id":1,"repo_path":"project-1.git","unknown":true}`, http.StatusBadRequest},
+		{http.MethodPost, "/jobs", `not json`, http.StatusBadRequest},
+		{http.MethodGet, "/jobs/unknown", "", http.StatusNotFound},
+		{http.MethodDelete, "/jobs", "", http.StatusMethodNotAllowed},
+		{http.MethodPost, "/jobs/unknown", "", http.StatusMethodNotAllowed},
+	} {
+		req, err := http.NewRequest(tc.method, ts.URL+tc.path, strings.NewReader(tc.body))
+		require.NoError(t, err)
+
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+
+		require.Equal(t, tc.status, resp.StatusCode, "%s %s %s", tc.method, tc.path, tc.body)
+	}
+}
+
+func TestRequireToken(t *testing.T) {
+	srv := server.New(context.Background(), newBlockingRunner().run, server.Options{Concurrency: 1})
+
+	for _, tc := range []struct {
+		token         string
+		authorization string
+		status        int
+	}{
+		{"secret", "", http.StatusUnauthorized},
+		{"secret", "Bearer wrong", http.StatusUnauthorized},
+		{"secret", "secret", http.StatusUnauthorized},
+		{"secret", "Bearer secret", http.StatusOK},
+		{"", "", http.StatusUnauthorized},
+		{"", "Bearer ", http.StatusUnauthorized},
+	} {
+		ts := httptest.NewServer(server.RequireToken(tc.token, srv.Handler()))
+
+		req, err := http.NewRequest(http.MethodGet, ts.URL+"/jobs", nil)
+		require.NoError(t, err)
+		if tc.authorization != "" {
+			req.Header.Set("Authorization", tc.authorization)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		ts.Close()
+
+		require.Equal(t, tc.status, resp.StatusCode, "token %q, authorization %q", tc.token, tc.authorization)
+	}
+}